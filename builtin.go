@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fzft/my-actor/internel"
+	"time"
+)
+
+// the actor types that pipeline specs can use out of the box
+func init() {
+	internel.RegisterActorType("identity", func(name string, config map[string]any) (internel.Actor, error) {
+		return &identityActor{name: name}, nil
+	})
+
+	internel.RegisterActorType("delay", func(name string, config map[string]any) (internel.Actor, error) {
+		raw, ok := config["delay"]
+		if !ok {
+			return nil, fmt.Errorf("delay is required")
+		}
+		delay, err := time.ParseDuration(fmt.Sprint(raw))
+		if err != nil {
+			return nil, fmt.Errorf("delay: %w", err)
+		}
+		return &delayActor{name: name, delay: delay}, nil
+	})
+
+	internel.RegisterActorType("set", func(name string, config map[string]any) (internel.Actor, error) {
+		fields, ok := config["fields"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("fields is required")
+		}
+		return &setActor{name: name, fields: fields}, nil
+	})
+}
+
+// identityActor passes the msg through
+type identityActor struct {
+	name string
+}
+
+func (a *identityActor) String() string {
+	return a.name
+}
+
+func (a *identityActor) Receive(ctx *internel.Context, msg any) (any, error) {
+	return msg, nil
+}
+
+// delayActor passes the msg through after a delay, it simulates a slow stage
+type delayActor struct {
+	name  string
+	delay time.Duration
+}
+
+func (a *delayActor) String() string {
+	return a.name
+}
+
+func (a *delayActor) Receive(ctx *internel.Context, msg any) (any, error) {
+	time.Sleep(a.delay)
+	return msg, nil
+}
+
+// setActor sets the configured fields on a JSON object msg
+type setActor struct {
+	name   string
+	fields map[string]any
+}
+
+func (a *setActor) String() string {
+	return a.name
+}
+
+func (a *setActor) Receive(ctx *internel.Context, msg any) (any, error) {
+	obj, ok := msg.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s not support msg type %T", a.name, msg)
+	}
+
+	out := make(map[string]any, len(obj)+len(a.fields))
+	for k, v := range obj {
+		out[k] = v
+	}
+	for k, v := range a.fields {
+		out[k] = v
+	}
+	return out, nil
+}
@@ -17,6 +17,7 @@ type Actor interface {
 	String() string
 
 	// Receive is the method that defines the actor's behavior when it receives a message.
+	// ctx.Envelope() returns the uid, headers and the other metadata of the message
 	Receive(ctx *Context, msg any) (any, error)
 }
 
@@ -72,7 +73,7 @@ func (d *DefaultActor) PreStart() {
 	panic("implement me")
 }
 
-func (d *DefaultActor) Receive(ctx Context, msg any) error {
+func (d *DefaultActor) Receive(ctx *Context, msg any) (any, error) {
 	//TODO implement me
 	panic("implement me")
 }
@@ -0,0 +1,624 @@
+package internel
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// ErrUnregisteredType is the error of a codec asked to encode or decode a type missing from its registry
+var ErrUnregisteredType = errors.New("type is not registered")
+
+// Codec turns the payload of a message into bytes and back, e.g. to send it to a remote engine
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte) (any, error)
+}
+
+// MessageTypes is an actor that declares the types of the messages it receives and returns, one sample value per type
+// the types the durable backends encode must be declared too, e.g. the events and the snapshot of an EventSourcedActor, or the values of its FileStore
+// once the engine has a type registry, Ready fails if one of them is not registered
+// it also fails for an actor whose messages are encoded and that declares nothing: one with a journal or a FileStore,
+// one that sends to a remote actor, or any actor once the SinkPool has a FileSink; a TypedActor declares its In and Out
+type MessageTypes interface {
+	MessageTypes() []any
+}
+
+// codecBackend is a durable backend that encodes its values with a Codec, e.g. a FileSink, a FileJournal or a FileStore
+// Ready sets a JSONCodec of the engine's type registry on the ones opened without a codec
+type codecBackend interface {
+	setDefaultCodec(codec Codec)
+}
+
+// plainJSON is the codec of the durable backends without a codec, their values are decoded as plain JSON, e.g. map[string]any
+var plainJSON = NewJSONCodec(nil)
+
+// codecOrPlainJSON returns codec, or plainJSON if it is nil
+func codecOrPlainJSON(codec Codec) Codec {
+	if codec == nil {
+		return plainJSON
+	}
+	return codec
+}
+
+// TypeRegistry maps stable names to Go types, so a codec decodes a payload into the type it was encoded from
+// the names go on the wire, every engine of a deployment must register the same names for the same types
+type TypeRegistry struct {
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+// NewTypeRegistry returns a registry of the builtin types, e.g. "string", "int", "float64", "bytes" and "map"
+func NewTypeRegistry() *TypeRegistry {
+	r := &TypeRegistry{
+		types: make(map[string]reflect.Type),
+		names: make(map[reflect.Type]string),
+	}
+	builtins := map[string]any{
+		"bool": false, "string": "", "bytes": []byte(nil),
+		"int": 0, "int8": int8(0), "int16": int16(0), "int32": int32(0), "int64": int64(0),
+		"uint": uint(0), "uint8": uint8(0), "uint16": uint16(0), "uint32": uint32(0), "uint64": uint64(0),
+		"float32": float32(0), "float64": float64(0),
+		"map": map[string]any(nil), "list": []any(nil),
+	}
+	for name, sample := range builtins {
+		r.MustRegister(name, sample)
+	}
+	return r
+}
+
+// Register maps name to the type of sample, e.g. Register("orders.Created", Created{})
+// a value and a pointer are distinct types, register the one the actors send
+func (r *TypeRegistry) Register(name string, sample any) error {
+	if name == "" {
+		return fmt.Errorf("type name is empty")
+	}
+	if sample == nil {
+		return fmt.Errorf("type %s: sample is nil", name)
+	}
+	t := reflect.TypeOf(sample)
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return fmt.Errorf("type %s: %s can not be encoded", name, t)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if registered, ok := r.types[name]; ok && registered != t {
+		return fmt.Errorf("type %s is already registered as %s", name, registered)
+	}
+	if registered, ok := r.names[t]; ok && registered != name {
+		return fmt.Errorf("type %s is already registered as %s", t, registered)
+	}
+	r.types[name] = t
+	r.names[t] = name
+	return nil
+}
+
+// MustRegister is Register that panics on error, e.g. in an init function
+func (r *TypeRegistry) MustRegister(name string, sample any) {
+	if err := r.Register(name, sample); err != nil {
+		panic(err)
+	}
+}
+
+// NameOf returns the name of the type of v
+func (r *TypeRegistry) NameOf(v any) (string, error) {
+	return r.nameOf(reflect.TypeOf(v))
+}
+
+func (r *TypeRegistry) nameOf(t reflect.Type) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, ok := r.names[t]
+	if !ok {
+		return "", fmt.Errorf("%w: %v", ErrUnregisteredType, t)
+	}
+	return name, nil
+}
+
+// TypeOf returns the type registered as name
+func (r *TypeRegistry) TypeOf(name string) (reflect.Type, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnregisteredType, name)
+	}
+	return t, nil
+}
+
+// JSONCodec encodes the payload as JSON, tagged with its type name to be decoded into its type
+// without a registry, the payload is plain JSON and the receiver gets its JSON decoding, e.g. map[string]any
+type JSONCodec struct {
+	registry *TypeRegistry
+}
+
+func NewJSONCodec(registry *TypeRegistry) *JSONCodec {
+	return &JSONCodec{registry: registry}
+}
+
+// typedJSON is a payload of the JSONCodec with a registry, Type is empty for nil
+type typedJSON struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (c *JSONCodec) Marshal(v any) ([]byte, error) {
+	if c.registry == nil {
+		return json.Marshal(v)
+	}
+	if v == nil {
+		return json.Marshal(typedJSON{Data: json.RawMessage("null")})
+	}
+	name, err := c.registry.NameOf(v)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(typedJSON{Type: name, Data: data})
+}
+
+func (c *JSONCodec) Unmarshal(data []byte) (any, error) {
+	if c.registry == nil {
+		var v any
+		err := json.Unmarshal(data, &v)
+		return v, err
+	}
+	var typed typedJSON
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return nil, err
+	}
+	if typed.Type == "" {
+		return nil, nil
+	}
+	t, err := c.registry.TypeOf(typed.Type)
+	if err != nil {
+		return nil, err
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(typed.Data, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// GobCodec encodes the payload with encoding/gob after its type name
+// the concrete types held by interface fields, e.g. in a map[string]any, must be registered with gob.Register too
+type GobCodec struct {
+	registry *TypeRegistry
+}
+
+func NewGobCodec(registry *TypeRegistry) *GobCodec {
+	return &GobCodec{registry: registry}
+}
+
+func (c *GobCodec) Marshal(v any) ([]byte, error) {
+	if v == nil {
+		return appendName(nil, ""), nil
+	}
+	name, err := c.registry.NameOf(v)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(appendName(nil, name))
+	if err := gob.NewEncoder(buf).EncodeValue(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *GobCodec) Unmarshal(data []byte) (any, error) {
+	d := &binaryDecoder{buf: data, registry: c.registry}
+	t, err := d.typ()
+	if err != nil || t == nil {
+		return nil, err
+	}
+	ptr := reflect.New(t)
+	if err := gob.NewDecoder(bytes.NewReader(d.buf)).DecodeValue(ptr); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// BinaryCodec is a compact encoding of the payload: its type name, then its fields in order, without their names
+// integers are varints, the types implementing encoding.BinaryMarshaler, e.g. time.Time, encode themselves
+// both ends must have the same definition of the types, a field added on one end only breaks the decoding
+type BinaryCodec struct {
+	registry *TypeRegistry
+}
+
+func NewBinaryCodec(registry *TypeRegistry) *BinaryCodec {
+	return &BinaryCodec{registry: registry}
+}
+
+func (c *BinaryCodec) Marshal(v any) ([]byte, error) {
+	e := &binaryEncoder{registry: c.registry}
+	if err := e.any(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (c *BinaryCodec) Unmarshal(data []byte) (any, error) {
+	d := &binaryDecoder{buf: data, registry: c.registry}
+	v, err := d.any()
+	if err != nil {
+		return nil, err
+	}
+	if len(d.buf) > 0 {
+		return nil, fmt.Errorf("binary codec: %d trailing bytes", len(d.buf))
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+	return v.Interface(), nil
+}
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// selfEncoding reports whether the values of t encode themselves with encoding.BinaryMarshaler
+func selfEncoding(t reflect.Type) bool {
+	ptr := reflect.PointerTo(t)
+	return t.Kind() != reflect.Pointer && ptr.Implements(binaryMarshalerType) && ptr.Implements(binaryUnmarshalerType)
+}
+
+// appendName appends a type name as its length then its bytes, the empty name is nil
+func appendName(buf []byte, name string) []byte {
+	buf = appendUvarint(buf, uint64(len(name)))
+	return append(buf, name...)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, x int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+type binaryEncoder struct {
+	buf      []byte
+	registry *TypeRegistry
+}
+
+// any encodes a value of any type, its type name then the value
+func (e *binaryEncoder) any(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = appendName(e.buf, "")
+		return nil
+	}
+	name, err := e.registry.nameOf(v.Type())
+	if err != nil {
+		return err
+	}
+	e.buf = appendName(e.buf, name)
+	return e.value(v)
+}
+
+func (e *binaryEncoder) value(v reflect.Value) error {
+	if selfEncoding(v.Type()) {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		data, err := ptr.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.bytes(data)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.buf = appendVarint(e.buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.buf = appendUvarint(e.buf, v.Uint())
+	case reflect.Float32:
+		var tmp [4]byte
+		binary.BigEndian.PutUint32(tmp[:], math.Float32bits(float32(v.Float())))
+		e.buf = append(e.buf, tmp[:]...)
+	case reflect.Float64:
+		var tmp [8]byte
+		binary.BigEndian.PutUint64(tmp[:], math.Float64bits(v.Float()))
+		e.buf = append(e.buf, tmp[:]...)
+	case reflect.String:
+		e.bytes([]byte(v.String()))
+	case reflect.Slice:
+		// the length is shifted by one, 0 is a nil slice
+		if v.IsNil() {
+			e.buf = append(e.buf, 0)
+			return nil
+		}
+		e.buf = appendUvarint(e.buf, uint64(v.Len())+1)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.buf = append(e.buf, v.Bytes()...)
+			return nil
+		}
+		return e.elems(v)
+	case reflect.Array:
+		return e.elems(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0)
+			return nil
+		}
+		e.buf = appendUvarint(e.buf, uint64(v.Len())+1)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.value(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.value(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := e.value(v.Field(i)); err != nil {
+				return fmt.Errorf("%s.%s: %w", t, t.Field(i).Name, err)
+			}
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0)
+			return nil
+		}
+		e.buf = append(e.buf, 1)
+		return e.value(v.Elem())
+	case reflect.Interface:
+		return e.any(v.Elem())
+	default:
+		return fmt.Errorf("binary codec: %s can not be encoded", v.Type())
+	}
+	return nil
+}
+
+func (e *binaryEncoder) elems(v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := e.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *binaryEncoder) bytes(data []byte) {
+	e.buf = appendUvarint(e.buf, uint64(len(data)))
+	e.buf = append(e.buf, data...)
+}
+
+var errShortBuffer = errors.New("binary codec: unexpected end of data")
+
+type binaryDecoder struct {
+	buf      []byte
+	registry *TypeRegistry
+}
+
+// typ decodes a type name, nil for the empty name
+func (d *binaryDecoder) typ() (reflect.Type, error) {
+	name, err := d.bytes()
+	if err != nil || len(name) == 0 {
+		return nil, err
+	}
+	return d.registry.TypeOf(string(name))
+}
+
+// any decodes a value encoded by binaryEncoder.any, the zero Value for nil
+func (d *binaryDecoder) any() (reflect.Value, error) {
+	t, err := d.typ()
+	if err != nil || t == nil {
+		return reflect.Value{}, err
+	}
+	v := reflect.New(t).Elem()
+	if err := d.value(v); err != nil {
+		return reflect.Value{}, err
+	}
+	return v, nil
+}
+
+func (d *binaryDecoder) value(v reflect.Value) error {
+	if selfEncoding(v.Type()) {
+		data, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.byte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(d.buf)
+		if n <= 0 {
+			return errShortBuffer
+		}
+		d.buf = d.buf[n:]
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		v.SetUint(x)
+	case reflect.Float32:
+		if len(d.buf) < 4 {
+			return errShortBuffer
+		}
+		v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(d.buf))))
+		d.buf = d.buf[4:]
+	case reflect.Float64:
+		if len(d.buf) < 8 {
+			return errShortBuffer
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(d.buf)))
+		d.buf = d.buf[8:]
+	case reflect.String:
+		data, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(data))
+	case reflect.Slice:
+		n, err := d.length()
+		if err != nil || n < 0 {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if len(d.buf) < n {
+				return errShortBuffer
+			}
+			v.SetBytes(append([]byte{}, d.buf[:n]...))
+			d.buf = d.buf[n:]
+			return nil
+		}
+		// grow as the elements are decoded, a corrupt length must not allocate for it
+		slice := reflect.MakeSlice(v.Type(), 0, minInt(n, len(d.buf)))
+		for i := 0; i < n; i++ {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		v.Set(slice)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := d.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.length()
+		if err != nil || n < 0 {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), minInt(n, len(d.buf)))
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.value(key); err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := d.value(v.Field(i)); err != nil {
+				return fmt.Errorf("%s.%s: %w", t, t.Field(i).Name, err)
+			}
+		}
+	case reflect.Pointer:
+		present, err := d.byte()
+		if err != nil || present == 0 {
+			return err
+		}
+		ptr := reflect.New(v.Type().Elem())
+		if err := d.value(ptr.Elem()); err != nil {
+			return err
+		}
+		v.Set(ptr)
+	case reflect.Interface:
+		elem, err := d.any()
+		if err != nil || !elem.IsValid() {
+			return err
+		}
+		if !elem.Type().AssignableTo(v.Type()) {
+			return fmt.Errorf("binary codec: %s is not assignable to %s", elem.Type(), v.Type())
+		}
+		v.Set(elem)
+	default:
+		return fmt.Errorf("binary codec: %s can not be decoded", v.Type())
+	}
+	return nil
+}
+
+func (d *binaryDecoder) byte() (byte, error) {
+	if len(d.buf) == 0 {
+		return 0, errShortBuffer
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errShortBuffer
+	}
+	d.buf = d.buf[n:]
+	return x, nil
+}
+
+// length decodes the length of a slice or a map, -1 for nil
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("binary codec: length %d is too large", n-1)
+	}
+	return int(n) - 1, nil
+}
+
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(d.buf)) < n {
+		return nil, errShortBuffer
+	}
+	data := d.buf[:n]
+	d.buf = d.buf[n:]
+	return data, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,321 @@
+package internel
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type Order struct {
+	ID       string
+	Amount   float64
+	Quantity int
+	Tags     []string
+	Created  time.Time
+	Customer *Customer
+	Extra    map[string]any
+	note     string
+}
+
+type Customer struct {
+	Name string
+}
+
+// Shipper declares the types it receives and returns, and records the orders
+type Shipper struct {
+	orders chan Order
+}
+
+func (s *Shipper) Receive(ctx *Context, msg any) (any, error) {
+	order := msg.(Order)
+	s.orders <- order
+	return order.ID, nil
+}
+
+func (s *Shipper) MessageTypes() []any {
+	return []any{Order{}, ""}
+}
+
+func (s *Shipper) String() string {
+	return "shipper"
+}
+
+func newOrderRegistry() *TypeRegistry {
+	types := NewTypeRegistry()
+	types.MustRegister("orders.Order", Order{})
+	return types
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	types := newOrderRegistry()
+	order := Order{
+		ID:       "order-1",
+		Amount:   12.5,
+		Quantity: -3,
+		Tags:     []string{"a", "b"},
+		Created:  time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		Customer: &Customer{Name: "acme"},
+		Extra:    map[string]any{"priority": 1, "gift": true},
+		note:     "not encoded",
+	}
+
+	for name, codec := range map[string]Codec{
+		"binary": NewBinaryCodec(types),
+		"gob":    NewGobCodec(types),
+		"json":   NewJSONCodec(types),
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, v := range []any{"hello", 42, []byte{1, 2}, nil} {
+				data, err := codec.Marshal(v)
+				assert.Nil(t, err)
+				decoded, err := codec.Unmarshal(data)
+				assert.Nil(t, err)
+				assert.Equal(t, v, decoded)
+			}
+
+			data, err := codec.Marshal(order)
+			assert.Nil(t, err)
+			decoded, err := codec.Unmarshal(data)
+			assert.Nil(t, err)
+			got, ok := decoded.(Order)
+			assert.True(t, ok)
+			assert.Equal(t, order.ID, got.ID)
+			assert.Equal(t, order.Tags, got.Tags)
+			assert.Equal(t, *order.Customer, *got.Customer)
+			assert.True(t, order.Created.Equal(got.Created))
+			assert.Equal(t, "", got.note)
+			if name == "binary" {
+				// the binary codec keeps the types in the interface fields
+				assert.Equal(t, order.Extra, got.Extra)
+			}
+
+			_, err = codec.Marshal(Customer{})
+			assert.True(t, errors.Is(err, ErrUnregisteredType))
+		})
+	}
+}
+
+func TestDurableBackends_Codec(t *testing.T) {
+	types := newOrderRegistry()
+	order := Order{
+		ID:       "order-1",
+		Quantity: 2,
+		Tags:     []string{"a"},
+		Created:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Customer: &Customer{Name: "acme"},
+	}
+
+	for name, codec := range map[string]Codec{
+		"binary": NewBinaryCodec(types),
+		"gob":    NewGobCodec(types),
+		"json":   NewJSONCodec(types),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// the reopened backends return the concrete types, not their JSON decoding
+			store, err := OpenFileStore(filepath.Join(dir, "store"), WithStoreCodec(codec))
+			assert.Nil(t, err)
+			store.Put("order", order)
+			store.Close()
+			assert.Nil(t, store.Err())
+			store, err = OpenFileStore(filepath.Join(dir, "store"), WithStoreCodec(codec))
+			assert.Nil(t, err)
+			value, ok := store.Get("order")
+			assert.True(t, ok)
+			assert.Equal(t, order, value)
+			store.Close()
+
+			journal, err := OpenFileJournal(filepath.Join(dir, "journal"), WithJournalCodec(codec))
+			assert.Nil(t, err)
+			assert.Nil(t, journal.Append([]JournalEvent{{Seq: 1, Event: order}}))
+			assert.Nil(t, journal.SaveSnapshot(1, order))
+			assert.Nil(t, journal.Close())
+			journal, err = OpenFileJournal(filepath.Join(dir, "journal"), WithJournalCodec(codec))
+			assert.Nil(t, err)
+			var events []JournalEvent
+			assert.Nil(t, journal.Replay(0, func(event JournalEvent) error {
+				events = append(events, event)
+				return nil
+			}))
+			assert.Equal(t, []JournalEvent{{Seq: 1, Event: order}}, events)
+			_, snapshot, ok, err := journal.LoadSnapshot()
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, order, snapshot)
+			assert.Nil(t, journal.Close())
+
+			sink, err := OpenFileSink(filepath.Join(dir, "sink"), WithSinkCodec(codec))
+			assert.Nil(t, err)
+			assert.Nil(t, sink.Append(newTestResult("uid-1", order)))
+			// a type missing from the registry is refused
+			assert.True(t, errors.Is(sink.Append(newTestResult("uid-2", Customer{})), ErrUnregisteredType))
+			assert.Nil(t, sink.Close())
+			sink, err = OpenFileSink(filepath.Join(dir, "sink"), WithSinkCodec(codec))
+			assert.Nil(t, err)
+			defer sink.Close()
+			_, outputs := readAll(t, sink)
+			assert.Equal(t, map[string]any{"uid-1": order}, outputs)
+		})
+	}
+}
+
+// OrderBook keeps the last order of every customer in its store
+type OrderBook struct{}
+
+func (b *OrderBook) Receive(ctx *Context, msg any) (any, error) {
+	order := msg.(Order)
+	ctx.Store().Put(order.Customer.Name, order)
+	return order.ID, nil
+}
+
+func (b *OrderBook) MessageTypes() []any {
+	return []any{Order{}, ""}
+}
+
+func (b *OrderBook) String() string {
+	return "orderbook"
+}
+
+func TestEngine_DurableBackendCodecs(t *testing.T) {
+	types := newOrderRegistry()
+	order := Order{ID: "order-1", Quantity: 2, Customer: &Customer{Name: "acme"}}
+	dir := t.TempDir()
+
+	// the backends are opened without a codec, Ready sets the codec of the engine's registry
+	store, err := OpenFileStore(filepath.Join(dir, "store"))
+	assert.Nil(t, err)
+	sink, err := OpenFileSink(filepath.Join(dir, "sink"))
+	assert.Nil(t, err)
+	engine := NewEngine()
+	engine.SetTypeRegistry(types)
+	engine.SetSinkPool(NewSinkPool(WithBackend(sink)))
+	_, err = engine.Spawn(&OrderBook{}, WithStore(store))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	_, err = engine.SendAndWait(context.Background(), order)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Shutdown(context.Background()))
+	assert.Nil(t, store.Err())
+	assert.Nil(t, engine.SinkPool().BackendErr())
+
+	store, err = OpenFileStore(filepath.Join(dir, "store"), WithStoreCodec(NewJSONCodec(types)))
+	assert.Nil(t, err)
+	defer store.Close()
+	value, ok := store.Get("acme")
+	assert.True(t, ok)
+	assert.Equal(t, order, value)
+
+	sink, err = OpenFileSink(filepath.Join(dir, "sink"), WithSinkCodec(NewJSONCodec(types)))
+	assert.Nil(t, err)
+	defer sink.Close()
+	it, err := sink.Iterator()
+	assert.Nil(t, err)
+	defer it.Close()
+	assert.True(t, it.Next())
+	assert.Equal(t, order, it.Result().In()[0].Input())
+	assert.Equal(t, "order-1", it.Result().Out()[0].Output())
+}
+
+func TestEngine_CheckTypes(t *testing.T) {
+	// a TypedActor declares its In and Out
+	engine := NewEngine()
+	engine.SetTypeRegistry(NewTypeRegistry())
+	_, err := engine.Spawn(TypedFunc("pricer", func(ctx *Context, order Order) (float64, error) {
+		return order.Amount, nil
+	}))
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(engine.Ready(), ErrUnregisteredType))
+
+	engine = NewEngine()
+	engine.SetTypeRegistry(newOrderRegistry())
+	_, err = engine.Spawn(TypedFunc("pricer", func(ctx *Context, order Order) (float64, error) {
+		return order.Amount, nil
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	assert.Nil(t, engine.Shutdown(context.Background()))
+
+	// an actor whose messages are encoded must declare their types
+	engine = NewEngine()
+	engine.SetTypeRegistry(newOrderRegistry())
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	remote, err := engine.SpawnRemote(RemotePid{Addr: "127.0.0.1:1", Name: "shipper"})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, remote))
+	assert.EqualError(t, engine.Ready(), "actor src: its messages are encoded by the remote actor shipper@127.0.0.1:1, declare their types with MessageTypes")
+
+	sink, err := OpenFileSink(t.TempDir())
+	assert.Nil(t, err)
+	engine = NewEngine()
+	engine.SetTypeRegistry(newOrderRegistry())
+	engine.SetSinkPool(NewSinkPool(WithBackend(sink)))
+	_, err = engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	assert.EqualError(t, engine.Ready(), "actor src: its messages are encoded by the sink backend, declare their types with MessageTypes")
+	engine.SinkPool().Close()
+}
+
+func TestBinaryCodec_Compact(t *testing.T) {
+	types := newOrderRegistry()
+	order := Order{ID: "order-1", Amount: 12.5, Quantity: 3, Tags: []string{"a"}}
+
+	binaryData, err := NewBinaryCodec(types).Marshal(order)
+	assert.Nil(t, err)
+	jsonData, err := NewJSONCodec(types).Marshal(order)
+	assert.Nil(t, err)
+	assert.Less(t, len(binaryData), len(jsonData)/2)
+
+	// a truncated payload is an error, not a panic
+	for i := 0; i < len(binaryData); i++ {
+		_, err := NewBinaryCodec(types).Unmarshal(binaryData[:i])
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTypeRegistry_Register(t *testing.T) {
+	types := NewTypeRegistry()
+	assert.Nil(t, types.Register("orders.Order", Order{}))
+	assert.Nil(t, types.Register("orders.Order", Order{}))
+	assert.NotNil(t, types.Register("orders.Order", &Order{}))
+	assert.NotNil(t, types.Register("orders.Other", Order{}))
+	assert.NotNil(t, types.Register("chan", make(chan int)))
+
+	name, err := types.NameOf(Order{})
+	assert.Nil(t, err)
+	assert.Equal(t, "orders.Order", name)
+}
+
+func TestEngine_TypeRegistry(t *testing.T) {
+	engine := NewEngine()
+	engine.SetTypeRegistry(NewTypeRegistry())
+	_, err := engine.Spawn(&Shipper{})
+	assert.Nil(t, err)
+	err = engine.Ready()
+	assert.True(t, errors.Is(err, ErrUnregisteredType))
+
+	// the registry of the engine types the payloads between engines
+	types := newOrderRegistry()
+	server := NewEngine()
+	server.SetTypeRegistry(types)
+	shipper := &Shipper{orders: make(chan Order, 1)}
+	_, err = server.Spawn(shipper)
+	assert.Nil(t, err)
+	assert.Nil(t, server.Ready())
+	defer server.Shutdown(context.Background())
+	addr, err := server.Listen("127.0.0.1:0", WithRemoteCodec(NewBinaryCodec(types)))
+	assert.Nil(t, err)
+
+	client := NewEngine()
+	client.SetTypeRegistry(types)
+	_, err = client.SpawnRemote(RemotePid{Addr: addr.String(), Name: "shipper"}, WithRemoteCodec(NewBinaryCodec(types)))
+	assert.Nil(t, err)
+	assert.Nil(t, client.Ready())
+	assert.Nil(t, client.Send(Order{ID: "order-1", Quantity: 2}))
+	assert.Equal(t, Order{ID: "order-1", Quantity: 2}, <-shipper.orders)
+	assert.Nil(t, client.Shutdown(context.Background()))
+}
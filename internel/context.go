@@ -1,27 +1,61 @@
 package internel
 
 import (
+	"context"
 	"github.com/fzft/my-actor/pkg"
 	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// InBox maintains a lock-free ring buffer for incoming messages
+// InBox maintains a lock-free ring buffer for incoming messages, safe for several producers:
+// the parents and the timers of the actor all enqueue into it
+// an empty inbox waits with the wait strategy, the blocking one by default so an idle actor costs nothing
 type InBox struct {
-	buffer *pkg.LockFreeRingBuffer
+	buffer *pkg.BlockingRingBuffer
+	size   int
+	wait   pkg.WaitStrategy
 }
 
-func NewInBox(bufferSize int) *InBox {
-	return &InBox{buffer: pkg.NewLockFreeRingBuffer(bufferSize)}
+func NewInBox(bufferSize int, wait pkg.WaitStrategy) *InBox {
+	return &InBox{
+		buffer: pkg.NewBlockingRingBuffer(bufferSize, wait),
+		size:   bufferSize,
+		wait:   wait,
+	}
+}
+
+// Enqueue adds a message to the actor's inbox, returns false if the inbox is full
+func (i *InBox) Enqueue(msg any) bool {
+	return i.buffer.Enqueue(msg)
+}
+
+// Len returns the number of messages in the actor's inbox
+func (i *InBox) Len() int {
+	return i.buffer.Len()
 }
 
-// Enqueue adds a message to the actor's inbox
-func (i *InBox) Enqueue(msg any) {
-	i.buffer.Enqueue(msg)
+// EnqueueWait adds a message to the actor's inbox, waits for room while the inbox is full
+// returns false if any of stopChs is closed before the message is added
+func (i *InBox) EnqueueWait(msg any, stopChs ...<-chan struct{}) bool {
+	wait := pkg.NewSleepingWaitStrategy(time.Microsecond, time.Millisecond)
+	for attempt := 0; !i.buffer.Enqueue(msg); attempt++ {
+		for _, stopCh := range stopChs {
+			select {
+			case <-stopCh:
+				return false
+			default:
+			}
+		}
+		wait.Wait(attempt, stopChs[0])
+	}
+	return true
 }
 
-// Dequeue removes a message from the actor's inbox
-func (i *InBox) Dequeue() (any, bool) {
-	return i.buffer.Dequeue()
+// Dequeue removes a message from the actor's inbox, blocks until a message arrives or stopCh is closed
+func (i *InBox) Dequeue(stopCh <-chan struct{}) (any, bool) {
+	return i.buffer.Dequeue(stopCh)
 }
 
 // Context is the interface that wraps the basic Context methods.
@@ -39,21 +73,49 @@ type Context struct {
 	// pid is the actor's pid
 	pid      string
 	children []*Pid
+	parents  []*Pid
 
-	stopCh chan struct{}
+	// predicates is the map of edge predicates, child actor name -> predicate
+	predicates map[string]func(out any) bool
+	// policies is the map of edge policies, child actor name -> policy, EdgeBlock if not set
+	policies map[string]EdgePolicy
+
+	// futures tracks the messages in flight
+	futures *futureRegistry
+
+	// deadLetters records the messages that are not handled
+	deadLetters *DeadLetters
+
+	// pending is the number of messages sent to the actor but not handled yet
+	pending int64
+
+	// root is set when Suber is a mailbox, the messages wait in the mailbox while the inbox is full
+	root bool
+
+	// current is the message the actor is receiving, headers are its output headers if the actor overrides them
+	current Message
+	headers map[string]string
+	// events are emitted by an EventSourcedActor in the current Receive
+	events []any
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
 }
 
 // NewContext returns a new Context
 func NewContext(logger *zap.SugaredLogger, pid string) *Context {
 	ctx := &Context{
-		pid:    pid,
-		store:  NewMemoryStore(),
-		inbox:  *NewInBox(1024),
-		logger: logger,
-		Suber:  make(chan Message),
-		stopCh: make(chan struct{}),
+		pid:         pid,
+		predicates:  make(map[string]func(out any) bool),
+		policies:    make(map[string]EdgePolicy),
+		futures:     newFutureRegistry(),
+		deadLetters: NewDeadLetters(0),
+		store:       NewMemoryStore(),
+		inbox:       *NewInBox(defaultBufferSize, pkg.NewBlockingWaitStrategy()),
+		logger:      logger,
+		Suber:       make(chan Message),
+		stopCh:      make(chan struct{}),
 	}
-	go ctx.buffered()
 	return ctx
 }
 
@@ -67,6 +129,16 @@ func (c *Context) childActors() []*Pid {
 	return c.children
 }
 
+// addParent adds a parent to the actor's parents
+func (c *Context) addParent(pid *Pid) {
+	c.parents = append(c.parents, pid)
+}
+
+// parentActors returns the actor's parents
+func (c *Context) parentActors() []*Pid {
+	return c.parents
+}
+
 // buffered buffer the incoming message from suber into the actor's inbox
 func (c *Context) buffered() {
 	for {
@@ -77,28 +149,154 @@ func (c *Context) buffered() {
 		case msg, ok := <-c.Suber:
 			if ok {
 				c.logger.Debugf("[%s] buffered %+v", c.pid, msg)
-				c.inbox.Enqueue(msg)
+				if c.root {
+					if !c.inbox.EnqueueWait(msg, c.stopCh) {
+						return
+					}
+					continue
+				}
+				if !c.inbox.Enqueue(msg) {
+					atomic.AddInt64(&c.pending, -1)
+					c.futures.dropped(msg.uid)
+					c.logger.Warnw("inbox is full, drop message", "pid", c.pid, "msg", msg)
+				}
 			}
 		}
 	}
 }
 
+// Envelope returns the envelope of the message the actor is receiving
+func (c *Context) Envelope() Envelope {
+	return c.current.envelope()
+}
+
+// Store returns the actor's store, see WithStore
+func (c *Context) Store() Storer {
+	return c.store
+}
+
+// Context returns the context of the message the actor is receiving, it is done once the message expires
+// a long running Receive should give up when it is done, the output of an expired message is dropped by the children
+func (c *Context) Context() context.Context {
+	return c.current.context()
+}
+
+// SetHeader sets a header of the actor's output, the children receive it with the other headers
+func (c *Context) SetHeader(key, value string) {
+	c.overrideHeaders()
+	c.headers[key] = value
+}
+
+// DeleteHeader removes a header from the actor's output
+func (c *Context) DeleteHeader(key string) {
+	c.overrideHeaders()
+	delete(c.headers, key)
+}
+
+// overrideHeaders copies the input headers on the first override, the input headers are shared
+func (c *Context) overrideHeaders() {
+	if c.headers != nil {
+		return
+	}
+	c.headers = copyHeaders(c.current.headers)
+	if c.headers == nil {
+		c.headers = make(map[string]string)
+	}
+}
+
+// receiving sets the message the actor is receiving
+func (c *Context) receiving(msg Message) {
+	c.current = msg
+	c.headers = nil
+	c.events = nil
+}
+
+// outputHeaders returns the headers of the actor's output
+func (c *Context) outputHeaders() map[string]string {
+	if c.headers == nil {
+		return c.current.headers
+	}
+	return c.headers
+}
+
 // setMailbox sets the root actor's mailbox
+// the inbox takes a message from the mailbox only when it has room, so the mailbox's order and overload policy apply
 func (c *Context) setMailbox(mailbox Mailbox) {
 	c.Suber = mailbox.Consume()
+	c.root = true
+}
+
+// setPolicy sets the policy of the edge to the child actor
+func (c *Context) setPolicy(child string, policy EdgePolicy) {
+	c.policies[child] = policy
 }
 
-// broadcast the outgoing message from the actor's inbox to the puber
-func (c *Context) broadcast(msg Message) {
+// setPredicate sets the predicate of the edge to the child actor
+func (c *Context) setPredicate(child string, when func(out any) bool) {
+	c.predicates[child] = when
+}
+
+// route returns the children that the output goes to, and the output unwrapped from a Route envelope
+func (c *Context) route(output any) ([]*Pid, any) {
+	var to map[string]bool
+	if r, ok := output.(Route); ok {
+		to = make(map[string]bool, len(r.To))
+		for _, name := range r.To {
+			to[name] = true
+		}
+		output = r.Data
+	}
+
+	targets := make([]*Pid, 0, len(c.children))
 	for _, child := range c.children {
-		go func(child *Pid) {
-			child.context.Suber <- msg
+		if to != nil && !to[child.actorName] {
+			continue
+		}
+		if when, ok := c.predicates[child.actorName]; ok && !when(output) {
+			continue
+		}
+		targets = append(targets, child)
+	}
+	return targets, output
+}
+
+// broadcast hands the outgoing message over to the inbox of the given children, in the actor's goroutine
+// a child whose inbox is full makes the actor wait, unless the edge drops the message
+func (c *Context) broadcast(msg Message, children []*Pid) {
+	for _, child := range children {
+		// count the message as pending before it is handed over, so a draining engine waits for it
+		atomic.AddInt64(&child.context.pending, 1)
+		if c.deliver(msg, child) {
 			c.logger.Debugf("[%s] broadcast %v -> [%s] ", c.pid, msg, child.context.pid)
-		}(child)
+			continue
+		}
+		atomic.AddInt64(&child.context.pending, -1)
+		c.futures.dropped(msg.uid)
 	}
 }
 
+// deliver enqueues the message into the child's inbox following the policy of the edge, returns false if it is dropped
+func (c *Context) deliver(msg Message, child *Pid) bool {
+	if c.policies[child.actorName] == EdgeDrop {
+		if child.context.inbox.Enqueue(msg) {
+			return true
+		}
+		c.logger.Warnw("inbox is full, drop message", "pid", c.pid, "child", child.context.pid, "uid", msg.uid)
+		c.deadLetters.add(child.actorName, msg, DeadLetterInboxFull, nil)
+		return false
+	}
+
+	if child.context.inbox.EnqueueWait(msg, c.stopCh, child.context.stopCh) {
+		return true
+	}
+	c.logger.Debugw("drop broadcast, actor is stopped", "pid", c.pid, "child", child.context.pid)
+	c.deadLetters.add(child.actorName, msg, DeadLetterStopped, nil)
+	return false
+}
+
 // stop stops the actor's context
 func (c *Context) stop() {
-	close(c.stopCh)
-}
\ No newline at end of file
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
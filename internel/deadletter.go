@@ -0,0 +1,207 @@
+package internel
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DeadLetterReason is why a message is a dead letter
+type DeadLetterReason int
+
+const (
+	// DeadLetterRejected is a message the root mailbox refused, e.g. ErrBusy, the sender got the error too
+	DeadLetterRejected DeadLetterReason = iota
+	// DeadLetterMailboxDropped is a message the root mailbox dropped after it was accepted, e.g. evicted or coalesced
+	DeadLetterMailboxDropped
+	// DeadLetterInboxFull is a message dropped by an EdgeDrop edge because the actor's inbox was full
+	DeadLetterInboxFull
+	// DeadLetterStopped is a message sent to an actor that was stopped
+	DeadLetterStopped
+	// DeadLetterInvalid is a value in the inbox that is not a Message
+	DeadLetterInvalid
+	// DeadLetterFailed is a message whose Receive returned an error or panicked
+	DeadLetterFailed
+	// DeadLetterExpired is a message whose deadline passed, or whose context was canceled, before Receive
+	DeadLetterExpired
+	// DeadLetterJoinTimeout is the partial input of a JoinActor whose parents did not all report in time, or skipped the uid
+	DeadLetterJoinTimeout
+	// DeadLetterJoinLate is the output of a parent of a JoinActor that arrived after its uid was joined or timed out
+	DeadLetterJoinLate
+)
+
+func (r DeadLetterReason) String() string {
+	switch r {
+	case DeadLetterRejected:
+		return "rejected"
+	case DeadLetterMailboxDropped:
+		return "mailbox_dropped"
+	case DeadLetterInboxFull:
+		return "inbox_full"
+	case DeadLetterStopped:
+		return "stopped"
+	case DeadLetterInvalid:
+		return "invalid"
+	case DeadLetterFailed:
+		return "failed"
+	case DeadLetterExpired:
+		return "expired"
+	case DeadLetterJoinTimeout:
+		return "join_timeout"
+	case DeadLetterJoinLate:
+		return "join_late"
+	}
+	return "unknown"
+}
+
+// DeadLetter is a message that was not handled
+type DeadLetter struct {
+	// ID identifies the dead letter in its DeadLetters, e.g. for Engine.Redeliver
+	ID uint64
+	// Uid is the message uid
+	Uid string
+	// Actor is the name of the actor the message was meant for
+	Actor  string
+	Reason DeadLetterReason
+	Err    error
+	// Message is the message as the actor would have received it
+	Message Envelope
+	Time    time.Time
+
+	// msg is the message to redeliver
+	msg Message
+}
+
+const (
+	defaultDeadLetters     = 10000
+	deadLetterSubscription = 256
+)
+
+// DeadLetters keeps the dead letters of an engine, the oldest are evicted beyond its capacity
+type DeadLetters struct {
+	mu       sync.Mutex
+	capacity int
+	seq      uint64
+	letters  *list.List
+	byID     map[uint64]*list.Element
+	evicted  int
+
+	subscribers map[chan DeadLetter]struct{}
+}
+
+// NewDeadLetters keeps at most capacity dead letters, 0 means the default capacity
+func NewDeadLetters(capacity int) *DeadLetters {
+	if capacity <= 0 {
+		capacity = defaultDeadLetters
+	}
+	return &DeadLetters{
+		capacity:    capacity,
+		letters:     list.New(),
+		byID:        make(map[uint64]*list.Element),
+		subscribers: make(map[chan DeadLetter]struct{}),
+	}
+}
+
+// add records the msg meant for actor as a dead letter, and publishes it to the subscribers
+func (d *DeadLetters) add(actor string, msg Message, reason DeadLetterReason, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seq++
+	letter := DeadLetter{
+		ID:      d.seq,
+		Uid:     msg.uid,
+		Actor:   actor,
+		Reason:  reason,
+		Err:     err,
+		Message: msg.envelope(),
+		Time:    time.Now(),
+		msg:     msg,
+	}
+	d.byID[letter.ID] = d.letters.PushBack(letter)
+	for d.letters.Len() > d.capacity {
+		oldest := d.letters.Remove(d.letters.Front()).(DeadLetter)
+		delete(d.byID, oldest.ID)
+		d.evicted++
+	}
+
+	for sub := range d.subscribers {
+		select {
+		case sub <- letter:
+		default:
+			// a slow subscriber misses the letter, it can still be queried
+		}
+	}
+}
+
+// Get returns the dead letter by id
+func (d *DeadLetters) Get(id uint64) (DeadLetter, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.byID[id]
+	if !ok {
+		return DeadLetter{}, false
+	}
+	return elem.Value.(DeadLetter), true
+}
+
+// Query returns the dead letters that satisfy fn, oldest first, nil fn returns all of them
+func (d *DeadLetters) Query(fn func(letter DeadLetter) bool) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var letters []DeadLetter
+	for elem := d.letters.Front(); elem != nil; elem = elem.Next() {
+		letter := elem.Value.(DeadLetter)
+		if fn == nil || fn(letter) {
+			letters = append(letters, letter)
+		}
+	}
+	return letters
+}
+
+// Remove drops the dead letter by id, returns false if it is not found
+func (d *DeadLetters) Remove(id uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.byID[id]
+	if !ok {
+		return false
+	}
+	d.letters.Remove(elem)
+	delete(d.byID, id)
+	return true
+}
+
+// Len returns the number of dead letters
+func (d *DeadLetters) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.letters.Len()
+}
+
+// Evicted returns the number of dead letters evicted beyond the capacity
+func (d *DeadLetters) Evicted() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.evicted
+}
+
+// Subscribe returns a channel of the new dead letters, it is closed once ctx is done
+// a subscriber that does not keep up misses letters, they can still be queried
+func (d *DeadLetters) Subscribe(ctx context.Context) <-chan DeadLetter {
+	sub := make(chan DeadLetter, deadLetterSubscription)
+	d.mu.Lock()
+	d.subscribers[sub] = struct{}{}
+	d.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		delete(d.subscribers, sub)
+		d.mu.Unlock()
+		close(sub)
+	}()
+	return sub
+}
@@ -0,0 +1,96 @@
+package internel
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Flaky fails until it is fixed, and records what it receives once fixed
+type Flaky struct {
+	fixed    int32
+	received chan any
+}
+
+func (f *Flaky) Receive(ctx *Context, msg any) (any, error) {
+	if atomic.LoadInt32(&f.fixed) == 0 {
+		return nil, fmt.Errorf("flaky is broken")
+	}
+	f.received <- msg
+	return msg, nil
+}
+
+func (f *Flaky) String() string {
+	return "flaky"
+}
+
+func TestDeadLetters_Capacity(t *testing.T) {
+	letters := NewDeadLetters(2)
+	for i := 0; i < 3; i++ {
+		letters.add("a", Message{uid: fmt.Sprint(i), data: i}, DeadLetterFailed, nil)
+	}
+	assert.Equal(t, 2, letters.Len())
+	assert.Equal(t, 1, letters.Evicted())
+
+	all := letters.Query(nil)
+	assert.Equal(t, "1", all[0].Uid)
+	assert.Equal(t, 2, all[1].Message.Data)
+	_, ok := letters.Get(1)
+	assert.False(t, ok)
+
+	assert.True(t, letters.Remove(all[0].ID))
+	assert.False(t, letters.Remove(all[0].ID))
+	assert.Equal(t, 1, letters.Len())
+}
+
+func TestEngine_DeadLetters(t *testing.T) {
+	flaky := &Flaky{received: make(chan any, 1)}
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	leaf, err := engine.Spawn(flaky)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, leaf))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sub := engine.DeadLetters().Subscribe(ctx)
+
+	future, err := engine.Ask(ctx, Envelope{Uid: "order-1", Headers: map[string]string{"tenant": "acme"}, Data: "order"})
+	assert.Nil(t, err)
+	_, err = future.Result()
+	assert.NotNil(t, err)
+
+	letter := <-sub
+	assert.Equal(t, "order-1", letter.Uid)
+	assert.Equal(t, "flaky", letter.Actor)
+	assert.Equal(t, DeadLetterFailed, letter.Reason)
+	assert.Equal(t, "failed", letter.Reason.String())
+	assert.EqualError(t, letter.Err, "flaky is broken")
+	assert.Equal(t, "src(order)", letter.Message.Data)
+	assert.Equal(t, "acme", letter.Message.Header("tenant"))
+
+	failed := engine.DeadLetters().Query(func(letter DeadLetter) bool {
+		return letter.Reason == DeadLetterFailed
+	})
+	assert.Equal(t, []DeadLetter{letter}, failed)
+
+	// once fixed, the letter is redelivered to the actor it was meant for
+	atomic.StoreInt32(&flaky.fixed, 1)
+	assert.NotNil(t, engine.Redeliver(letter.ID, "unknown"))
+	assert.Nil(t, engine.Redeliver(letter.ID, ""))
+	assert.Equal(t, "src(order)", <-flaky.received)
+	assert.Equal(t, 0, engine.DeadLetters().Len())
+	assert.NotNil(t, engine.Redeliver(letter.ID, ""))
+
+	// redelivered to the root, the message goes through the DAG again
+	engine.DeadLetters().add("src", Message{uid: "order-2", data: "again"}, DeadLetterRejected, ErrBusy)
+	again := engine.DeadLetters().Query(nil)[0]
+	assert.Nil(t, engine.Redeliver(again.ID, ""))
+	assert.Equal(t, "src(again)", <-flaky.received)
+}
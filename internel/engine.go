@@ -1,14 +1,22 @@
 package internel
 
 import (
+	"context"
 	"fmt"
 	"github.com/fzft/my-actor/pkg"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // DAG  directed acyclic graph (DAG) where actors are the nodes
-// DAG is allowed to have only one root actor
+// DAG can have multiple root actors, every root actor has its own mailbox
 // every actor can have multiple parents and children
+// a JoinActor receives once per message, with the outputs of all its parents
 // actor is driven by messages
 // between actors, there are edges that connect them
 // the edges are unidirectional
@@ -21,6 +29,7 @@ import (
 // Step 3: Add Edge between actors
 // Step 3: Ready the actors in the DAG
 // Step 4: Send messages to the DAG
+// Step 5: Shutdown the engine, drain the in-flight messages and stop the actors
 
 // Engine is the actor engine
 type Engine[T Actor] struct {
@@ -29,47 +38,210 @@ type Engine[T Actor] struct {
 	// Nodes is the list of nodes in the engine
 	*pkg.DAG[T]
 
-	// mailbox is the mailbox of the engine
-	mailbox Mailbox
-
 	// nodeMaps is the map of actors
 	nodeMaps map[string]*pkg.Node[T]
 
 	// pidMaps is the map of pid
 	pidMaps map[string]*Pid
 
-	// root is the root actor
-	root *Pid
+	// roots is the map of root actors, actor name -> pid
+	roots map[string]*Pid
 
 	// sinkPool is store the result of the leaf actor
 	sinkPool *SinkPool
 
+	// futures tracks the messages in flight and the pending futures of Ask
+	futures *futureRegistry
+
+	// deadLetters records the messages that are not handled, for every actor
+	deadLetters *DeadLetters
+
+	// metrics receives the metrics of the actors and the root mailboxes
+	metrics MetricsSink
+
+	// exporter receives the spans of the actors, nil if tracing is off
+	exporter SpanExporter
+
+	// journalDir is where the default journals of the EventSourcedActors are, one directory per actor
+	journalDir string
+
+	// newMailbox returns the mailbox of a root actor spawned without WithMailbox, nil means NewDefaultMailbox
+	newMailbox func() Mailbox
+
+	// typedEdges are the edges added with AddTypedEdge, parent -> child, their types are checked at Ready
+	typedEdges [][2]*Pid
+
+	// types maps the names of the message types to their Go types, nil if there is no registry
+	types *TypeRegistry
+
+	// remotes are the connections of the remote actors, listeners accept the messages of remote engines
+	remotes   []*remoteConn
+	listeners []*remoteListener
+
 	isReady bool
+
+	// sendMu guards isStopping against the senders
+	sendMu     sync.RWMutex
+	isStopping bool
+
+	// wg tracks the goroutines of the actors and the sink
+	wg sync.WaitGroup
 }
 
 func NewEngine() *Engine[Actor] {
 	loggerConfig := zap.NewDevelopmentConfig()
 	loggerConfig.EncoderConfig.TimeKey = ""
 	logger, _ := loggerConfig.Build()
-	sugarLogger := logger.Sugar()
+	return NewEngineWithLogger(logger.Sugar())
+}
+
+// NewEngineWithLogger returns a new Engine that logs to the given logger
+func NewEngineWithLogger(sugarLogger *zap.SugaredLogger) *Engine[Actor] {
+	sinkPool := NewSinkPool()
+	futures := newFutureRegistry()
+	// stream the result once the message has gone through the DAG
+	futures.onComplete = sinkPool.complete
+
 	return &Engine[Actor]{
-		logger:   sugarLogger,
-		DAG:      pkg.NewDAG[Actor](),
-		mailbox:  NewDefaultMailbox(sugarLogger),
-		sinkPool: NewSinkPool(),
-		nodeMaps: make(map[string]*pkg.Node[Actor]),
-		pidMaps:  make(map[string]*Pid),
+		logger:      sugarLogger,
+		DAG:         pkg.NewDAG[Actor](),
+		sinkPool:    sinkPool,
+		nodeMaps:    make(map[string]*pkg.Node[Actor]),
+		pidMaps:     make(map[string]*Pid),
+		roots:       make(map[string]*Pid),
+		futures:     futures,
+		deadLetters: NewDeadLetters(0),
+		metrics:     nopMetrics{},
 	}
 }
 
-// Spawn spawns a new actor
-func (e *Engine[Actor]) Spawn(actor Actor) (*Pid, error) {
+// SetSpanExporter traces every message through the DAG, each Receive is exported as a span
+// it must be called before Ready, the exporter is closed when the engine is shut down
+func (e *Engine[Actor]) SetSpanExporter(exporter SpanExporter) {
+	e.exporter = exporter
+}
+
+// SetSinkPool replaces the default pool, e.g. NewSinkPool(WithMaxEntries(10000, EvictLRU)), it must be called before Ready
+func (e *Engine[Actor]) SetSinkPool(pool *SinkPool) {
+	e.sinkPool.Close()
+	e.sinkPool = pool
+	e.futures.onComplete = pool.complete
+}
+
+// SinkPool returns the pool of the ticks of every message, to query or stream the results
+func (e *Engine[Actor]) SinkPool() *SinkPool {
+	return e.sinkPool
+}
+
+// SetDeadLetters replaces the default dead letters, e.g. NewDeadLetters(100000), it must be called before Ready
+func (e *Engine[Actor]) SetDeadLetters(deadLetters *DeadLetters) {
+	e.deadLetters = deadLetters
+}
+
+// DeadLetters returns the messages that are not handled, to query, subscribe or Redeliver them
+func (e *Engine[Actor]) DeadLetters() *DeadLetters {
+	return e.deadLetters
+}
+
+// SetJournalDir opens a FileJournal in dir/<actor name> for every EventSourcedActor spawned without WithJournal
+// it must be called before Ready
+func (e *Engine[Actor]) SetJournalDir(dir string) {
+	e.journalDir = dir
+}
+
+// SetMetrics reports the metrics of the actors and the root mailboxes to sink, it must be called before Ready
+//
+//	metrics := NewMemoryMetrics()
+//	engine.SetMetrics(metrics)
+//	http.Handle("/metrics", PrometheusHandler(metrics))
+func (e *Engine[Actor]) SetMetrics(sink MetricsSink) {
+	e.metrics = sink
+}
+
+// SetTypeRegistry sets the registry of the message types, it must be called before Ready
+// Ready checks the types declared by the actors, see MessageTypes, the remote actors and Listen encode with a JSONCodec of it by default
+// so do the FileSink of the SinkPool, and the FileJournal and the FileStore of the actors, opened without a codec
+//
+//	types := NewTypeRegistry()
+//	types.MustRegister("orders.Created", Created{})
+//	engine.SetTypeRegistry(types)
+func (e *Engine[Actor]) SetTypeRegistry(registry *TypeRegistry) {
+	e.types = registry
+}
+
+// checkTypes returns an error if a type declared by the actor is not registered, or if it declares none and its messages are encoded
+func (e *Engine[Actor]) checkTypes(node *pkg.Node[Actor]) error {
+	if e.types == nil {
+		return nil
+	}
+	pid := e.pidMaps[node.Value.String()]
+	declared, ok := any(pid.actor).(MessageTypes)
+	if !ok {
+		if encoder := e.encoder(node); encoder != "" {
+			return fmt.Errorf("actor %s: its messages are encoded by %s, declare their types with MessageTypes", pid.actorName, encoder)
+		}
+		return nil
+	}
+	for _, sample := range declared.MessageTypes() {
+		if sample == nil {
+			continue
+		}
+		if _, err := e.types.NameOf(sample); err != nil {
+			return fmt.Errorf("actor %s: %w", pid.actorName, err)
+		}
+	}
+	return nil
+}
+
+// encoder returns what encodes the messages or the state of the actor, empty if nothing does
+// a remote actor is not checked, its messages are the outputs of its parents
+func (e *Engine[Actor]) encoder(node *pkg.Node[Actor]) string {
+	pid := e.pidMaps[node.Value.String()]
+	if _, ok := any(pid.actor).(*remoteActor); ok {
+		return ""
+	}
+	if pid.journal != nil {
+		return "its journal"
+	}
+	if _, ok := pid.context.store.(codecBackend); ok {
+		return "its store"
+	}
+	if _, ok := e.sinkPool.backend.(codecBackend); ok {
+		return "the sink backend"
+	}
+	for _, child := range e.DAG.Neighbors(node) {
+		if _, ok := any(child.Value).(*remoteActor); ok {
+			return fmt.Sprintf("the remote actor %s", child.Value.String())
+		}
+	}
+	return ""
+}
+
+// setDefaultCodec sets codec on the durable backends opened without a codec
+func setDefaultCodec(codec Codec, backends ...any) {
+	for _, backend := range backends {
+		if b, ok := backend.(codecBackend); ok {
+			b.setDefaultCodec(codec)
+		}
+	}
+}
+
+// SetMailboxFactory sets the mailbox of every root actor spawned without WithMailbox, it must be called before Ready
+//
+//	engine.SetMailboxFactory(func() Mailbox { return NewDropOldestMailbox(logger, 256) })
+func (e *Engine[Actor]) SetMailboxFactory(factory func() Mailbox) {
+	e.newMailbox = factory
+}
+
+// Spawn spawns a new actor, opts configure the actor's pid, e.g. WithSupervisor
+func (e *Engine[Actor]) Spawn(actor Actor, opts ...PidOption) (*Pid, error) {
 	// check if the actor is already spawned
 	if _, ok := e.pidMaps[actor.String()]; ok {
 		return nil, fmt.Errorf("actor already spawned")
 	}
 
-	pid := NewPid(e.logger, actor)
+	pid := NewPid(e.logger, actor, opts...)
+	pid.context.futures = e.futures
 	node := e.AddNode(actor)
 	e.nodeMaps[pid.uuid] = node
 	e.pidMaps[actor.String()] = pid
@@ -89,31 +261,116 @@ func (e *Engine[Actor]) AddEdge(from, to *Pid) error {
 
 	err := e.DAG.AddEdge(fromNode, toNode)
 	if err != nil {
-		e.logger.Fatalw("Error adding edge", "error", err)
+		e.logger.Errorw("Error adding edge", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// AddEdgeWhen adds an edge that only forwards the outputs of from that satisfy when
+func (e *Engine[Actor]) AddEdgeWhen(from, to *Pid, when func(out any) bool) error {
+	if err := e.AddEdge(from, to); err != nil {
 		return err
 	}
+	from.context.setPredicate(to.actorName, when)
+	return nil
+}
 
+// openJournal opens the default journal of an EventSourcedActor spawned without WithJournal
+func (e *Engine[Actor]) openJournal(pid *Pid) error {
+	if _, ok := pid.actor.(EventSourcedActor); !ok || pid.journal != nil {
+		return nil
+	}
+	if e.journalDir == "" {
+		return fmt.Errorf("event sourced actor %s has no journal, use WithJournal or SetJournalDir", pid.actorName)
+	}
+	journal, err := OpenFileJournal(filepath.Join(e.journalDir, pid.actorName))
+	if err != nil {
+		return fmt.Errorf("open journal of %s: %w", pid.actorName, err)
+	}
+	pid.journal = journal
 	return nil
 }
 
+// EdgePolicy is what an actor does when the inbox of a child is full
+type EdgePolicy int
+
+const (
+	// EdgeBlock waits until the child has room, a slow child slows its parents down, up to the root mailbox
+	EdgeBlock EdgePolicy = iota
+	// EdgeDrop drops the message for the child, the other children still receive it
+	EdgeDrop
+)
+
+// SetEdgePolicy sets the policy of the edge from -> to, edges block by default
+func (e *Engine[Actor]) SetEdgePolicy(from, to *Pid, policy EdgePolicy) error {
+	fromNode, ok := e.nodeMaps[from.uuid]
+	if !ok {
+		return fmt.Errorf("from actor not found")
+	}
+	for _, node := range e.DAG.Neighbors(fromNode) {
+		if node.Value.String() == to.actorName {
+			from.context.setPolicy(to.actorName, policy)
+			return nil
+		}
+	}
+	return fmt.Errorf("edge %s -> %s not found", from.actorName, to.actorName)
+}
+
 // Ready is the method that generates the DAG, and verifies that the DAG is valid
 func (e *Engine[Actor]) Ready() error {
 	roots, err := e.getRootActors()
 	if err != nil {
-		e.logger.Fatalw("Error getting root actor", "error", err)
+		return err
+	}
+	if err := e.checkTypedEdges(); err != nil {
 		return err
 	}
 
-	// only one root actor is allowed
-	if len(roots) != 1 {
-		return fmt.Errorf("only one root actor is allowed")
+	for _, node := range e.DAG.Nodes {
+		pid := e.pidMaps[node.Value.String()]
+		if pid.mailbox != nil && e.DAG.InDegree(node) > 0 {
+			return fmt.Errorf("actor %s is not a root actor, mailbox is not allowed", pid.actorName)
+		}
+		if err := e.openJournal(pid); err != nil {
+			return err
+		}
+		if err := e.checkTypes(node); err != nil {
+			return err
+		}
+		if e.types != nil {
+			setDefaultCodec(NewJSONCodec(e.types), pid.journal, pid.context.store)
+		}
+	}
+	if e.types != nil {
+		setDefaultCodec(NewJSONCodec(e.types), e.sinkPool.backend)
+	}
+	for _, conn := range e.remotes {
+		if conn.opts.codec == nil {
+			conn.opts.codec = NewJSONCodec(e.types)
+		}
 	}
 
-	rootActor := roots[0].Value
-	e.root = e.pidMaps[rootActor.String()]
+	for _, rootNode := range roots {
+		rootPid := e.pidMaps[rootNode.Value.String()]
+		e.roots[rootPid.actorName] = rootPid
 
-	// setup mailbox to root actor
-	e.root.context.setMailbox(e.mailbox)
+		// setup mailbox to root actor
+		if rootPid.mailbox == nil && e.newMailbox != nil {
+			rootPid.mailbox = e.newMailbox()
+		}
+		if rootPid.mailbox == nil {
+			rootPid.mailbox = NewDefaultMailbox(e.logger)
+		}
+		if mailbox, ok := rootPid.mailbox.(MetricsMailbox); ok {
+			mailbox.SetMetrics(rootPid.actorName, e.metrics)
+		}
+		if mailbox, ok := rootPid.mailbox.(DroppingMailbox); ok {
+			mailbox.SetDropHandler(e.mailboxDropped(rootPid))
+		}
+		rootPid.context.setMailbox(rootPid.mailbox)
+	}
 
 	// setup every non-leaf actor conn to its child actor
 	for _, node := range e.getNonLeafActors() {
@@ -122,44 +379,391 @@ func (e *Engine[Actor]) Ready() error {
 		for _, childNode := range childActorNodes {
 			childPid := e.pidMaps[childNode.Value.String()]
 			nodePid.context.addChild(childPid)
+			childPid.context.addParent(nodePid)
 		}
 	}
 
+	if err := e.markJoinPaths(); err != nil {
+		return err
+	}
+
+	var leaves []string
+	for _, node := range e.DAG.LeafNodes() {
+		leaves = append(leaves, e.pidMaps[node.Value.String()].String())
+	}
+	e.sinkPool.setLeaves(leaves)
+
 	for _, pid := range e.pidMaps {
-		go pid.run()
+		pid.metrics = e.metrics
+		pid.exporter = e.exporter
+		pid.context.deadLetters = e.deadLetters
+		e.wg.Add(1)
+		go func(pid *Pid) {
+			defer e.wg.Done()
+			pid.run()
+		}(pid)
 	}
 
 	// run the tick message
-	go e.sinkTickMsg()
+	e.sinkTickMsg()
 
 	e.isReady = true
 	return nil
 }
 
-// Send sends a message to the DAG
+// markJoinPaths marks the JoinActors and the actors on the way to one, children first
+func (e *Engine[Actor]) markJoinPaths() error {
+	sorted, err := e.DAG.TopologicalSort()
+	if err != nil {
+		return err
+	}
+	for i := len(sorted) - 1; i >= 0; i-- {
+		pid := e.pidMaps[sorted[i].Value.String()]
+		if _, ok := pid.actor.(JoinActor); ok {
+			pid.feedsJoin = true
+			continue
+		}
+		for _, child := range pid.context.childActors() {
+			pid.feedsJoin = pid.feedsJoin || child.feedsJoin
+		}
+	}
+	return nil
+}
+
+// Send sends a message to the DAG, the DAG must have only one root actor
 func (e *Engine[Actor]) Send(msg any) error {
+	root, err := e.singleRoot()
+	if err != nil {
+		return err
+	}
+	return e.source(context.Background(), root, msg)
+}
+
+// SendTo sends a message to the root actor by name
+func (e *Engine[Actor]) SendTo(rootName string, msg any) error {
+	root, err := e.rootByName(rootName)
+	if err != nil {
+		return err
+	}
+	return e.source(context.Background(), root, msg)
+}
+
+// SendWithContext sends a message to the DAG, ctx follows the message through every hop
+// once ctx is done, or its deadline has passed, the message is dropped before the next actor receives it
+func (e *Engine[Actor]) SendWithContext(ctx context.Context, msg any) error {
+	root, err := e.singleRoot()
+	if err != nil {
+		return err
+	}
+	return e.sourceWithContext(ctx, root, msg)
+}
+
+// SendToWithContext sends a message to the root actor by name, ctx follows the message through every hop
+func (e *Engine[Actor]) SendToWithContext(ctx context.Context, rootName string, msg any) error {
+	root, err := e.rootByName(rootName)
+	if err != nil {
+		return err
+	}
+	return e.sourceWithContext(ctx, root, msg)
+}
+
+func (e *Engine[Actor]) sourceWithContext(ctx context.Context, root *Pid, msg any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m := newMessage(uuid.New().String(), msg)
+	m.withContext(ctx)
+	return e.source(ctx, root, m)
+}
+
+// singleRoot returns the root actor of a DAG that has only one
+func (e *Engine[Actor]) singleRoot() (*Pid, error) {
+	if !e.isReady {
+		return nil, fmt.Errorf("engine is not ready")
+	}
+	if len(e.roots) != 1 {
+		return nil, fmt.Errorf("engine has %d root actors, use SendTo with the root actor name", len(e.roots))
+	}
+	for _, root := range e.roots {
+		return root, nil
+	}
+	return nil, nil
+}
+
+// rootByName returns the root actor by name
+func (e *Engine[Actor]) rootByName(rootName string) (*Pid, error) {
+	if !e.isReady {
+		return nil, fmt.Errorf("engine is not ready")
+	}
+	root, ok := e.roots[rootName]
+	if !ok {
+		return nil, fmt.Errorf("root actor %s not found", rootName)
+	}
+	return root, nil
+}
+
+// source posts the message to the root's mailbox, and counts it as pending on the root actor
+// a ContextMailbox may wait for room until ctx is done
+func (e *Engine[Actor]) source(ctx context.Context, root *Pid, msg any) error {
+	if err := e.enqueue(ctx, root, msg); err != nil {
+		m, ok := msg.(Message)
+		if !ok {
+			m = newMessage(uuid.New().String(), msg)
+		}
+		e.deadLetters.add(root.actorName, m, DeadLetterRejected, err)
+		return err
+	}
+	return nil
+}
+
+// enqueue is source without the dead letter, for the callers that try again
+func (e *Engine[Actor]) enqueue(ctx context.Context, root *Pid, msg any) error {
+	e.sendMu.RLock()
+	defer e.sendMu.RUnlock()
+
+	if e.isStopping {
+		return fmt.Errorf("engine is shutting down")
+	}
+
+	atomic.AddInt64(&root.context.pending, 1)
+	var err error
+	if mailbox, ok := root.mailbox.(ContextMailbox); ok {
+		err = mailbox.SourceContext(ctx, msg)
+	} else {
+		err = root.mailbox.Source(msg)
+	}
+	if err != nil {
+		atomic.AddInt64(&root.context.pending, -1)
+	}
+	return err
+}
+
+// mailboxDropped returns the drop handler of the root's mailbox, the message will never be handled
+func (e *Engine[Actor]) mailboxDropped(root *Pid) func(msg Message) {
+	return func(msg Message) {
+		atomic.AddInt64(&root.context.pending, -1)
+		e.futures.reject(msg.uid, ErrMailboxDropped)
+		e.deadLetters.add(root.actorName, msg, DeadLetterMailboxDropped, ErrMailboxDropped)
+		e.logger.Warnw("mailbox dropped message", "pid", root.String(), "uid", msg.uid)
+	}
+}
+
+// Redeliver sends a dead letter to the actor by name, an empty name is the actor it was meant for
+// the letter is removed once it is delivered, its deadline and context are dropped, it keeps its uid and headers
+// a letter redelivered to a root actor goes through its mailbox, to another actor straight into its inbox
+func (e *Engine[Actor]) Redeliver(id uint64, actorName string) error {
+	letter, ok := e.deadLetters.Get(id)
+	if !ok {
+		return fmt.Errorf("dead letter %d not found", id)
+	}
+	if actorName == "" {
+		actorName = letter.Actor
+	}
+	pid, ok := e.pidMaps[actorName]
+	if !ok {
+		return fmt.Errorf("actor %s not found", actorName)
+	}
 	if !e.isReady {
 		return fmt.Errorf("engine is not ready")
 	}
-	return e.mailbox.Source(msg)
+
+	msg := letter.msg
+	msg.ctx = nil
+	msg.deadline = time.Time{}
+	msg.attempt = 0
+	if msg.uid == "" {
+		msg.uid = uuid.New().String()
+	}
+
+	if root, ok := e.roots[actorName]; ok {
+		msg.from = ""
+		if err := e.source(context.Background(), root, msg); err != nil {
+			return err
+		}
+		e.deadLetters.Remove(id)
+		return nil
+	}
+
+	e.sendMu.RLock()
+	defer e.sendMu.RUnlock()
+	if e.isStopping {
+		return fmt.Errorf("engine is shutting down")
+	}
+	if msg.from == "" {
+		// an actor other than a root takes messages from its parents
+		msg.from = letter.Actor
+	}
+	e.futures.begin(msg.uid)
+	atomic.AddInt64(&pid.context.pending, 1)
+	if !pid.context.inbox.EnqueueWait(msg, pid.context.stopCh) {
+		atomic.AddInt64(&pid.context.pending, -1)
+		e.futures.dropped(msg.uid)
+		return fmt.Errorf("actor %s is stopped", actorName)
+	}
+	e.deadLetters.Remove(id)
+	return nil
 }
 
-// getRootActor returns the root actors of the DAG, could be multiple
-func (e *Engine[Actor]) getRootActors() ([]*pkg.Node[Actor], error) {
-	components := e.DAG.StronglyConnectedComponents()
-	if len(components) == 0 {
-		return nil, fmt.Errorf("No root actor found")
+// Shutdown stops accepting messages, drains the in-flight messages through the DAG in topological order,
+// stops every actor and waits for all goroutines to exit.
+// if ctx is done before the drain completes, the remaining actors are stopped without waiting and ctx.Err() is returned
+func (e *Engine[Actor]) Shutdown(ctx context.Context) error {
+	e.sendMu.Lock()
+	if e.isStopping {
+		e.sendMu.Unlock()
+		return fmt.Errorf("engine is already shut down")
+	}
+	e.isStopping = true
+	e.sendMu.Unlock()
+
+	for _, listener := range e.listeners {
+		listener.close()
+	}
+	if !e.isReady {
+		e.sinkPool.Close()
+		return nil
+	}
+
+	sorted, err := e.DAG.TopologicalSort()
+	if err != nil {
+		return err
 	}
 
-	var roots []*pkg.Node[Actor]
-	for _, component := range components {
-		for _, node := range component {
-			roots = append(roots, node)
+	var drainErr error
+	for _, node := range sorted {
+		pid := e.pidMaps[node.Value.String()]
+		if drainErr == nil {
+			drainErr = e.drain(ctx, pid)
 		}
+		if pid.mailbox != nil {
+			pid.mailbox.Stop()
+		}
+		pid.Stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// the connections do not outlive the engine, their unacknowledged messages are not flushed
+		for _, conn := range e.remotes {
+			conn.close()
+		}
+		return ctx.Err()
+	}
+
+	for _, conn := range e.remotes {
+		if err := conn.flush(ctx); err != nil && drainErr == nil {
+			drainErr = err
+		}
+		conn.close()
+	}
+	e.futures.failAll(fmt.Errorf("engine is shut down"))
+	e.sinkPool.Close()
+	if e.exporter != nil {
+		if err := e.exporter.Close(); err != nil {
+			e.logger.Errorw("close span exporter", "err", err)
+		}
+	}
+	return drainErr
+}
+
+// drain waits until the actor has handled all its pending messages
+func (e *Engine[Actor]) drain(ctx context.Context, pid *Pid) error {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for pid.Pending() > 0 {
+		if pid.State() == ActorStateStopped {
+			// stopped by its supervisor, nothing will handle the pending messages
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			e.logger.Warnw("drain interrupted", "pid", pid.String(), "pending", pid.Pending())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Ask sends a message to the DAG and returns a future of the leaf outputs, the DAG must have only one root actor
+// the future is resolved with ctx.Err() if ctx is done before all leaf actors have reported
+func (e *Engine[Actor]) Ask(ctx context.Context, msg any) (*Future, error) {
+	root, err := e.singleRoot()
+	if err != nil {
+		return nil, err
+	}
+	return e.ask(ctx, root, msg)
+}
+
+// AskTo sends a message to the root actor by name and returns a future of the leaf outputs reachable from it
+func (e *Engine[Actor]) AskTo(ctx context.Context, rootName string, msg any) (*Future, error) {
+	root, err := e.rootByName(rootName)
+	if err != nil {
+		return nil, err
+	}
+	return e.ask(ctx, root, msg)
+}
+
+func (e *Engine[Actor]) ask(ctx context.Context, root *Pid, msg any) (*Future, error) {
+	m := newMessage(uuid.New().String(), msg)
+	m.withContext(ctx)
+	uid := m.uid
+	future := newFuture(uid)
+
+	// register before sending, the leaf actors may report before Source returns
+	e.futures.register(future)
+	if err := e.source(ctx, root, m); err != nil {
+		e.futures.remove(uid)
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-future.Done():
+		case <-ctx.Done():
+			e.futures.remove(uid)
+			future.resolve(nil, ctx.Err())
+		}
+	}()
+	return future, nil
+}
+
+// SendAndWait sends a message to the DAG and blocks until every leaf actor has produced its output
+func (e *Engine[Actor]) SendAndWait(ctx context.Context, msg any) (map[string]any, error) {
+	future, err := e.Ask(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return future.Result()
+}
+
+// getRootActors returns the root actors of the DAG, the actors without parents, could be multiple
+func (e *Engine[Actor]) getRootActors() ([]*pkg.Node[Actor], error) {
+	roots := e.DAG.RootNodes()
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("No root actor found")
 	}
 	return roots, nil
 }
 
+// Roots returns the names of the root actors
+func (e *Engine[Actor]) Roots() []string {
+	names := make([]string, 0, len(e.roots))
+	for name := range e.roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // getNonLeafActors returns the non-leaf actors of the DAG, could be multiple
 func (e *Engine[Actor]) getNonLeafActors() []*pkg.Node[Actor] {
 	return e.DAG.GetNonLeafNodes()
@@ -170,15 +774,37 @@ func (e *Engine[Actor]) getChildActors(node *pkg.Node[Actor]) []*pkg.Node[Actor]
 	return e.DAG.Neighbors(node)
 }
 
-// sinkTickMsg is the message that is sent to the sink actor
+// sinkTickMsg is the message that is sent to the sink actor, it samples the actor's inbox depth too
+// every goroutine exits once the actor is stopped and its tick channels are drained
 func (e *Engine[Actor]) sinkTickMsg() {
+	_, nop := e.metrics.(nopMetrics)
 	for _, pid := range e.pidMaps {
+		e.wg.Add(1)
 		go func(pid *Pid) {
-			for {
+			defer e.wg.Done()
+			// the depth is sampled rather than reported by the actor, it is not stale while the actor is busy
+			var sample <-chan time.Time
+			if !nop {
+				ticker := time.NewTicker(inboxDepthInterval)
+				defer ticker.Stop()
+				sample = ticker.C
+			}
+			inCh, outCh := pid.TickInMsgCh, pid.TickOutMsgCh
+			for inCh != nil || outCh != nil {
 				select {
-				case in := <-pid.TickInMsgCh:
+				case <-sample:
+					e.metrics.InboxDepth(pid.actorName, pid.context.inbox.Len())
+				case in, ok := <-inCh:
+					if !ok {
+						inCh = nil
+						continue
+					}
 					e.sinkPool.PutInMsg(in.uid, in)
-				case out := <-pid.TickOutMsgCh:
+				case out, ok := <-outCh:
+					if !ok {
+						outCh = nil
+						continue
+					}
 					e.sinkPool.PutOutMsg(out.uid, out)
 				}
 			}
@@ -1,8 +1,14 @@
 package internel
 
 import (
+	"context"
 	"fmt"
+	"github.com/fzft/my-actor/pkg"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -41,6 +47,23 @@ func newDummy() *Dummy {
 	return &Dummy{}
 }
 
+// Echo prefixes the msg with its name
+type Echo struct {
+	name string
+}
+
+func (e *Echo) Receive(ctx *Context, msg any) (any, error) {
+	return fmt.Sprintf("%s(%v)", e.name, msg), nil
+}
+
+func (e *Echo) String() string {
+	return e.name
+}
+
+func newEcho(name string) *Echo {
+	return &Echo{name: name}
+}
+
 // TestEngine one node DAG, with dummy actor and recv msg and handle it
 func TestEngine_OneNode(t *testing.T) {
 	engine := NewEngine()
@@ -63,3 +86,468 @@ func TestEngine_OneNode(t *testing.T) {
 	t.Log(results)
 
 }
+
+// TestEngine_SendAndWait one node DAG, wait for the leaf output instead of polling the sinkPool
+func TestEngine_SendAndWait(t *testing.T) {
+	engine := NewEngine()
+	_, err := engine.Spawn(newDummy())
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outputs, err := engine.SendAndWait(ctx, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"dummy": "dummy:hello"}, outputs)
+
+	outputs, err = engine.SendAndWait(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, outputs["dummy"])
+
+	_, err = engine.SendAndWait(ctx, 1.5)
+	assert.NotNil(t, err)
+}
+
+// TestEngine_AskCanceled the future is resolved with the context error
+func TestEngine_AskCanceled(t *testing.T) {
+	engine := NewEngine()
+	_, err := engine.Ask(context.Background(), "hello")
+	assert.NotNil(t, err)
+
+	_, err = engine.Spawn(newDummy())
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	future, err := engine.Ask(ctx, "hello")
+	assert.Nil(t, err)
+	<-future.Done()
+	_, err = future.Result()
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// Lagging echoes the msg after a delay
+type Lagging struct {
+	delay time.Duration
+}
+
+func (l *Lagging) Receive(ctx *Context, msg any) (any, error) {
+	time.Sleep(l.delay)
+	return fmt.Sprintf("lagging(%v)", msg), nil
+}
+
+func (l *Lagging) String() string {
+	return "lagging"
+}
+
+// TestEngine_AskDeadline the future is resolved with the deadline error, before the actor has replied
+func TestEngine_AskDeadline(t *testing.T) {
+	engine := NewEngine()
+	_, err := engine.Spawn(&Lagging{delay: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	future, err := engine.Ask(ctx, "slow")
+	assert.Nil(t, err)
+	_, err = future.Result()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the late output of slow does not resolve the next ask
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outputs, err := engine.SendAndWait(ctx, "next")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"lagging": "lagging(next)"}, outputs)
+}
+
+// Counter counts the handled messages and the lifecycle hooks
+type Counter struct {
+	received int64
+	started  int64
+	stopped  int64
+}
+
+func (c *Counter) Receive(ctx *Context, msg any) (any, error) {
+	atomic.AddInt64(&c.received, 1)
+	return msg, nil
+}
+
+func (c *Counter) String() string {
+	return "counter"
+}
+
+func (c *Counter) PreStart() {
+	atomic.AddInt64(&c.started, 1)
+}
+
+func (c *Counter) PostStop() {
+	atomic.AddInt64(&c.stopped, 1)
+}
+
+// TestEngine_Shutdown drains the in-flight messages, calls PostStop and releases the goroutines
+func TestEngine_Shutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	engine := NewEngine()
+	counter := &Counter{}
+	_, err := engine.Spawn(counter)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, engine.Send(i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, engine.Shutdown(ctx))
+
+	assert.Equal(t, int64(100), atomic.LoadInt64(&counter.received))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&counter.started))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&counter.stopped))
+
+	assert.NotNil(t, engine.Send(1))
+	assert.NotNil(t, engine.Shutdown(ctx))
+
+	// give the runtime a moment to reap the exited goroutines
+	time.Sleep(100 * time.Millisecond)
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+// TestEngine_WaitStrategy the actor's inbox waits with the given strategy
+func TestEngine_WaitStrategy(t *testing.T) {
+	for _, wait := range []pkg.WaitStrategy{
+		pkg.NewBusySpinWaitStrategy(),
+		pkg.NewYieldingWaitStrategy(100),
+		pkg.NewSleepingWaitStrategy(time.Microsecond, time.Millisecond),
+		pkg.NewBlockingWaitStrategy(),
+	} {
+		engine := NewEngine()
+		_, err := engine.Spawn(newDummy(), WithWaitStrategy(wait))
+		assert.Nil(t, err)
+		assert.Nil(t, engine.Ready())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		outputs, err := engine.SendAndWait(ctx, "hello")
+		assert.Nil(t, err)
+		assert.Equal(t, "dummy:hello", outputs["dummy"])
+
+		assert.Nil(t, engine.Shutdown(ctx))
+		cancel()
+	}
+}
+
+// TestEngine_MultipleRoots two root actors with their own mailbox join into one leaf actor
+func TestEngine_MultipleRoots(t *testing.T) {
+	engine := NewEngine()
+	orders, err := engine.Spawn(newEcho("orders"))
+	assert.Nil(t, err)
+	prices, err := engine.Spawn(newEcho("prices"), WithMailbox(NewDefaultMailbox(engine.logger)))
+	assert.Nil(t, err)
+	enrich, err := engine.Spawn(newEcho("enrich"))
+	assert.Nil(t, err)
+	join, err := engine.Spawn(newEcho("join"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, engine.AddEdge(orders, enrich))
+	assert.Nil(t, engine.AddEdge(enrich, join))
+	assert.Nil(t, engine.AddEdge(prices, join))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	assert.Equal(t, []string{"orders", "prices"}, engine.Roots())
+	assert.NotNil(t, engine.Send("hello"))
+	assert.NotNil(t, engine.SendTo("enrich", "hello"))
+	assert.Nil(t, engine.SendTo("prices", 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	future, err := engine.AskTo(ctx, "orders", "o1")
+	assert.Nil(t, err)
+	outputs, err := future.Result()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"join": "join(enrich(orders(o1)))"}, outputs)
+
+	future, err = engine.AskTo(ctx, "prices", "p1")
+	assert.Nil(t, err)
+	outputs, err = future.Result()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"join": "join(prices(p1))"}, outputs)
+}
+
+// TestEngine_MailboxOnNonRoot only root actors can have a mailbox
+func TestEngine_MailboxOnNonRoot(t *testing.T) {
+	engine := NewEngine()
+	a, err := engine.Spawn(newEcho("a"))
+	assert.Nil(t, err)
+	b, err := engine.Spawn(newEcho("b"), WithMailbox(NewDefaultMailbox(engine.logger)))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(a, b))
+	assert.NotNil(t, engine.Ready())
+}
+
+// Router routes the msg to the child named by the msg
+type Router struct{}
+
+func (r *Router) Receive(ctx *Context, msg any) (any, error) {
+	return Route{To: []string{fmt.Sprint(msg)}, Data: msg}, nil
+}
+
+func (r *Router) String() string {
+	return "router"
+}
+
+// TestEngine_AddEdgeWhen the output only goes down the edges whose predicate holds
+func TestEngine_AddEdgeWhen(t *testing.T) {
+	engine := NewEngine()
+	classify, err := engine.Spawn(newDummy())
+	assert.Nil(t, err)
+	fraud, err := engine.Spawn(newEcho("fraud"))
+	assert.Nil(t, err)
+	clean, err := engine.Spawn(newEcho("clean"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, engine.AddEdgeWhen(classify, fraud, func(out any) bool {
+		return out.(int) > 100
+	}))
+	assert.Nil(t, engine.AddEdgeWhen(classify, clean, func(out any) bool {
+		return out.(int) <= 100
+	}))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outputs, err := engine.SendAndWait(ctx, 500)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"fraud": "fraud(501)"}, outputs)
+
+	outputs, err = engine.SendAndWait(ctx, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"clean": "clean(6)"}, outputs)
+}
+
+// TestEngine_Route the actor picks the children with a Route envelope
+func TestEngine_Route(t *testing.T) {
+	engine := NewEngine()
+	router, err := engine.Spawn(&Router{})
+	assert.Nil(t, err)
+	for _, name := range []string{"a", "b"} {
+		child, err := engine.Spawn(newEcho(name))
+		assert.Nil(t, err)
+		assert.Nil(t, engine.AddEdge(router, child))
+	}
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outputs, err := engine.SendAndWait(ctx, "b")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"b": "b(b)"}, outputs)
+
+	// routed to nowhere
+	outputs, err = engine.SendAndWait(ctx, "c")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{}, outputs)
+}
+
+// Sleeper sleeps for delay, if abortable it gives up when the message's context is done
+type Sleeper struct {
+	name      string
+	delay     time.Duration
+	abortable bool
+}
+
+func (s *Sleeper) Receive(ctx *Context, msg any) (any, error) {
+	if !s.abortable {
+		time.Sleep(s.delay)
+		return msg, nil
+	}
+	select {
+	case <-time.After(s.delay):
+		return msg, nil
+	case <-ctx.Context().Done():
+		return nil, ctx.Context().Err()
+	}
+}
+
+func (s *Sleeper) String() string {
+	return s.name
+}
+
+func TestEngine_SendWithContext(t *testing.T) {
+	engine := NewEngine()
+	slow, err := engine.Spawn(&Sleeper{name: "slow", delay: 50 * time.Millisecond})
+	assert.Nil(t, err)
+	leaf, err := engine.Spawn(newEcho("leaf"))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(slow, leaf))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	streamCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream := engine.SinkPool().Stream(streamCtx)
+
+	// the message expires while the slow actor sleeps, the leaf actor drops it
+	ctx, cancelMsg := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelMsg()
+	assert.Nil(t, engine.SendWithContext(ctx, "hello"))
+
+	select {
+	case result := <-stream:
+		outs := make(map[string]TickOutMsg)
+		for _, out := range result.Out() {
+			outs[out.Pid()] = out
+		}
+		assert.False(t, outs["pid:slow"].TimedOut())
+		assert.True(t, outs["pid:leaf"].TimedOut())
+		assert.ErrorIs(t, outs["pid:leaf"].Err(), context.DeadlineExceeded)
+	case <-streamCtx.Done():
+		t.Fatal("result is not streamed")
+	}
+
+	// a canceled context is rejected
+	assert.NotNil(t, engine.SendWithContext(ctx, "late"))
+}
+
+func TestEngine_ContextAbortsReceive(t *testing.T) {
+	engine := NewEngine()
+	_, err := engine.Spawn(&Sleeper{name: "sleeper", delay: time.Minute, abortable: true})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	future, err := engine.Ask(ctx, "hello")
+	assert.Nil(t, err)
+	_, err = future.Result()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the actor gives up, and handles the next message right away
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel2()
+	future, err = engine.Ask(ctx2, "again")
+	assert.Nil(t, err)
+	_, err = future.Result()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestEngine_Backpressure(t *testing.T) {
+	gate := &Gate{started: make(chan any, 1000), open: make(chan struct{})}
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"), WithMailbox(NewDefaultMailboxWithSize(zap.NewNop().Sugar(), 1)), WithInboxSize(2))
+	assert.Nil(t, err)
+	leaf, err := engine.Spawn(gate, WithInboxSize(2))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, leaf))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	// the blocked leaf fills its inbox, then its parent, then the root mailbox
+	accepted := 0
+	for ; accepted < 1000; accepted++ {
+		if err = engine.Send(accepted); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.ErrorIs(t, err, ErrBusy)
+	assert.True(t, accepted < 10)
+
+	// nothing accepted is lost
+	close(gate.open)
+	for i := 0; i < accepted; i++ {
+		assert.Equal(t, fmt.Sprintf("src(%d)", i), <-gate.started)
+	}
+}
+
+// TestEngine_FanIn several parents write into the small inbox of one child, every message arrives exactly once
+func TestEngine_FanIn(t *testing.T) {
+	const parents, perParent = 4, 500
+	sink := &Tenant{name: "sink", envelopes: make(chan Envelope, parents*perParent)}
+	engine := NewEngine()
+	leaf, err := engine.Spawn(sink, WithInboxSize(4))
+	assert.Nil(t, err)
+	var roots []string
+	for p := 0; p < parents; p++ {
+		name := fmt.Sprintf("p%d", p)
+		root, err := engine.Spawn(newEcho(name))
+		assert.Nil(t, err)
+		assert.Nil(t, engine.AddEdge(root, leaf))
+		roots = append(roots, name)
+	}
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	var wg sync.WaitGroup
+	for _, name := range roots {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for i := 0; i < perParent; i++ {
+				msg := Envelope{Uid: fmt.Sprintf("%s-%d", name, i), Data: i}
+				for engine.SendTo(name, msg) != nil {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for i := 0; i < parents*perParent; i++ {
+		select {
+		case envelope := <-sink.envelopes:
+			seen[envelope.Uid]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d messages of %d", i, parents*perParent)
+		}
+	}
+	for uid, count := range seen {
+		assert.Equal(t, 1, count, uid)
+	}
+	assert.Len(t, seen, parents*perParent)
+}
+
+func TestEngine_EdgeDrop(t *testing.T) {
+	gate := &Gate{started: make(chan any, 10), open: make(chan struct{})}
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	leaf, err := engine.Spawn(gate, WithInboxSize(2))
+	assert.Nil(t, err)
+	assert.NotNil(t, engine.SetEdgePolicy(src, leaf, EdgeDrop))
+	assert.Nil(t, engine.AddEdge(src, leaf))
+	assert.Nil(t, engine.SetEdgePolicy(src, leaf, EdgeDrop))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	assert.Nil(t, engine.Send(1))
+	assert.Equal(t, "src(1)", <-gate.started)
+	// the leaf's inbox holds one message, the others are dropped without blocking src
+	for i := 2; i <= 5; i++ {
+		assert.Nil(t, engine.Send(i))
+		assert.Eventually(t, func() bool { return src.Pending() == 0 }, time.Second, time.Millisecond)
+	}
+
+	close(gate.open)
+	assert.Equal(t, "src(2)", <-gate.started)
+	assert.Eventually(t, func() bool { return leaf.Pending() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, len(gate.started))
+}
@@ -0,0 +1,464 @@
+package internel
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// EventSourcedActor keeps its state as the events it emits with Context.Emit in Receive
+// once Receive returns, the engine appends the events to the actor's journal, then applies them with ApplyEvent
+// when the actor starts or restarts, the journal is replayed, from the latest snapshot, before PreStart and the first message
+type EventSourcedActor interface {
+	Actor
+
+	// ApplyEvent applies an event to the state, it must not fail, it is called on emit and on replay
+	ApplyEvent(event any)
+}
+
+// SnapshotActor is an EventSourcedActor whose state is snapshotted, see WithEventSnapshots
+type SnapshotActor interface {
+	EventSourcedActor
+
+	// Snapshot returns the state, it must be encodable by the journal
+	Snapshot() any
+
+	// RestoreSnapshot replaces the state, the events after the snapshot are replayed on top of it
+	RestoreSnapshot(snapshot any)
+}
+
+// EventDecoder decodes the events and the snapshot a journal returns as json.RawMessage into the actor's types
+// it is a fallback for the journals that do not decode them, e.g. a FileJournal without a codec in an engine without a type registry
+// without it, the actor replays the JSON decoding, e.g. map[string]any
+type EventDecoder interface {
+	DecodeEvent(data json.RawMessage) (any, error)
+	DecodeSnapshot(data json.RawMessage) (any, error)
+}
+
+// JournalEvent is an event in the journal, Seq starts at 1 and increases by 1 for every event of the actor
+type JournalEvent struct {
+	Seq   uint64
+	Event any
+}
+
+// Journal persists the events of one actor
+type Journal interface {
+	// Append persists the events, all of them or none
+	Append(events []JournalEvent) error
+
+	// Replay calls fn with the events whose Seq is after from, in order
+	Replay(from uint64, fn func(event JournalEvent) error) error
+
+	// SaveSnapshot persists the state of the actor at seq
+	SaveSnapshot(seq uint64, snapshot any) error
+
+	// LoadSnapshot returns the latest snapshot, ok is false if there is none
+	LoadSnapshot() (seq uint64, snapshot any, ok bool, err error)
+
+	Close() error
+}
+
+// WithJournal sets the journal of an EventSourcedActor, see Engine.SetJournalDir for the default
+func WithJournal(journal Journal) PidOption {
+	return func(p *Pid) {
+		p.journal = journal
+	}
+}
+
+// WithEventSnapshots snapshots a SnapshotActor after every n events, the replay starts from the latest snapshot
+func WithEventSnapshots(n int) PidOption {
+	return func(p *Pid) {
+		p.snapshotEvery = n
+	}
+}
+
+// Emit records an event of an EventSourcedActor, it is persisted and applied once Receive returns without error
+func (c *Context) Emit(event any) {
+	c.events = append(c.events, event)
+}
+
+// takeEvents returns the events emitted in the current Receive
+func (c *Context) takeEvents() []any {
+	events := c.events
+	c.events = nil
+	return events
+}
+
+// persist appends the events emitted in the Receive to the journal, and applies them
+// nothing is applied if the journal fails
+func (p *Pid) persist() error {
+	events := p.context.takeEvents()
+	if p.journal == nil || len(events) == 0 {
+		return nil
+	}
+	actor, ok := p.actor.(EventSourcedActor)
+	if !ok {
+		return nil
+	}
+
+	entries := make([]JournalEvent, len(events))
+	for i, event := range events {
+		entries[i] = JournalEvent{Seq: p.seq + uint64(i) + 1, Event: event}
+	}
+	if err := p.journal.Append(entries); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	for _, event := range events {
+		actor.ApplyEvent(event)
+	}
+	p.seq += uint64(len(events))
+
+	p.sinceSnapshot += len(events)
+	if s, ok := p.actor.(SnapshotActor); ok && p.snapshotEvery > 0 && p.sinceSnapshot >= p.snapshotEvery {
+		if err := p.journal.SaveSnapshot(p.seq, s.Snapshot()); err != nil {
+			p.logger.Errorw("save snapshot", "pid", p.String(), "seq", p.seq, "err", err)
+		} else {
+			p.sinceSnapshot = 0
+		}
+	}
+	return nil
+}
+
+// replay restores the state of an EventSourcedActor from its journal, from the latest snapshot
+func (p *Pid) replay() error {
+	actor, ok := p.actor.(EventSourcedActor)
+	if !ok || p.journal == nil {
+		return nil
+	}
+	decoder, _ := p.actor.(EventDecoder)
+
+	p.seq, p.sinceSnapshot = 0, 0
+	if s, ok := p.actor.(SnapshotActor); ok {
+		seq, snapshot, found, err := p.journal.LoadSnapshot()
+		if err != nil {
+			return fmt.Errorf("load snapshot: %w", err)
+		}
+		if found {
+			if raw, ok := snapshot.(json.RawMessage); ok {
+				if snapshot, err = decodeJournal(raw, decoderFunc(decoder, true)); err != nil {
+					return fmt.Errorf("decode snapshot: %w", err)
+				}
+			}
+			s.RestoreSnapshot(snapshot)
+			p.seq = seq
+		}
+	}
+
+	err := p.journal.Replay(p.seq, func(entry JournalEvent) error {
+		event := entry.Event
+		if raw, ok := event.(json.RawMessage); ok {
+			var err error
+			if event, err = decodeJournal(raw, decoderFunc(decoder, false)); err != nil {
+				return fmt.Errorf("decode event %d: %w", entry.Seq, err)
+			}
+		}
+		actor.ApplyEvent(event)
+		p.seq = entry.Seq
+		p.sinceSnapshot++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.logger.Debugw("replayed journal", "pid", p.String(), "seq", p.seq)
+	return nil
+}
+
+// decoderFunc returns the actor's decoder of snapshots or events, nil if it has none
+func decoderFunc(decoder EventDecoder, snapshot bool) func(data json.RawMessage) (any, error) {
+	if decoder == nil {
+		return nil
+	}
+	if snapshot {
+		return decoder.DecodeSnapshot
+	}
+	return decoder.DecodeEvent
+}
+
+func decodeJournal(data json.RawMessage, decode func(data json.RawMessage) (any, error)) (any, error) {
+	if decode != nil {
+		return decode(data)
+	}
+	var v any
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// MemoryJournal is a Journal that keeps the events in memory, e.g. for tests
+type MemoryJournal struct {
+	mu          sync.Mutex
+	events      []JournalEvent
+	snapshotSeq uint64
+	snapshot    any
+	hasSnapshot bool
+}
+
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{}
+}
+
+func (m *MemoryJournal) Append(events []JournalEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *MemoryJournal) Replay(from uint64, fn func(event JournalEvent) error) error {
+	m.mu.Lock()
+	events := append([]JournalEvent(nil), m.events...)
+	m.mu.Unlock()
+
+	for _, event := range events {
+		if event.Seq <= from {
+			continue
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryJournal) SaveSnapshot(seq uint64, snapshot any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshotSeq, m.snapshot, m.hasSnapshot = seq, snapshot, true
+	return nil
+}
+
+func (m *MemoryJournal) LoadSnapshot() (uint64, any, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshotSeq, m.snapshot, m.hasSnapshot, nil
+}
+
+func (m *MemoryJournal) Close() error {
+	return nil
+}
+
+// Events returns the journaled events, in order
+func (m *MemoryJournal) Events() []JournalEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]JournalEvent(nil), m.events...)
+}
+
+const (
+	journalFile         = "events.log"
+	journalSnapshotFile = "snapshot.json"
+)
+
+// FileJournalOption configures a FileJournal
+type FileJournalOption func(f *FileJournal)
+
+// WithJournalSync fsyncs the journal after every append, a crash of the host loses no event
+func WithJournalSync() FileJournalOption {
+	return func(f *FileJournal) {
+		f.sync = true
+	}
+}
+
+// WithJournalCodec encodes the events and the snapshot with codec, Replay and LoadSnapshot return their decoding
+// by default it is a JSONCodec of the engine's type registry, set at Ready
+func WithJournalCodec(codec Codec) FileJournalOption {
+	return func(f *FileJournal) {
+		f.codec = codec
+	}
+}
+
+// FileJournal is a Journal that appends the events to a log file in a directory, it is never truncated
+// a record is the length and the crc32 of the JSON payload, like a FileSink, a torn record at the end is truncated on open
+// the snapshot is a JSON file replaced on every save
+// the events and the snapshot are encoded with the codec, without a codec they are JSON, and Replay and LoadSnapshot return json.RawMessage
+type FileJournal struct {
+	dir  string
+	sync bool
+
+	mu     sync.Mutex
+	codec  Codec
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// journalRecord is an event in the log, or the snapshot, a record of the log is the events of one Append
+type journalRecord struct {
+	Seq  uint64 `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+// OpenFileJournal opens the journal in dir, it is created if it does not exist
+func OpenFileJournal(dir string, opts ...FileJournalOption) (*FileJournal, error) {
+	f := &FileJournal{dir: dir}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, journalFile)
+	if _, err := os.Stat(path); err == nil {
+		size, err := validLength(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Truncate(path, size); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.file = file
+	f.writer = bufio.NewWriter(file)
+	return f, nil
+}
+
+// Append writes the events as one record, a torn batch is dropped as a whole when the journal is opened
+func (f *FileJournal) Append(events []JournalEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records := make([]journalRecord, len(events))
+	for i, event := range events {
+		data, err := f.encode(event.Event)
+		if err != nil {
+			return fmt.Errorf("event %d: %w", event.Seq, err)
+		}
+		records[i] = journalRecord{Seq: event.Seq, Data: data}
+	}
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	if _, err := writePayload(f.writer, payload); err != nil {
+		return err
+	}
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	if f.sync {
+		return f.file.Sync()
+	}
+	return nil
+}
+
+func (f *FileJournal) Replay(from uint64, fn func(event JournalEvent) error) error {
+	file, err := os.Open(filepath.Join(f.dir, journalFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		payload, err := readPayload(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var records []journalRecord
+		if err := json.Unmarshal(payload, &records); err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Seq <= from {
+				continue
+			}
+			f.mu.Lock()
+			event, err := f.decode(record.Data)
+			f.mu.Unlock()
+			if err != nil {
+				return fmt.Errorf("event %d: %w", record.Seq, err)
+			}
+			if err := fn(JournalEvent{Seq: record.Seq, Event: event}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *FileJournal) SaveSnapshot(seq uint64, snapshot any) error {
+	f.mu.Lock()
+	data, err := f.encode(snapshot)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(journalRecord{Seq: seq, Data: data})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(f.dir, journalSnapshotFile+".tmp")
+	if err := writeFileSync(tmp, payload); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(f.dir, journalSnapshotFile))
+}
+
+func (f *FileJournal) LoadSnapshot() (uint64, any, bool, error) {
+	payload, err := os.ReadFile(filepath.Join(f.dir, journalSnapshotFile))
+	if os.IsNotExist(err) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	var record journalRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return 0, nil, false, err
+	}
+	f.mu.Lock()
+	snapshot, err := f.decode(record.Data)
+	f.mu.Unlock()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return record.Seq, snapshot, true, nil
+}
+
+// encode encodes an event or the snapshot with the codec, as JSON without one, must be called with mu held
+func (f *FileJournal) encode(v any) ([]byte, error) {
+	if f.codec == nil {
+		return json.Marshal(v)
+	}
+	return f.codec.Marshal(v)
+}
+
+// decode decodes an event or the snapshot with the codec, it is json.RawMessage without one, must be called with mu held
+func (f *FileJournal) decode(data []byte) (any, error) {
+	if f.codec == nil {
+		return json.RawMessage(data), nil
+	}
+	return f.codec.Unmarshal(data)
+}
+
+func (f *FileJournal) setDefaultCodec(codec Codec) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.codec == nil {
+		f.codec = codec
+	}
+}
+
+func (f *FileJournal) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.writer.Flush()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
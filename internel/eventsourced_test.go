@@ -0,0 +1,255 @@
+package internel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type Deposit struct {
+	Account string
+	Amount  float64
+}
+
+type Deposited struct {
+	Account string
+	Amount  float64
+}
+
+// Ledger is an event sourced actor of account balances
+type Ledger struct {
+	balances map[string]float64
+	// applied counts the ApplyEvent calls, started receives the balances and applied in PreStart
+	applied int
+	started chan ledgerState
+}
+
+type ledgerState struct {
+	balances map[string]float64
+	applied  int
+}
+
+func newLedger() *Ledger {
+	return &Ledger{balances: make(map[string]float64), started: make(chan ledgerState, 1)}
+}
+
+func (l *Ledger) Receive(ctx *Context, msg any) (any, error) {
+	deposit := msg.(Deposit)
+	if deposit.Amount <= 0 {
+		return nil, fmt.Errorf("invalid amount %v", deposit.Amount)
+	}
+	ctx.Emit(Deposited(deposit))
+	return l.balances[deposit.Account] + deposit.Amount, nil
+}
+
+func (l *Ledger) ApplyEvent(event any) {
+	deposited := event.(Deposited)
+	l.balances[deposited.Account] += deposited.Amount
+	l.applied++
+}
+
+func (l *Ledger) Snapshot() any {
+	balances := make(map[string]float64)
+	for account, balance := range l.balances {
+		balances[account] = balance
+	}
+	return balances
+}
+
+func (l *Ledger) RestoreSnapshot(snapshot any) {
+	l.balances = snapshot.(map[string]float64)
+}
+
+func (l *Ledger) DecodeEvent(data json.RawMessage) (any, error) {
+	var event Deposited
+	err := json.Unmarshal(data, &event)
+	return event, err
+}
+
+func (l *Ledger) DecodeSnapshot(data json.RawMessage) (any, error) {
+	var balances map[string]float64
+	err := json.Unmarshal(data, &balances)
+	return balances, err
+}
+
+func (l *Ledger) PreStart() {
+	l.started <- ledgerState{balances: l.Snapshot().(map[string]float64), applied: l.applied}
+}
+
+func (l *Ledger) String() string {
+	return "ledger"
+}
+
+func TestEventSourcedActor_Replay(t *testing.T) {
+	dir := t.TempDir()
+	deposits := []Deposit{{"alice", 10}, {"bob", 5}, {"alice", -1}, {"alice", 2}}
+
+	ledger := newLedger()
+	engine := NewEngine()
+	engine.SetJournalDir(dir)
+	_, err := engine.Spawn(ledger, WithEventSnapshots(2))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	assert.Equal(t, ledgerState{balances: map[string]float64{}}, <-ledger.started)
+
+	for _, deposit := range deposits {
+		outputs, err := engine.SendAndWait(context.Background(), deposit)
+		if deposit.Amount < 0 {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.NotNil(t, outputs["ledger"])
+	}
+	assert.Nil(t, engine.Shutdown(context.Background()))
+	assert.Equal(t, map[string]float64{"alice": 12, "bob": 5}, ledger.balances)
+
+	// the new ledger restores the snapshot of the first 2 events, and replays the third
+	restored := newLedger()
+	engine = NewEngine()
+	engine.SetJournalDir(dir)
+	_, err = engine.Spawn(restored, WithEventSnapshots(2))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	assert.Equal(t, ledgerState{balances: map[string]float64{"alice": 12, "bob": 5}, applied: 1}, <-restored.started)
+
+	outputs, err := engine.SendAndWait(context.Background(), Deposit{"bob", 1})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(6), outputs["ledger"])
+	assert.Nil(t, engine.Shutdown(context.Background()))
+
+	// the journal keeps every event for the audit
+	journal, err := OpenFileJournal(filepath.Join(dir, "ledger"))
+	assert.Nil(t, err)
+	defer journal.Close()
+	var seqs []uint64
+	assert.Nil(t, journal.Replay(0, func(event JournalEvent) error {
+		seqs = append(seqs, event.Seq)
+		return nil
+	}))
+	assert.Equal(t, []uint64{1, 2, 3, 4}, seqs)
+}
+
+func TestEventSourcedActor_Restart(t *testing.T) {
+	journal := NewMemoryJournal()
+	ledger := newLedger()
+	restarted := newLedger()
+	engine := NewEngine()
+	_, err := engine.Spawn(ledger, WithJournal(journal), WithSupervisor(SupervisorStrategy{
+		Decider: func(err error) Directive { return DirectiveRestart },
+		Factory: func() Actor { return restarted },
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+	<-ledger.started
+
+	_, err = engine.SendAndWait(context.Background(), Deposit{"alice", 3})
+	assert.Nil(t, err)
+	_, err = engine.SendAndWait(context.Background(), Deposit{"alice", 0})
+	assert.NotNil(t, err)
+
+	// the actor recreated by the supervisor replays the journal
+	assert.Equal(t, ledgerState{balances: map[string]float64{"alice": 3}, applied: 1}, <-restarted.started)
+	assert.Equal(t, []JournalEvent{{Seq: 1, Event: Deposited{"alice", 3}}}, journal.Events())
+}
+
+// DeclaredLedger is a Ledger that declares its types, its journal encodes them with the engine's registry
+type DeclaredLedger struct {
+	*Ledger
+}
+
+func (l DeclaredLedger) MessageTypes() []any {
+	return []any{Deposit{}, Deposited{}, map[string]float64{}, float64(0)}
+}
+
+func TestEventSourcedActor_TypeRegistry(t *testing.T) {
+	types := NewTypeRegistry()
+	types.MustRegister("ledger.Deposit", Deposit{})
+	types.MustRegister("ledger.Deposited", Deposited{})
+
+	// the type of the snapshot is declared and not registered
+	engine := NewEngine()
+	engine.SetTypeRegistry(types)
+	engine.SetJournalDir(t.TempDir())
+	_, err := engine.Spawn(DeclaredLedger{newLedger()})
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(engine.Ready(), ErrUnregisteredType))
+
+	types.MustRegister("ledger.Balances", map[string]float64{})
+	dir := t.TempDir()
+	for _, want := range []ledgerState{{balances: map[string]float64{}}, {balances: map[string]float64{"alice": 3}}} {
+		ledger := newLedger()
+		engine = NewEngine()
+		engine.SetTypeRegistry(types)
+		engine.SetJournalDir(dir)
+		_, err = engine.Spawn(DeclaredLedger{ledger}, WithEventSnapshots(2))
+		assert.Nil(t, err)
+		assert.Nil(t, engine.Ready())
+		// the restarted ledger restores the snapshot of the 2 events
+		assert.Equal(t, want, <-ledger.started)
+		for _, amount := range []float64{1, 2} {
+			_, err := engine.SendAndWait(context.Background(), Deposit{"alice", amount})
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, engine.Shutdown(context.Background()))
+	}
+
+	// the journal holds the concrete types, the replay does not go through DecodeEvent
+	journal, err := OpenFileJournal(filepath.Join(dir, "ledger"), WithJournalCodec(NewJSONCodec(types)))
+	assert.Nil(t, err)
+	defer journal.Close()
+	var events []any
+	assert.Nil(t, journal.Replay(0, func(event JournalEvent) error {
+		events = append(events, event.Event)
+		return nil
+	}))
+	assert.Equal(t, []any{Deposited{"alice", 1}, Deposited{"alice", 2}, Deposited{"alice", 1}, Deposited{"alice", 2}}, events)
+	seq, snapshot, ok, err := journal.LoadSnapshot()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), seq)
+	assert.Equal(t, map[string]float64{"alice": 6}, snapshot)
+}
+
+func TestEventSourcedActor_NoJournal(t *testing.T) {
+	engine := NewEngine()
+	_, err := engine.Spawn(newLedger())
+	assert.Nil(t, err)
+	assert.NotNil(t, engine.Ready())
+}
+
+func TestFileJournal_TornBatch(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := OpenFileJournal(dir, WithJournalSync())
+	assert.Nil(t, err)
+	assert.Nil(t, journal.Append([]JournalEvent{{Seq: 1, Event: "a"}, {Seq: 2, Event: "b"}}))
+	assert.Nil(t, journal.Close())
+
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 40, 1, 2})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	journal, err = OpenFileJournal(dir)
+	assert.Nil(t, err)
+	defer journal.Close()
+	assert.Nil(t, journal.Append([]JournalEvent{{Seq: 3, Event: "c"}}))
+
+	var events []string
+	assert.Nil(t, journal.Replay(1, func(event JournalEvent) error {
+		events = append(events, string(event.Event.(json.RawMessage)))
+		return nil
+	}))
+	assert.Equal(t, []string{`"b"`, `"c"`}, events)
+
+	_, _, ok, err := journal.LoadSnapshot()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,689 @@
+package internel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SinkBackend persists the completed results of a SinkPool, see WithBackend
+type SinkBackend interface {
+	// Append persists a result, it is called from one goroutine in completion order
+	Append(result SinkResult) error
+
+	// Close flushes and releases the backend, it is called once the pool is closed
+	Close() error
+}
+
+const (
+	defaultSegmentSize = 64 << 20
+	segmentExt         = ".log"
+
+	// recordHeaderSize is the length and the crc32 of the payload, both big endian uint32
+	recordHeaderSize = 8
+	// maxRecordSize caps the length of a payload, a header above it is corrupt
+	maxRecordSize = 64 << 20
+)
+
+// FileSinkOption configures a FileSink
+type FileSinkOption func(f *FileSink)
+
+// WithSegmentSize rotates to a new segment once the active one reaches size bytes
+func WithSegmentSize(size int64) FileSinkOption {
+	return func(f *FileSink) {
+		f.segmentSize = size
+	}
+}
+
+// WithSyncWrites fsyncs the segment after every record, a crash loses no acknowledged result
+func WithSyncWrites() FileSinkOption {
+	return func(f *FileSink) {
+		f.sync = true
+	}
+}
+
+// WithSinkCodec encodes the inputs and the outputs of the results with codec
+// by default it is a JSONCodec of the engine's type registry, set at Ready, or plain JSON without a registry
+func WithSinkCodec(codec Codec) FileSinkOption {
+	return func(f *FileSink) {
+		f.codec = codec
+	}
+}
+
+// FileSink is a SinkBackend that appends every result to a log of segment files in a directory
+// a record is the length and the crc32 of the payload, then the JSON payload, the inputs and the outputs in it are encoded with the codec
+// a torn record at the end of the log, e.g. after a crash, is truncated when the sink is opened
+// a corrupt record before the end of the log fails the open, the records after it are not dropped
+type FileSink struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+
+	mu       sync.Mutex
+	codec    Codec
+	segments []int // the segment ids in order, the last one is active
+	active   *os.File
+	writer   *bufio.Writer
+	size     int64
+	closed   bool
+}
+
+// OpenFileSink opens the log in dir, it is created if it does not exist
+func OpenFileSink(dir string, opts ...FileSinkOption) (*FileSink, error) {
+	f := &FileSink{
+		dir:         dir,
+		segmentSize: defaultSegmentSize,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	f.segments = segments
+
+	if len(segments) == 0 {
+		if err := f.rotate(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	// repair the tail of the active segment and append to it
+	path := f.segmentPath(segments[len(segments)-1])
+	size, err := validLength(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(path, size); err != nil {
+		return nil, err
+	}
+	active, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.active = active
+	f.writer = bufio.NewWriter(active)
+	f.size = size
+	return f, nil
+}
+
+// Append appends the result to the active segment, and rotates the segment if it is full
+func (f *FileSink) Append(result SinkResult) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fmt.Errorf("file sink is closed")
+	}
+
+	n, err := writeRecord(f.writer, result, codecOrPlainJSON(f.codec))
+	if err != nil {
+		return fmt.Errorf("append result %s: %w", result.uid, err)
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+	f.size += int64(n)
+
+	if f.size >= f.segmentSize {
+		return f.rotate()
+	}
+	return nil
+}
+
+// Close flushes and closes the active segment
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if err := f.flush(); err != nil {
+		f.active.Close()
+		return err
+	}
+	return f.active.Close()
+}
+
+// Segments returns the number of segment files
+func (f *FileSink) Segments() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.segments)
+}
+
+// Compact rewrites the sealed segments, it drops the results keep returns false for,
+// and the results whose uid is appended again later. the active segment is not rewritten
+func (f *FileSink) Compact(keep func(result SinkResult) bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fmt.Errorf("file sink is closed")
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	// the last segment and record index of every uid
+	type position struct{ segment, index int }
+	last := make(map[string]position)
+	for _, id := range f.segments {
+		index := 0
+		err := readSegment(f.segmentPath(id), codecOrPlainJSON(f.codec), func(result SinkResult) error {
+			last[result.uid] = position{id, index}
+			index++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	sealed, active := f.segments[:len(f.segments)-1], f.segments[len(f.segments)-1]
+	var segments []int
+	for i, id := range sealed {
+		kept, err := f.compactSegment(id, func(result SinkResult, index int) bool {
+			return last[result.uid] == (position{id, index}) && keep(result)
+		})
+		if err != nil {
+			// the segments not compacted yet are left as they are
+			f.segments = append(append(segments, sealed[i:]...), active)
+			return err
+		}
+		if kept {
+			segments = append(segments, id)
+		}
+	}
+	f.segments = append(segments, active)
+	return nil
+}
+
+// compactSegment rewrites the segment with the records keep returns true for, the file is removed if none is kept
+// must be called with mu held
+func (f *FileSink) compactSegment(id int, keep func(result SinkResult, index int) bool) (bool, error) {
+	path := f.segmentPath(id)
+	tmp := path + ".compact"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	w := bufio.NewWriter(out)
+	codec := codecOrPlainJSON(f.codec)
+
+	index, kept := 0, 0
+	err = readSegment(path, codec, func(result SinkResult) error {
+		defer func() { index++ }()
+		if !keep(result, index) {
+			return nil
+		}
+		kept++
+		_, err := writeRecord(w, result, codec)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	if kept == 0 {
+		os.Remove(tmp)
+		return false, os.Remove(path)
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// Iterator returns an iterator over the results appended so far, in append order
+func (f *FileSink) Iterator() (*SinkIterator, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, fmt.Errorf("file sink is closed")
+	}
+	if err := f.flush(); err != nil {
+		return nil, err
+	}
+
+	it := &SinkIterator{codec: codecOrPlainJSON(f.codec)}
+	for _, id := range f.segments {
+		it.paths = append(it.paths, f.segmentPath(id))
+	}
+	// the records appended after the iterator is created are not read
+	it.activeSize = f.size
+	return it, nil
+}
+
+func (f *FileSink) setDefaultCodec(codec Codec) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.codec == nil {
+		f.codec = codec
+	}
+}
+
+// flush writes the buffered records to the active segment, must be called with mu held
+func (f *FileSink) flush() error {
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	if f.sync {
+		return f.active.Sync()
+	}
+	return nil
+}
+
+// rotate seals the active segment and creates a new one, must be called with mu held
+func (f *FileSink) rotate() error {
+	next := 0
+	if len(f.segments) > 0 {
+		next = f.segments[len(f.segments)-1] + 1
+	}
+	if f.active != nil {
+		if err := f.flush(); err != nil {
+			return err
+		}
+		if err := f.active.Close(); err != nil {
+			return err
+		}
+		f.segments = append(f.segments, next)
+	} else {
+		f.segments = []int{next}
+	}
+
+	active, err := os.OpenFile(f.segmentPath(next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	f.active = active
+	f.writer = bufio.NewWriter(active)
+	f.size = 0
+	return nil
+}
+
+func (f *FileSink) segmentPath(id int) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// SinkIterator reads the results of a FileSink
+//
+//	it, err := sink.Iterator()
+//	defer it.Close()
+//	for it.Next() {
+//		result := it.Result()
+//	}
+//	err = it.Err()
+type SinkIterator struct {
+	paths      []string
+	activeSize int64
+	codec      Codec
+
+	file   *os.File
+	reader *bufio.Reader
+	result SinkResult
+	err    error
+}
+
+// Next reads the next result, it returns false at the end of the log or on error
+func (it *SinkIterator) Next() bool {
+	for it.err == nil {
+		if it.reader == nil {
+			if len(it.paths) == 0 {
+				return false
+			}
+			if !it.open() {
+				continue
+			}
+		}
+
+		result, err := readRecord(it.reader, it.codec)
+		if err == io.EOF {
+			it.closeFile()
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.result = result
+		return true
+	}
+	return false
+}
+
+// open opens the next segment, it returns false if the segment has been compacted away
+func (it *SinkIterator) open() bool {
+	path := it.paths[0]
+	it.paths = it.paths[1:]
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.file = file
+
+	var r io.Reader = file
+	if len(it.paths) == 0 {
+		r = io.LimitReader(file, it.activeSize)
+	}
+	it.reader = bufio.NewReader(r)
+	return true
+}
+
+func (it *SinkIterator) closeFile() {
+	if it.file != nil {
+		it.file.Close()
+	}
+	it.file, it.reader = nil, nil
+}
+
+// Result returns the result read by the last Next
+func (it *SinkIterator) Result() SinkResult {
+	return it.result
+}
+
+// Err returns the error that stopped the iteration, nil at the end of the log
+func (it *SinkIterator) Err() error {
+	return it.err
+}
+
+func (it *SinkIterator) Close() error {
+	it.closeFile()
+	it.paths = nil
+	return nil
+}
+
+// sinkRecord is the JSON payload of a record, the inputs and the outputs are encoded with the codec of the sink
+type sinkRecord struct {
+	Uid string              `json:"uid"`
+	In  []sinkTickInRecord  `json:"in,omitempty"`
+	Out []sinkTickOutRecord `json:"out,omitempty"`
+}
+
+type sinkTickInRecord struct {
+	Pid       string `json:"pid"`
+	Input     []byte `json:"input"`
+	Timestamp int64  `json:"ts"`
+}
+
+type sinkTickOutRecord struct {
+	Pid       string `json:"pid"`
+	Output    []byte `json:"output"`
+	Err       string `json:"err,omitempty"`
+	Timestamp int64  `json:"ts"`
+}
+
+func newSinkRecord(result SinkResult, codec Codec) (sinkRecord, error) {
+	record := sinkRecord{Uid: result.uid}
+	for _, tick := range result.in {
+		input, err := codec.Marshal(tick.input)
+		if err != nil {
+			return sinkRecord{}, fmt.Errorf("input of %s: %w", tick.pid, err)
+		}
+		record.In = append(record.In, sinkTickInRecord{
+			Pid:       tick.pid,
+			Input:     input,
+			Timestamp: tick.timestamp,
+		})
+	}
+	for _, tick := range result.out {
+		output, err := codec.Marshal(tick.output)
+		if err != nil {
+			return sinkRecord{}, fmt.Errorf("output of %s: %w", tick.pid, err)
+		}
+		out := sinkTickOutRecord{
+			Pid:       tick.pid,
+			Output:    output,
+			Timestamp: tick.timestamp,
+		}
+		if tick.err != nil {
+			out.Err = tick.err.Error()
+		}
+		record.Out = append(record.Out, out)
+	}
+	return record, nil
+}
+
+func (r sinkRecord) result(codec Codec) (SinkResult, error) {
+	result := SinkResult{uid: r.Uid}
+	for _, tick := range r.In {
+		input, err := codec.Unmarshal(tick.Input)
+		if err != nil {
+			return SinkResult{}, fmt.Errorf("input of %s: %w", tick.Pid, err)
+		}
+		result.in = append(result.in, TickInMsg{
+			uid:       r.Uid,
+			pid:       tick.Pid,
+			input:     input,
+			timestamp: tick.Timestamp,
+		})
+	}
+	for _, tick := range r.Out {
+		output, err := codec.Unmarshal(tick.Output)
+		if err != nil {
+			return SinkResult{}, fmt.Errorf("output of %s: %w", tick.Pid, err)
+		}
+		out := TickOutMsg{
+			uid:       r.Uid,
+			pid:       tick.Pid,
+			output:    output,
+			timestamp: tick.Timestamp,
+		}
+		if tick.Err != "" {
+			out.err = errors.New(tick.Err)
+		}
+		result.out = append(result.out, out)
+	}
+	if len(result.in) > 0 {
+		result.created = time.Unix(0, result.in[0].timestamp)
+	} else if len(result.out) > 0 {
+		result.created = time.Unix(0, result.out[0].timestamp)
+	}
+	return result, nil
+}
+
+// writeRecord writes the result as a record, and returns its size
+// a msg the codec can not encode is an error, it is not stored in a lossy form
+func writeRecord(w io.Writer, result SinkResult, codec Codec) (int, error) {
+	record, err := newSinkRecord(result, codec)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	return writePayload(w, payload)
+}
+
+// writePayload writes the payload as a record, and returns its size
+func writePayload(w io.Writer, payload []byte) (int, error) {
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return 0, err
+	}
+	return recordHeaderSize + len(payload), nil
+}
+
+var (
+	// errTornRecord is a record cut short by the end of the file, e.g. by a crash while it was written
+	errTornRecord = errors.New("torn record")
+	// errCorruptRecord is a record whose checksum does not match, or whose length is above maxRecordSize
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+// corruptRecordError is an errCorruptRecord, with the length its header claims
+type corruptRecordError struct {
+	length int64
+	reason string
+}
+
+func (e *corruptRecordError) Error() string {
+	return fmt.Sprintf("%s: %s", errCorruptRecord, e.reason)
+}
+
+func (e *corruptRecordError) Is(target error) bool {
+	return target == errCorruptRecord
+}
+
+// readPayload reads the payload of one record, it returns io.EOF at a clean end
+func readPayload(r *bufio.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errTornRecord
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > maxRecordSize {
+		return nil, &corruptRecordError{length: int64(length), reason: fmt.Sprintf("length %d is above %d", length, maxRecordSize)}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errTornRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, &corruptRecordError{length: int64(length), reason: "checksum mismatch"}
+	}
+	return payload, nil
+}
+
+// tornTail reports whether the record that failed with err at offset is the torn tail of a file of size bytes
+// a record cut short, or a corrupt one that runs to the end of the file, is what a crash in the middle of a write leaves
+// a corrupt record followed by other records is not, truncating it would drop them
+func tornTail(err error, offset, size int64) bool {
+	if errors.Is(err, errTornRecord) {
+		return true
+	}
+	var corrupt *corruptRecordError
+	return errors.As(err, &corrupt) && offset+recordHeaderSize+corrupt.length >= size
+}
+
+// readRecord reads one record, it returns io.EOF at a clean end
+func readRecord(r *bufio.Reader, codec Codec) (SinkResult, error) {
+	payload, err := readPayload(r)
+	if err != nil {
+		return SinkResult{}, err
+	}
+	var record sinkRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return SinkResult{}, fmt.Errorf("decode record: %w", err)
+	}
+	result, err := record.result(codec)
+	if err != nil {
+		return SinkResult{}, fmt.Errorf("decode record %s: %w", record.Uid, err)
+	}
+	return result, nil
+}
+
+// readSegment calls fn with every record of the segment
+func readSegment(path string, codec Codec, fn func(result SinkResult) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		result, err := readRecord(r, codec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+}
+
+// validLength returns the length of the complete records at the start of the file, without its torn tail
+// a corrupt record in the middle of the file is an error
+func validLength(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(file)
+	var size int64
+	for {
+		payload, err := readPayload(r)
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			if tornTail(err, size, info.Size()) {
+				return size, nil
+			}
+			return 0, fmt.Errorf("%s: %w at offset %d", filepath.Base(path), err, size)
+		}
+		size += int64(recordHeaderSize + len(payload))
+	}
+}
+
+// listSegments returns the ids of the segment files in dir, in order
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, id)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
@@ -0,0 +1,201 @@
+package internel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestResult(uid string, output any) SinkResult {
+	result := NewSinkResult(uid)
+	result.AddInMsg(NewTickInMsg(uid, "pid:a", "in"))
+	result.AddOutMsg(NewTickOutMsg(uid, "pid:a", output, nil))
+	return *result
+}
+
+// readAll reads every result of the sink, uid -> output of its first out tick
+func readAll(t *testing.T, sink *FileSink) ([]string, map[string]any) {
+	it, err := sink.Iterator()
+	assert.Nil(t, err)
+	defer it.Close()
+
+	var uids []string
+	outputs := make(map[string]any)
+	for it.Next() {
+		result := it.Result()
+		uids = append(uids, result.Uid())
+		outputs[result.Uid()] = result.Out()[0].Output()
+	}
+	assert.Nil(t, it.Err())
+	return uids, outputs
+}
+
+func TestFileSink_AppendAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := OpenFileSink(dir, WithSegmentSize(256))
+	assert.Nil(t, err)
+
+	failed := NewSinkResult("err")
+	failed.AddOutMsg(NewTickOutMsg("err", "pid:a", nil, fmt.Errorf("boom")))
+	assert.Nil(t, sink.Append(*failed))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, sink.Append(newTestResult(fmt.Sprint(i), map[string]any{"n": i})))
+	}
+	assert.True(t, sink.Segments() > 1)
+
+	uids, outputs := readAll(t, sink)
+	assert.Equal(t, []string{"err", "0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, uids)
+	assert.Equal(t, map[string]any{"n": float64(3)}, outputs["3"])
+	assert.Nil(t, sink.Close())
+
+	// a crash while a record is written leaves a torn record at the end
+	segments, err := listSegments(dir)
+	assert.Nil(t, err)
+	last, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", segments[len(segments)-1], segmentExt)), os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.Nil(t, err)
+	_, err = last.Write([]byte{0, 0, 1, 0, 42})
+	assert.Nil(t, err)
+	assert.Nil(t, last.Close())
+
+	sink, err = OpenFileSink(dir, WithSegmentSize(256))
+	assert.Nil(t, err)
+	defer sink.Close()
+	assert.Nil(t, sink.Append(newTestResult("10", "last")))
+
+	it, err := sink.Iterator()
+	assert.Nil(t, err)
+	defer it.Close()
+	var first SinkResult
+	count := 0
+	for it.Next() {
+		if count == 0 {
+			first = it.Result()
+		}
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 12, count)
+	assert.Equal(t, "boom", first.Out()[0].Err().Error())
+}
+
+func TestFileSink_Corruption(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := OpenFileSink(dir)
+	assert.Nil(t, err)
+	var ends []int64
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, sink.Append(newTestResult(fmt.Sprint(i), i)))
+		ends = append(ends, sink.size)
+	}
+	// a value that is not JSON serializable is refused, not stored in a lossy form
+	assert.NotNil(t, sink.Append(newTestResult("chan", make(chan int))))
+	assert.Nil(t, sink.Close())
+
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", 0, segmentExt))
+	flip := func(offset int64) {
+		file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		assert.Nil(t, err)
+		defer file.Close()
+		b := make([]byte, 1)
+		_, err = file.ReadAt(b, offset)
+		assert.Nil(t, err)
+		b[0] ^= 0xff
+		_, err = file.WriteAt(b, offset)
+		assert.Nil(t, err)
+	}
+
+	// a bit flip in the last record is a torn tail, it is truncated
+	flip(ends[2] - 1)
+	sink, err = OpenFileSink(dir)
+	assert.Nil(t, err)
+	uids, _ := readAll(t, sink)
+	assert.Equal(t, []string{"0", "1"}, uids)
+	assert.Nil(t, sink.Close())
+
+	// a bit flip in the middle fails the open, the records after it are kept
+	flip(ends[0] - 1)
+	_, err = OpenFileSink(dir)
+	assert.ErrorIs(t, err, errCorruptRecord)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, ends[1], info.Size())
+}
+
+func TestReadPayload_MaxRecordSize(t *testing.T) {
+	// a header claiming 4 GiB is refused before anything is allocated
+	header := []byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0}
+	_, err := readPayload(bufio.NewReader(bytes.NewReader(append(header, 1, 2, 3))))
+	assert.ErrorIs(t, err, errCorruptRecord)
+	assert.True(t, tornTail(err, 0, int64(len(header)+3)))
+}
+
+func TestFileSink_Compact(t *testing.T) {
+	sink, err := OpenFileSink(t.TempDir(), WithSegmentSize(1))
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	// every record is a segment
+	for _, r := range []SinkResult{
+		newTestResult("a", 1),
+		newTestResult("b", 1),
+		newTestResult("a", 2),
+		newTestResult("c", 1),
+	} {
+		assert.Nil(t, sink.Append(r))
+	}
+	assert.Equal(t, 5, sink.Segments())
+
+	assert.Nil(t, sink.Compact(func(result SinkResult) bool {
+		return result.Uid() != "b"
+	}))
+	uids, outputs := readAll(t, sink)
+	assert.Equal(t, []string{"a", "c"}, uids)
+	assert.Equal(t, float64(2), outputs["a"])
+	assert.Equal(t, 3, sink.Segments())
+
+	// the sink keeps appending after the compaction
+	assert.Nil(t, sink.Append(newTestResult("d", 1)))
+	uids, _ = readAll(t, sink)
+	assert.Equal(t, []string{"a", "c", "d"}, uids)
+}
+
+func TestSinkPool_Backend(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := OpenFileSink(dir)
+	assert.Nil(t, err)
+
+	engine := NewEngine()
+	engine.SetSinkPool(NewSinkPool(WithBackend(sink)))
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	leaf, err := engine.Spawn(newEcho("leaf"))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, leaf))
+	assert.Nil(t, engine.Ready())
+
+	for i := 0; i < 5; i++ {
+		_, err := engine.SendAndWait(context.Background(), i)
+		assert.Nil(t, err)
+	}
+	// the pool is closed, and the results are persisted once the engine is shut down
+	assert.Nil(t, engine.Shutdown(context.Background()))
+	assert.Nil(t, engine.SinkPool().BackendErr())
+
+	sink, err = OpenFileSink(dir)
+	assert.Nil(t, err)
+	defer sink.Close()
+	uids, _ := readAll(t, sink)
+	assert.Equal(t, 5, len(uids))
+
+	it, err := sink.Iterator()
+	assert.Nil(t, err)
+	defer it.Close()
+	assert.True(t, it.Next())
+	assert.Equal(t, 2, len(it.Result().In()))
+	assert.Equal(t, 2, len(it.Result().Out()))
+}
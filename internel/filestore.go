@@ -0,0 +1,372 @@
+package internel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	defaultSnapshotEvery = 10000
+	walFile              = "wal.log"
+	snapshotFile         = "snapshot.json"
+)
+
+// FileStoreOption configures a FileStore
+type FileStoreOption func(f *FileStore)
+
+// WithSnapshotEvery snapshots the store and truncates the write-ahead log after every n writes, 0 snapshots only on Close
+func WithSnapshotEvery(n int) FileStoreOption {
+	return func(f *FileStore) {
+		f.snapshotEvery = n
+	}
+}
+
+// WithWALSync fsyncs the write-ahead log after every write, a crash of the host loses no write
+func WithWALSync() FileStoreOption {
+	return func(f *FileStore) {
+		f.sync = true
+	}
+}
+
+// WithStoreCodec encodes the values with codec
+// by default it is a JSONCodec of the engine's type registry, set at Ready, or plain JSON without a registry
+func WithStoreCodec(codec Codec) FileStoreOption {
+	return func(f *FileStore) {
+		f.codec = codec
+	}
+}
+
+// FileStore is a Storer that keeps the state in memory, and persists it to a directory
+// every write is appended to a write-ahead log, the log is folded into a snapshot periodically and on Close
+// a torn record at the end of the log, e.g. after a crash, is truncated when the store is opened
+//
+// the values are kept encoded with the codec, Get returns their decoding, the same value before and after a restart
+// with plain JSON, e.g. numbers are float64 and structs are map[string]any
+type FileStore struct {
+	dir           string
+	snapshotEvery int
+	sync          bool
+
+	mu     sync.Mutex
+	codec  Codec
+	data   map[string][]byte // the encoded values
+	wal    *os.File
+	writer *bufio.Writer
+	writes int // since the last snapshot
+	err    error
+	closed bool
+}
+
+// walRecord is one Write of the store in the write-ahead log
+type walRecord struct {
+	Ops []walOp `json:"ops"`
+}
+
+type walOp struct {
+	Key    string `json:"k"`
+	Value  []byte `json:"v,omitempty"`
+	Delete bool   `json:"d,omitempty"`
+}
+
+// OpenFileStore opens the store in dir, it is created if it does not exist
+// the state is restored from the snapshot and the write-ahead log before it returns
+func OpenFileStore(dir string, opts ...FileStoreOption) (*FileStore, error) {
+	f := &FileStore{
+		dir:           dir,
+		snapshotEvery: defaultSnapshotEvery,
+		data:          make(map[string][]byte),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.wal = wal
+	f.writer = bufio.NewWriter(wal)
+	return f, nil
+}
+
+// Put writes a batch of one put, an error is kept and returned by Err
+func (f *FileStore) Put(key string, value any) {
+	batch := &Batch{}
+	batch.Put(key, value)
+	f.Write(batch)
+}
+
+// Get decodes the value of key, a value that fails to decode is missing, the error is kept and returned by Err
+func (f *FileStore) Get(key string) (any, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.data[key]
+	if !ok {
+		return nil, false
+	}
+	value, err := f.decode(key, data)
+	if err != nil {
+		f.keepErr(err)
+		return nil, false
+	}
+	return value, true
+}
+
+// Delete writes a batch of one delete, an error is kept and returned by Err
+func (f *FileStore) Delete(key string) {
+	batch := &Batch{}
+	batch.Delete(key)
+	f.Write(batch)
+}
+
+// Range calls fn with a copy of the state, fn may write to the store
+func (f *FileStore) Range(fn func(key string, value any) bool) {
+	f.mu.Lock()
+	items := make(map[string]any, len(f.data))
+	for key, data := range f.data {
+		value, err := f.decode(key, data)
+		if err != nil {
+			f.keepErr(err)
+			continue
+		}
+		items[key] = value
+	}
+	f.mu.Unlock()
+	rangeItems(items, fn)
+}
+
+// Write appends the batch to the write-ahead log as one record, then applies it
+// a value that can not be encoded refuses the whole batch, nothing of it is applied
+// the first error is kept, and returned by Err, the state in memory is still updated if only the log fails
+func (f *FileStore) Write(batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errors.New("store is closed")
+	}
+
+	codec := codecOrPlainJSON(f.codec)
+	record := walRecord{Ops: make([]walOp, 0, batch.Len())}
+	for _, op := range batch.ops {
+		if op.delete {
+			record.Ops = append(record.Ops, walOp{Key: op.key, Delete: true})
+			continue
+		}
+		value, err := codec.Marshal(op.value)
+		if err != nil {
+			err = fmt.Errorf("put %s: %w", op.key, err)
+			f.keepErr(err)
+			return err
+		}
+		record.Ops = append(record.Ops, walOp{Key: op.key, Value: value})
+	}
+	f.apply(record)
+	err := f.append(record)
+
+	f.writes++
+	if f.snapshotEvery > 0 && f.writes >= f.snapshotEvery {
+		if snapErr := f.snapshot(); err == nil {
+			err = snapErr
+		}
+	}
+	f.keepErr(err)
+	return err
+}
+
+// Snapshot folds the write-ahead log into the snapshot
+func (f *FileStore) Snapshot() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errors.New("store is closed")
+	}
+	return f.snapshot()
+}
+
+// Err returns the first error of a write or a snapshot
+func (f *FileStore) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Close snapshots the state and closes the write-ahead log
+func (f *FileStore) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.keepErr(f.snapshot())
+	f.keepErr(f.wal.Close())
+	f.closed = true
+}
+
+// append writes the record to the write-ahead log, must be called with mu held
+func (f *FileStore) append(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := writePayload(f.writer, payload); err != nil {
+		return err
+	}
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	if f.sync {
+		return f.wal.Sync()
+	}
+	return nil
+}
+
+// apply applies the record to the state
+func (f *FileStore) apply(record walRecord) {
+	for _, op := range record.Ops {
+		if op.Delete {
+			delete(f.data, op.Key)
+		} else {
+			f.data[op.Key] = op.Value
+		}
+	}
+}
+
+// decode decodes the value of key with the codec, must be called with mu held
+func (f *FileStore) decode(key string, data []byte) (any, error) {
+	value, err := codecOrPlainJSON(f.codec).Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	return value, nil
+}
+
+func (f *FileStore) setDefaultCodec(codec Codec) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.codec == nil {
+		f.codec = codec
+	}
+}
+
+// snapshot writes the state to a new snapshot file and truncates the write-ahead log, must be called with mu held
+// a crash in between replays the log over the new snapshot, which leads to the same state
+func (f *FileStore) snapshot() error {
+	payload, err := json.Marshal(f.data)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(f.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, payload); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(f.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	if err := f.wal.Truncate(0); err != nil {
+		return err
+	}
+	f.writes = 0
+	return nil
+}
+
+// loadSnapshot restores the state of the snapshot, if any
+func (f *FileStore) loadSnapshot() error {
+	payload, err := os.ReadFile(filepath.Join(f.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(payload, &f.data)
+}
+
+// replay applies the records of the write-ahead log, and truncates a torn record at its end
+func (f *FileStore) replay() error {
+	path := filepath.Join(f.dir, walFile)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(file)
+	var size int64
+	for {
+		payload, err := readPayload(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if tornTail(err, size, info.Size()) {
+				return os.Truncate(path, size)
+			}
+			return fmt.Errorf("%s: %w at offset %d", walFile, err, size)
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return err
+		}
+		f.apply(record)
+		size += int64(recordHeaderSize + len(payload))
+	}
+}
+
+// keepErr keeps the first error, must be called with mu held
+func (f *FileStore) keepErr(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// writeFileSync writes the file and fsyncs it before it is renamed into place
+func writeFileSync(path string, payload []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(payload); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
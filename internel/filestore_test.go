@@ -0,0 +1,167 @@
+package internel
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Aggregator counts the messages in its store, and reads the count in PreStart
+type Aggregator struct {
+	ctx     *Context
+	started chan any
+}
+
+func (a *Aggregator) Receive(ctx *Context, msg any) (any, error) {
+	count, _ := ctx.Store().Get("count")
+	n, _ := count.(float64)
+	ctx.Store().Put("count", n+1)
+	return n + 1, nil
+}
+
+func (a *Aggregator) PreStart() {
+	count, _ := a.ctx.Store().Get("count")
+	a.started <- count
+}
+
+func (a *Aggregator) String() string {
+	return "aggregator"
+}
+
+// storeItems returns every item of the store
+func storeItems(store Storer) map[string]any {
+	items := make(map[string]any)
+	store.Range(func(key string, value any) bool {
+		items[key] = value
+		return true
+	})
+	return items
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	batch := &Batch{}
+	batch.Put("a", 1)
+	batch.Put("b", 2)
+	batch.Put("c", 3)
+	batch.Delete("b")
+	assert.Nil(t, store.Write(batch))
+	store.Delete("c")
+
+	var keys []string
+	store.Put("d", 4)
+	store.Range(func(key string, value any) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	assert.Equal(t, []string{"a", "d"}, keys)
+	assert.Equal(t, map[string]any{"a": 1, "d": 4}, storeItems(store))
+}
+
+func TestFileStore_Restore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	assert.Nil(t, err)
+
+	store.Put("count", 1)
+	store.Put("name", "orders")
+	store.Put("tmp", true)
+	batch := &Batch{}
+	batch.Put("count", 2)
+	batch.Delete("tmp")
+	assert.Nil(t, store.Write(batch))
+	assert.Equal(t, map[string]any{"count": float64(2), "name": "orders"}, storeItems(store))
+
+	// a crash: the state is in the log only, and the last record is torn
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte{0, 0, 0, 9, 1})
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	restored, err := OpenFileStore(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"count": float64(2), "name": "orders"}, storeItems(restored))
+	restored.Put("count", 3)
+	restored.Close()
+	assert.Nil(t, restored.Err())
+
+	// Close folds the log into the snapshot
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	restored, err = OpenFileStore(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+	value, ok := restored.Get("count")
+	assert.True(t, ok)
+	assert.Equal(t, float64(3), value)
+}
+
+func TestFileStore_WriteUnencodable(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	assert.Nil(t, err)
+
+	store.Put("count", 1)
+	batch := &Batch{}
+	batch.Put("count", 2)
+	batch.Put("events", make(chan int))
+	// the batch is refused as a whole, the value is not stored in a lossy form
+	assert.NotNil(t, store.Write(batch))
+	assert.NotNil(t, store.Err())
+	assert.Equal(t, map[string]any{"count": float64(1)}, storeItems(store))
+	store.Close()
+
+	restored, err := OpenFileStore(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+	assert.Equal(t, map[string]any{"count": float64(1)}, storeItems(restored))
+}
+
+func TestFileStore_SnapshotEvery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir, WithSnapshotEvery(2), WithWALSync())
+	assert.Nil(t, err)
+
+	for _, key := range []string{"a", "b", "c"} {
+		store.Put(key, key)
+	}
+	// a and b are in the snapshot, c in the log
+	_, err = os.Stat(filepath.Join(dir, snapshotFile))
+	assert.Nil(t, err)
+
+	restored, err := OpenFileStore(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+	assert.Equal(t, map[string]any{"a": "a", "b": "b", "c": "c"}, storeItems(restored))
+	store.Close()
+}
+
+func TestEngine_FileStore(t *testing.T) {
+	dir := t.TempDir()
+	for _, want := range []any{nil, float64(3)} {
+		store, err := OpenFileStore(dir)
+		assert.Nil(t, err)
+		aggregator := &Aggregator{started: make(chan any, 1)}
+		engine := NewEngine()
+		pid, err := engine.Spawn(aggregator, WithStore(store))
+		assert.Nil(t, err)
+		aggregator.ctx = pid.context
+		assert.Nil(t, engine.Ready())
+
+		// the state is restored before PreStart
+		assert.Equal(t, want, <-aggregator.started)
+		for i := 0; i < 3; i++ {
+			_, err := engine.SendAndWait(context.Background(), i)
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, engine.Shutdown(context.Background()))
+		assert.Nil(t, store.Err())
+	}
+}
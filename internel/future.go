@@ -0,0 +1,195 @@
+package internel
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Future is the pending result of a message sent with Engine.Ask
+// it resolves once the message has gone through every path of the DAG it was routed to,
+// with the outputs of the leaf actors it reached, or the first error on the way
+type Future struct {
+	uid string
+
+	mu      sync.Mutex
+	outputs map[string]any // leaf actor name -> output
+	err     error
+
+	done chan struct{}
+}
+
+func newFuture(uid string) *Future {
+	return &Future{
+		uid:  uid,
+		done: make(chan struct{}),
+	}
+}
+
+// Uid returns the uid of the message the future is waiting for
+func (f *Future) Uid() string {
+	return f.uid
+}
+
+// Done returns a channel that is closed when the future is resolved
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result blocks until the future is resolved, and returns the leaf outputs keyed by actor name
+func (f *Future) Result() (map[string]any, error) {
+	<-f.done
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.outputs, f.err
+}
+
+// resolve resolves the future, only the first call takes effect
+func (f *Future) resolve(outputs map[string]any, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	f.outputs, f.err = outputs, err
+	close(f.done)
+}
+
+// flight is a message uid on its way through the DAG
+type flight struct {
+	// inflight is the number of deliveries of the uid not handled yet
+	inflight int
+	// ticks is the number of times an actor has handled the uid
+	ticks   int
+	outputs map[string]any
+	err     error
+}
+
+// futureRegistry tracks the in-flight deliveries of every message uid, and the futures waiting on them
+type futureRegistry struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+	futures map[string]*Future
+
+	// onComplete is called when a uid has gone through the DAG, with the number of times an actor has handled it
+	onComplete func(uid string, ticks int)
+}
+
+func newFutureRegistry() *futureRegistry {
+	return &futureRegistry{
+		flights: make(map[string]*flight),
+		futures: make(map[string]*Future),
+	}
+}
+
+func (r *futureRegistry) register(f *Future) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.futures[f.uid] = f
+}
+
+func (r *futureRegistry) remove(uid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.futures, uid)
+}
+
+// begin starts the flight of a uid taken from a root actor's mailbox
+func (r *futureRegistry) begin(uid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.flights[uid]
+	if !ok {
+		f = &flight{outputs: make(map[string]any)}
+		r.flights[uid] = f
+	}
+	f.inflight++
+}
+
+// handled records that an actor has handled one delivery of the uid, and forwarded it to deliveries children
+// output is collected if the actor is a leaf actor, the first error is kept
+// an empty actorName means the delivery is settled without calling an actor
+func (r *futureRegistry) handled(uid string, actorName string, leaf bool, output any, err error, deliveries int) {
+	r.mu.Lock()
+	f, ok := r.flights[uid]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	if actorName != "" {
+		f.ticks++
+	}
+
+	if err != nil {
+		if f.err == nil {
+			f.err = fmt.Errorf("[%s] %w", actorName, err)
+		}
+	} else if leaf {
+		f.outputs[actorName] = output
+	}
+
+	f.inflight += deliveries - 1
+	if f.inflight > 0 {
+		r.mu.Unlock()
+		return
+	}
+
+	delete(r.flights, uid)
+	future, ok := r.futures[uid]
+	delete(r.futures, uid)
+	r.mu.Unlock()
+
+	if ok {
+		future.resolve(f.outputs, f.err)
+	}
+	if r.onComplete != nil {
+		r.onComplete(uid, f.ticks)
+	}
+}
+
+// dropped records that one delivery of the uid is dropped before it is handled
+func (r *futureRegistry) dropped(uid string) {
+	r.handled(uid, "", false, nil, nil, 0)
+}
+
+// absorbed records that a join actor has buffered one delivery of the uid, waiting for its other parents
+func (r *futureRegistry) absorbed(uid string) {
+	r.handled(uid, "", false, nil, nil, 0)
+}
+
+// reject resolves the future of a uid that never entered the DAG with err
+func (r *futureRegistry) reject(uid string, err error) {
+	r.mu.Lock()
+	future, ok := r.futures[uid]
+	delete(r.futures, uid)
+	r.mu.Unlock()
+
+	if ok {
+		future.resolve(nil, err)
+	}
+}
+
+// retried records that an actor has failed the uid and will receive it again, the delivery stays in flight
+func (r *futureRegistry) retried(uid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.flights[uid]; ok {
+		f.ticks++
+	}
+}
+
+// failAll resolves every pending future with the given error
+func (r *futureRegistry) failAll(err error) {
+	r.mu.Lock()
+	futures := r.futures
+	r.futures = make(map[string]*Future)
+	r.flights = make(map[string]*flight)
+	r.mu.Unlock()
+
+	for _, f := range futures {
+		f.resolve(nil, err)
+	}
+}
@@ -0,0 +1,329 @@
+package internel
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// JoinActor is the actor that waits for the outputs of all its parents for the same message uid
+// the engine buffers the parents' outputs, and calls Receive once per uid with a map[string]any of parent name -> output
+type JoinActor interface {
+	Actor
+
+	// JoinPolicy returns how long the actor waits for its parents, and what to do when some are missing
+	JoinPolicy() JoinPolicy
+}
+
+// MissingPolicy is what a JoinActor does when some parents have not reported within the timeout
+type MissingPolicy int
+
+const (
+	// JoinDrop drops the message, it is reported as failed
+	JoinDrop MissingPolicy = iota
+	// JoinPartial calls Receive with the outputs received so far
+	JoinPartial
+)
+
+// JoinPolicy configures a JoinActor
+type JoinPolicy struct {
+	// Timeout is how long to wait for all parents since the first output arrives, 0 means wait forever
+	// a parent that fails or routes the uid away is not waited for, an output dropped by an EdgeDrop edge is
+	Timeout time.Duration
+
+	// OnMissing is the policy when the timeout hits, or when a parent has no output for the uid
+	OnMissing MissingPolicy
+}
+
+// joinHistory is the number of joined or timed out uids a joiner remembers, to tell a late parent's output from a new uid
+const joinHistory = 4096
+
+// joinTimeout is queued in the actor's inbox when a pending join times out
+type joinTimeout struct {
+	uid string
+}
+
+// joinSkip is queued in the inbox of an actor on the way to a JoinActor when a parent has no output for the uid,
+// e.g. it failed or routed the output away, so the join does not wait for it
+type joinSkip struct {
+	uid    string
+	parent string
+	err    error
+}
+
+// pendingJoin is the parents' messages received so far for one uid, and the parents that skipped it
+type pendingJoin struct {
+	inputs  map[string]Message
+	skipped map[string]error
+	timer   *time.Timer
+	// held is true once an output's delivery is kept in flight until the join resolves
+	held bool
+}
+
+// message returns the joined message of the parents' outputs, parents are in name order
+// the trace continues from the first parent and links the others, the first parent wins a header
+func (pj *pendingJoin) message(uid string, parents []string) Message {
+	outputs := make(map[string]any, len(pj.inputs))
+	msg := WrapMsg(uid, outputs)
+	for _, parent := range parents {
+		input, ok := pj.inputs[parent]
+		if !ok {
+			continue
+		}
+		outputs[parent] = input.data
+
+		if msg.from == "" {
+			msg.from = parent
+			msg.created = input.created
+			msg.ctx = input.ctx
+		}
+		if input.hops > msg.hops {
+			msg.hops = input.hops
+		}
+		if !input.deadline.IsZero() && (msg.deadline.IsZero() || input.deadline.Before(msg.deadline)) {
+			msg.deadline = input.deadline
+		}
+		for k, v := range input.headers {
+			if _, ok := msg.headers[k]; ok {
+				continue
+			}
+			if msg.headers == nil {
+				msg.headers = make(map[string]string, len(input.headers))
+			}
+			msg.headers[k] = v
+		}
+
+		if !input.trace.IsValid() {
+			continue
+		}
+		if !msg.trace.IsValid() {
+			msg.trace = input.trace
+		} else {
+			msg.links = append(msg.links, input.trace)
+		}
+	}
+	return msg
+}
+
+// joiner buffers the parents' outputs of a JoinActor by message uid
+type joiner struct {
+	policy  JoinPolicy
+	parents []string
+	pending map[string]*pendingJoin
+
+	// resolved are the last joinHistory uids joined or timed out, history holds them in a ring, next is the oldest
+	resolved map[string]struct{}
+	history  []string
+	next     int
+}
+
+func newJoiner(policy JoinPolicy, parents []*Pid) *joiner {
+	names := make([]string, 0, len(parents))
+	for _, parent := range parents {
+		names = append(names, parent.actorName)
+	}
+	sort.Strings(names)
+	return &joiner{
+		policy:   policy,
+		parents:  names,
+		pending:  make(map[string]*pendingJoin),
+		resolved: make(map[string]struct{}),
+	}
+}
+
+// missing returns the parents whose output has not arrived
+func (j *joiner) missing(pj *pendingJoin) []string {
+	var missing []string
+	for _, parent := range j.parents {
+		if _, ok := pj.inputs[parent]; !ok {
+			missing = append(missing, parent)
+		}
+	}
+	return missing
+}
+
+// waiting returns the parents that have neither reported an output nor skipped yet
+func (j *joiner) waiting(pj *pendingJoin) []string {
+	var waiting []string
+	for _, parent := range j.missing(pj) {
+		if _, ok := pj.skipped[parent]; !ok {
+			waiting = append(waiting, parent)
+		}
+	}
+	return waiting
+}
+
+// remove forgets the pending join of the uid
+func (j *joiner) remove(uid string) (*pendingJoin, bool) {
+	pj, ok := j.pending[uid]
+	if !ok {
+		return nil, false
+	}
+	if pj.timer != nil {
+		pj.timer.Stop()
+	}
+	delete(j.pending, uid)
+	return pj, true
+}
+
+// resolve forgets the pending join of the uid, and remembers the uid is resolved, the oldest resolved uid is forgotten
+func (j *joiner) resolve(uid string) (*pendingJoin, bool) {
+	pj, ok := j.remove(uid)
+	if !ok {
+		return nil, false
+	}
+	if len(j.history) < joinHistory {
+		j.history = append(j.history, uid)
+	} else {
+		delete(j.resolved, j.history[j.next])
+		j.history[j.next] = uid
+		j.next = (j.next + 1) % joinHistory
+	}
+	j.resolved[uid] = struct{}{}
+	return pj, true
+}
+
+// stop stops the timers of all pending joins
+func (j *joiner) stop() {
+	for uid := range j.pending {
+		j.remove(uid)
+	}
+}
+
+// join buffers the parent's output, returns the joined message once all parents have reported
+// the delivery of the first output of a uid stays in flight until the join resolves, so Ask and the SinkPool see its outcome
+// an output of a uid already joined or timed out is a dead letter
+func (p *Pid) join(input Message) (Message, bool) {
+	j := p.joiner
+	if _, ok := j.resolved[input.uid]; ok {
+		err := fmt.Errorf("join already resolved, late output of %s", input.from)
+		p.logger.Warnw("drop late join output", "pid", p.String(), "uid", input.uid, "err", err)
+		p.context.deadLetters.add(p.actorName, input, DeadLetterJoinLate, err)
+		p.context.futures.dropped(input.uid)
+		return Message{}, false
+	}
+
+	pj := p.pendingJoin(input.uid)
+	if pj.held {
+		// wait for the other parents
+		p.context.futures.absorbed(input.uid)
+	}
+	pj.held = true
+	pj.inputs[input.from] = input
+	return p.settleJoin(input.uid, pj)
+}
+
+// pendingJoin returns the pending join of the uid, the timer starts with the first arrival
+func (p *Pid) pendingJoin(uid string) *pendingJoin {
+	j := p.joiner
+	pj, ok := j.pending[uid]
+	if ok {
+		return pj
+	}
+	pj = &pendingJoin{
+		inputs:  make(map[string]Message, len(j.parents)),
+		skipped: make(map[string]error),
+	}
+	if j.policy.Timeout > 0 {
+		pj.timer = time.AfterFunc(j.policy.Timeout, func() {
+			// waits for room, the timeout must not be lost to a full inbox
+			p.context.inbox.EnqueueWait(joinTimeout{uid: uid}, p.context.stopCh)
+		})
+	}
+	j.pending[uid] = pj
+	return pj
+}
+
+// settleJoin returns the joined message once every parent has reported, and applies the missing policy if some skipped
+func (p *Pid) settleJoin(uid string, pj *pendingJoin) (Message, bool) {
+	j := p.joiner
+	if len(j.waiting(pj)) > 0 {
+		return Message{}, false
+	}
+	j.resolve(uid)
+	if len(pj.skipped) == 0 {
+		return pj.message(uid, j.parents), true
+	}
+
+	skipped := make([]string, 0, len(pj.skipped))
+	for _, parent := range j.parents {
+		if _, ok := pj.skipped[parent]; ok {
+			skipped = append(skipped, parent)
+		}
+	}
+	p.missJoin(uid, pj, fmt.Errorf("join skipped by parents %v", skipped))
+	return Message{}, false
+}
+
+// skipped handles the notice of a parent that has no output for the uid
+// an actor that is not a JoinActor passes it on to its children, unless another parent may still send the uid
+func (p *Pid) skipped(s joinSkip) {
+	if p.joiner == nil {
+		if len(p.context.parentActors()) <= 1 {
+			p.skipJoins(s.uid, nil, s.err)
+		}
+		return
+	}
+
+	if _, ok := p.joiner.resolved[s.uid]; ok {
+		return
+	}
+	pj := p.pendingJoin(s.uid)
+	if _, ok := pj.inputs[s.parent]; ok {
+		return
+	}
+	pj.skipped[s.parent] = s.err
+	if joined, ok := p.settleJoin(s.uid, pj); ok {
+		p.process(joined)
+	}
+}
+
+// skipJoins tells the children on the way to a JoinActor, but the delivered ones, that the actor has no output for the uid
+func (p *Pid) skipJoins(uid string, delivered []*Pid, err error) {
+next:
+	for _, child := range p.context.childActors() {
+		if !child.feedsJoin {
+			continue
+		}
+		for _, d := range delivered {
+			if d == child {
+				continue next
+			}
+		}
+		child.context.inbox.EnqueueWait(joinSkip{uid: uid, parent: p.actorName, err: err}, p.context.stopCh, child.context.stopCh)
+	}
+}
+
+// expireJoin applies the missing policy to a pending join that timed out
+func (p *Pid) expireJoin(uid string) {
+	pj, ok := p.joiner.resolve(uid)
+	if !ok {
+		// joined right before the timeout
+		return
+	}
+
+	p.missJoin(uid, pj, fmt.Errorf("join timeout, missing parents %v", p.joiner.waiting(pj)))
+}
+
+// missJoin applies the missing policy to a resolved join that lacks some outputs
+// a join without any output has nothing in flight, the children on the way to a JoinActor are told to skip the uid
+func (p *Pid) missJoin(uid string, pj *pendingJoin, err error) {
+	if len(pj.inputs) == 0 {
+		p.skipJoins(uid, nil, err)
+		return
+	}
+
+	msg := pj.message(uid, p.joiner.parents)
+	switch p.joiner.policy.OnMissing {
+	case JoinPartial:
+		p.logger.Warnw("join incomplete, receive partial outputs", "pid", p.String(), "uid", uid, "err", err)
+		p.process(msg)
+	default:
+		p.logger.Errorw("join incomplete, drop message", "pid", p.String(), "uid", uid, "err", err)
+		p.TickInMsgCh <- NewTickInMsg(uid, p.String(), msg.data)
+		p.TickOutMsgCh <- NewTickOutMsg(uid, p.String(), nil, err)
+		p.context.futures.handled(uid, p.actorName, false, nil, err, 0)
+		p.context.deadLetters.add(p.actorName, msg, DeadLetterJoinTimeout, err)
+		p.skipJoins(uid, nil, err)
+	}
+}
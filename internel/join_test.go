@@ -0,0 +1,306 @@
+package internel
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Joiner collects the joined outputs of its parents, it waits for gate before it returns if gate is set
+type Joiner struct {
+	policy   JoinPolicy
+	received chan map[string]any
+	gate     chan struct{}
+}
+
+func (j *Joiner) Receive(ctx *Context, msg any) (any, error) {
+	outputs, ok := msg.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("joiner not support msg type %T", msg)
+	}
+	j.received <- outputs
+	if j.gate != nil {
+		<-j.gate
+	}
+	return len(outputs), nil
+}
+
+func (j *Joiner) String() string {
+	return "joiner"
+}
+
+func (j *Joiner) JoinPolicy() JoinPolicy {
+	return j.policy
+}
+
+// Picky fails on every msg that contains "bad"
+type Picky struct{}
+
+func (p *Picky) Receive(ctx *Context, msg any) (any, error) {
+	if strings.Contains(fmt.Sprint(msg), "bad") {
+		return nil, fmt.Errorf("picky does not like %v", msg)
+	}
+	return "picky", nil
+}
+
+func (p *Picky) String() string {
+	return "picky"
+}
+
+// Sleepy sleeps before it returns
+type Sleepy struct {
+	delay time.Duration
+}
+
+func (s *Sleepy) Receive(ctx *Context, msg any) (any, error) {
+	time.Sleep(s.delay)
+	return "sleepy", nil
+}
+
+func (s *Sleepy) String() string {
+	return "sleepy"
+}
+
+// newDiamond src -> left, right -> joiner
+func newDiamond(t *testing.T, joiner *Joiner, opts ...PidOption) *Engine[Actor] {
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	left, err := engine.Spawn(newEcho("left"))
+	assert.Nil(t, err)
+	right, err := engine.Spawn(&Picky{})
+	assert.Nil(t, err)
+	join, err := engine.Spawn(joiner, opts...)
+	assert.Nil(t, err)
+
+	assert.Nil(t, engine.AddEdge(src, left))
+	assert.Nil(t, engine.AddEdge(src, right))
+	assert.Nil(t, engine.AddEdge(left, join))
+	assert.Nil(t, engine.AddEdge(right, join))
+	assert.Nil(t, engine.Ready())
+	return engine
+}
+
+func TestJoin_AllParents(t *testing.T) {
+	joiner := &Joiner{received: make(chan map[string]any, 10)}
+	engine := newDiamond(t, joiner)
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outputs, err := engine.SendAndWait(ctx, "ok")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"joiner": 2}, outputs)
+
+	// the join actor receives once per message
+	select {
+	case received := <-joiner.received:
+		assert.Equal(t, map[string]any{"left": "left(src(ok))", "picky": "picky"}, received)
+	case <-time.After(time.Second):
+		t.Fatal("join is not received")
+	}
+	assert.Equal(t, 0, len(joiner.received))
+}
+
+func TestJoin_Timeout(t *testing.T) {
+	joiner := &Joiner{
+		policy:   JoinPolicy{Timeout: 50 * time.Millisecond, OnMissing: JoinPartial},
+		received: make(chan map[string]any, 10),
+	}
+	engine := newDiamond(t, joiner)
+	defer engine.Shutdown(context.Background())
+
+	assert.Nil(t, engine.Send("bad"))
+	select {
+	case outputs := <-joiner.received:
+		assert.Equal(t, map[string]any{"left": "left(src(bad))"}, outputs)
+	case <-time.After(time.Second):
+		t.Fatal("partial join is not received")
+	}
+
+	// the dropped uid is reported as failed, and streamed once it has gone through the DAG
+	joiner.policy.OnMissing = JoinDrop
+	engine = newLateDiamond(t, joiner, 200*time.Millisecond)
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream := engine.SinkPool().Stream(ctx)
+	future, err := engine.Ask(ctx, "ok")
+	assert.Nil(t, err)
+	_, err = future.Result()
+	assert.EqualError(t, err, "[joiner] join timeout, missing parents [sleepy]")
+	select {
+	case result := <-stream:
+		assert.Equal(t, future.Uid(), result.Uid())
+	case <-ctx.Done():
+		t.Fatal("dropped join is not streamed")
+	}
+	assert.Equal(t, 0, len(joiner.received))
+}
+
+func TestJoin_ParentFails(t *testing.T) {
+	// the join waits forever for its parents, but not for one that failed
+	joiner := &Joiner{received: make(chan map[string]any, 10)}
+	engine := newDiamond(t, joiner)
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := engine.SendAndWait(ctx, "bad")
+	assert.EqualError(t, err, "[picky] picky does not like src(bad)")
+	assert.Equal(t, 0, len(joiner.received))
+	dropped := engine.DeadLetters().Query(func(letter DeadLetter) bool {
+		return letter.Reason == DeadLetterJoinTimeout
+	})
+	assert.Equal(t, 1, len(dropped))
+	assert.Equal(t, "join skipped by parents [picky]", dropped[0].Err.Error())
+
+	outputs, err := engine.SendAndWait(ctx, "ok")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"joiner": 2}, outputs)
+
+	joiner.policy.OnMissing = JoinPartial
+	engine = newDiamond(t, joiner)
+	defer engine.Shutdown(context.Background())
+
+	_, err = engine.SendAndWait(ctx, "bad")
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]any{"left": "left(src(ok))", "picky": "picky"}, <-joiner.received)
+	assert.Equal(t, map[string]any{"left": "left(src(bad))"}, <-joiner.received)
+}
+
+func TestJoin_ParentFiltered(t *testing.T) {
+	joiner := &Joiner{
+		policy:   JoinPolicy{OnMissing: JoinPartial},
+		received: make(chan map[string]any, 10),
+	}
+	// src -> left -> joiner, src -> mid -> right -> joiner, mid only takes what is not skipped
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	left, err := engine.Spawn(newEcho("left"))
+	assert.Nil(t, err)
+	mid, err := engine.Spawn(newEcho("mid"))
+	assert.Nil(t, err)
+	right, err := engine.Spawn(newEcho("right"))
+	assert.Nil(t, err)
+	join, err := engine.Spawn(joiner)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, left))
+	assert.Nil(t, engine.AddEdgeWhen(src, mid, func(out any) bool {
+		return !strings.Contains(fmt.Sprint(out), "skip")
+	}))
+	assert.Nil(t, engine.AddEdge(mid, right))
+	assert.Nil(t, engine.AddEdge(left, join))
+	assert.Nil(t, engine.AddEdge(right, join))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	// the skip is passed down to the join, which does not wait for right
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outputs, err := engine.SendAndWait(ctx, "skip")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"joiner": 1}, outputs)
+	assert.Equal(t, map[string]any{"left": "left(src(skip))"}, <-joiner.received)
+
+	outputs, err = engine.SendAndWait(ctx, "ok")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"joiner": 2}, outputs)
+	assert.Equal(t, map[string]any{"left": "left(src(ok))", "right": "right(mid(src(ok)))"}, <-joiner.received)
+}
+
+// newLateDiamond src -> left, sleepy -> joiner, sleepy sleeps for delay
+func newLateDiamond(t *testing.T, joiner *Joiner, delay time.Duration) *Engine[Actor] {
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	left, err := engine.Spawn(newEcho("left"))
+	assert.Nil(t, err)
+	sleepy, err := engine.Spawn(&Sleepy{delay: delay})
+	assert.Nil(t, err)
+	join, err := engine.Spawn(joiner)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, left))
+	assert.Nil(t, engine.AddEdge(src, sleepy))
+	assert.Nil(t, engine.AddEdge(left, join))
+	assert.Nil(t, engine.AddEdge(sleepy, join))
+	assert.Nil(t, engine.Ready())
+	return engine
+}
+
+func TestJoin_LateParent(t *testing.T) {
+	joiner := &Joiner{
+		policy:   JoinPolicy{Timeout: 50 * time.Millisecond, OnMissing: JoinPartial},
+		received: make(chan map[string]any, 10),
+	}
+	engine := newLateDiamond(t, joiner, 200*time.Millisecond)
+	defer engine.Shutdown(context.Background())
+
+	// the partial output is the outcome of the message, the flight is open until the join resolves
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outputs, err := engine.SendAndWait(ctx, "ok")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"joiner": 1}, outputs)
+	assert.Equal(t, map[string]any{"left": "left(src(ok))"}, <-joiner.received)
+
+	// the late output of sleepy does not start a new join
+	late := engine.DeadLetters().Query(func(letter DeadLetter) bool {
+		return letter.Reason == DeadLetterJoinLate
+	})
+	assert.Equal(t, 1, len(late))
+	assert.Equal(t, "sleepy", late[0].Message.Source)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(joiner.received))
+}
+
+func TestJoin_TimeoutFullInbox(t *testing.T) {
+	joiner := &Joiner{
+		policy:   JoinPolicy{Timeout: 50 * time.Millisecond, OnMissing: JoinPartial},
+		received: make(chan map[string]any, 10),
+		gate:     make(chan struct{}),
+	}
+	// picky retries bad later, the joiner is not told to skip it before the timeout
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	left, err := engine.Spawn(newEcho("left"))
+	assert.Nil(t, err)
+	right, err := engine.Spawn(&Picky{}, WithRetry(RetryPolicy{MaxAttempts: 2, InitialBackoff: 300 * time.Millisecond}))
+	assert.Nil(t, err)
+	join, err := engine.Spawn(joiner, WithInboxSize(2))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, left))
+	assert.Nil(t, engine.AddEdge(src, right))
+	assert.Nil(t, engine.AddEdge(left, join))
+	assert.Nil(t, engine.AddEdge(right, join))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	// the join of bad times out while the joiner is busy with ok1, and its inbox is full of ok2
+	assert.Nil(t, engine.Send("bad"))
+	assert.Nil(t, engine.Send("ok1"))
+	assert.Nil(t, engine.Send("ok2"))
+	assert.Equal(t, map[string]any{"left": "left(src(ok1))", "picky": "picky"}, <-joiner.received)
+	time.Sleep(150 * time.Millisecond)
+	close(joiner.gate)
+
+	// the timeout waits for room instead of being lost
+	var joined []map[string]any
+	for len(joined) < 2 {
+		select {
+		case outputs := <-joiner.received:
+			joined = append(joined, outputs)
+		case <-time.After(time.Second):
+			t.Fatal("partial join is not received")
+		}
+	}
+	assert.Contains(t, joined, map[string]any{"left": "left(src(bad))"})
+	assert.Contains(t, joined, map[string]any{"left": "left(src(ok2))", "picky": "picky"})
+}
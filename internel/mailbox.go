@@ -1,10 +1,13 @@
 package internel
 
 import (
+	"errors"
 	"fmt"
 	"github.com/fzft/my-actor/pkg"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,11 +17,18 @@ import (
 // Author: fzft
 const defaultThrottle = 1024
 
+// ErrBusy is the error of a Send rejected because the root mailbox is full,
+// the DAG is not keeping up, the sender should back off and retry
+var ErrBusy = errors.New("engine is busy")
+
 type Mailbox interface {
 	// Source Post a message to the mailbox
 	Source(msg any) error
 
 	Consume() chan Message
+
+	// Stop stops accepting messages and releases the consumer goroutine
+	Stop()
 }
 
 type DefaultMailbox struct {
@@ -27,42 +37,98 @@ type DefaultMailbox struct {
 
 	q          *pkg.Queue
 	bufferSize int
-	lastSent   time.Time
+	// lastSent is the unix nanos of the last accepted message, the senders set it concurrently
+	lastSent int64
+
+	closed int32
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	// metrics reports the occupancy and drops as the root actor named metricsName
+	metricsName string
+	metrics     MetricsSink
 }
 
 func NewDefaultMailbox(logger *zap.SugaredLogger) *DefaultMailbox {
+	return NewDefaultMailboxWithSize(logger, defaultThrottle)
+}
+
+// NewDefaultMailboxWithSize returns a DefaultMailbox that holds at most size messages
+func NewDefaultMailboxWithSize(logger *zap.SugaredLogger, size int) *DefaultMailbox {
 	inbox := &DefaultMailbox{
 		// throttle is the throttling of messages in the mailbox, the default is 1024
-		throttle: make(chan struct{}, defaultThrottle),
-		q:        pkg.NewQueue(defaultThrottle),
-		logger:   logger,
+		throttle:   make(chan struct{}, size),
+		q:          pkg.NewQueue(size),
+		bufferSize: size,
+		logger:     logger,
+		stopCh:     make(chan struct{}),
+		metrics:    nopMetrics{},
 	}
 	return inbox
 }
 
 func (d *DefaultMailbox) Source(msg any) error {
+	if atomic.LoadInt32(&d.closed) == 1 {
+		return fmt.Errorf("mailbox is stopped, drop message")
+	}
 	select {
 	case d.throttle <- struct{}{}:
-		d.lastSent = time.Now()
+		atomic.StoreInt64(&d.lastSent, time.Now().UnixNano())
 		d.q.Enqueue(msg)
+		d.metrics.MailboxOccupancy(d.metricsName, len(d.throttle), cap(d.throttle))
 	default:
 		// Throttle channel is full, drop message
-		return fmt.Errorf("throttle channel is full, drop message")
+		d.metrics.MailboxDropped(d.metricsName)
+		return fmt.Errorf("throttle channel is full, drop message: %w", ErrBusy)
 	}
 	return nil
 }
 
 // Consume ...
 func (d *DefaultMailbox) Consume() chan Message {
-	c := make(chan Message, defaultThrottle)
+	c := make(chan Message, d.bufferSize)
 
+	d.wg.Add(1)
 	go func() {
+		defer d.wg.Done()
 		for {
-			item := d.q.Dequeue()
-			c <- WrapMsg(uuid.New().String(), item)
+			item := d.q.Dequeue(d.stopCh)
+			select {
+			case <-d.stopCh:
+				d.logger.Debugw("stop consume", "pending", d.q.Len())
+				return
+			default:
+			}
+
+			// the uid may already be assigned by the sender, e.g. Engine.Ask
+			msg, ok := item.(Message)
+			if !ok {
+				msg = newMessage(uuid.New().String(), item)
+			}
+			select {
+			case <-d.stopCh:
+				return
+			case c <- msg:
+			}
 			<-d.throttle
+			d.metrics.MailboxOccupancy(d.metricsName, len(d.throttle), cap(d.throttle))
 		}
 	}()
 
 	return c
 }
+
+// SetMetrics reports the occupancy and drops of the mailbox to sink, it must be called before Consume
+func (d *DefaultMailbox) SetMetrics(actor string, sink MetricsSink) {
+	d.metricsName = actor
+	d.metrics = sink
+}
+
+// Stop stops the mailbox, the messages are not consumed yet will be dropped
+func (d *DefaultMailbox) Stop() {
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return
+	}
+	close(d.stopCh)
+	d.wg.Wait()
+}
@@ -1,8 +1,12 @@
 package internel
 
 import (
+	"context"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDefaultMailbox(t *testing.T) {
@@ -27,3 +31,168 @@ func TestDefaultMailbox(t *testing.T) {
 	//	}
 	//}
 }
+
+// TestDefaultMailbox_ConcurrentSenders several goroutines send to the root, e.g. the bench command
+func TestDefaultMailbox_ConcurrentSenders(t *testing.T) {
+	engine := NewEngine()
+	_, err := engine.Spawn(newDummy())
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				outputs, err := engine.SendAndWait(ctx, i*10+j)
+				assert.Nil(t, err)
+				assert.Equal(t, i*10+j+1, outputs["dummy"])
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+type urgent struct {
+	n int
+}
+
+func (u urgent) Priority() int {
+	return u.n
+}
+
+// consumeN takes n messages from the mailbox, in the order it delivers them
+func consumeN(t *testing.T, mailbox Mailbox, n int) []any {
+	c := mailbox.Consume()
+	var consumed []any
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-c:
+			consumed = append(consumed, msg.data)
+		case <-time.After(time.Second):
+			t.Fatalf("consumed %d of %d messages", i, n)
+		}
+	}
+	return consumed
+}
+
+func TestPriorityMailbox(t *testing.T) {
+	mailbox := NewPriorityMailbox(zap.NewNop().Sugar(), 4, nil)
+	defer mailbox.Stop()
+
+	for _, msg := range []any{"plain", urgent{1}, urgent{5}, urgent{1}} {
+		assert.Nil(t, mailbox.Source(msg))
+	}
+	assert.NotNil(t, mailbox.Source(urgent{9}))
+	assert.Equal(t, []any{urgent{5}, urgent{1}, urgent{1}, "plain"}, consumeN(t, mailbox, 4))
+}
+
+func TestBoundedMailbox(t *testing.T) {
+	mailbox := NewBoundedMailbox(zap.NewNop().Sugar(), 2)
+	defer mailbox.Stop()
+
+	assert.Nil(t, mailbox.Source(1))
+	assert.Nil(t, mailbox.Source(2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, mailbox.SourceContext(ctx, 3), context.DeadlineExceeded)
+
+	// the sender waits until the consumer makes room
+	sent := make(chan error, 1)
+	go func() {
+		sent <- mailbox.Source(3)
+	}()
+	assert.Equal(t, []any{1, 2, 3}, consumeN(t, mailbox, 3))
+	assert.Nil(t, <-sent)
+}
+
+func TestDropOldestMailbox(t *testing.T) {
+	mailbox := NewDropOldestMailbox(zap.NewNop().Sugar(), 2)
+	defer mailbox.Stop()
+	var dropped []any
+	mailbox.SetDropHandler(func(msg Message) {
+		dropped = append(dropped, msg.data)
+	})
+
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, mailbox.Source(i))
+	}
+	assert.Equal(t, []any{1, 2}, dropped)
+	assert.Equal(t, []any{3, 4}, consumeN(t, mailbox, 2))
+}
+
+func TestCoalescingMailbox(t *testing.T) {
+	mailbox := NewCoalescingMailbox(zap.NewNop().Sugar(), 2, func(msg any) string {
+		if m, ok := msg.(map[string]any); ok {
+			return m["key"].(string)
+		}
+		return ""
+	})
+	defer mailbox.Stop()
+	var dropped []any
+	mailbox.SetDropHandler(func(msg Message) {
+		dropped = append(dropped, msg.data)
+	})
+
+	assert.Nil(t, mailbox.Source(map[string]any{"key": "a", "v": 1}))
+	assert.Nil(t, mailbox.Source(map[string]any{"key": "b", "v": 1}))
+	assert.Nil(t, mailbox.Source(map[string]any{"key": "a", "v": 2}))
+	assert.NotNil(t, mailbox.Source(map[string]any{"key": "c", "v": 1}))
+	assert.Equal(t, []any{map[string]any{"key": "a", "v": 1}}, dropped)
+	assert.Equal(t, []any{
+		map[string]any{"key": "a", "v": 2},
+		map[string]any{"key": "b", "v": 1},
+	}, consumeN(t, mailbox, 2))
+}
+
+// Gate blocks every Receive until it is opened
+type Gate struct {
+	started chan any
+	open    chan struct{}
+}
+
+func (g *Gate) Receive(ctx *Context, msg any) (any, error) {
+	g.started <- msg
+	<-g.open
+	return msg, nil
+}
+
+func (g *Gate) String() string {
+	return "gate"
+}
+
+func TestEngine_DropOldestMailbox(t *testing.T) {
+	gate := &Gate{started: make(chan any, 10), open: make(chan struct{})}
+	mailbox := NewDropOldestMailbox(zap.NewNop().Sugar(), 1)
+	engine := NewEngine()
+	_, err := engine.Spawn(gate, WithMailbox(mailbox), WithInboxSize(2))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	assert.Nil(t, engine.Send(1))
+	assert.Equal(t, 1, <-gate.started)
+	// the inbox, the root's buffering and the mailbox's delivery take one message each
+	for i := 2; i <= 4; i++ {
+		assert.Nil(t, engine.Send(i))
+		assert.Eventually(t, func() bool { return mailbox.Len() == 0 }, time.Second, time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	future, err := engine.Ask(ctx, 5)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Send(6))
+	_, err = future.Result()
+	assert.ErrorIs(t, err, ErrMailboxDropped)
+
+	close(gate.open)
+	for _, want := range []int{2, 3, 4, 6} {
+		assert.Equal(t, want, <-gate.started)
+	}
+}
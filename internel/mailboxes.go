@@ -0,0 +1,399 @@
+package internel
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// ErrMailboxDropped is the error of an Ask whose message is dropped by the mailbox after it was accepted,
+// e.g. evicted by a DropOldestMailbox or replaced by a CoalescingMailbox
+var ErrMailboxDropped = errors.New("message dropped by mailbox")
+
+// ContextMailbox is a Mailbox whose Source may wait, SourceContext gives up once ctx is done
+// the engine uses it for SendWithContext and Ask
+type ContextMailbox interface {
+	Mailbox
+	SourceContext(ctx context.Context, msg any) error
+}
+
+// DroppingMailbox is a Mailbox that drops messages it has accepted, e.g. to make room for newer ones
+// the engine sets the drop handler at Ready, so it stops waiting for the dropped messages
+type DroppingMailbox interface {
+	Mailbox
+	SetDropHandler(fn func(msg Message))
+}
+
+// Prioritized is a message that carries its priority for a PriorityMailbox, a higher priority is consumed first
+type Prioritized interface {
+	Priority() int
+}
+
+// mailboxQueue is the order and the overload behavior of a queueMailbox
+type mailboxQueue interface {
+	// push adds the msg to a queue that holds at most size messages
+	// it returns the messages dropped to accept it, or an error if it is rejected
+	push(msg Message, size int) ([]Message, error)
+	pop() (Message, bool)
+	len() int
+}
+
+// queueMailbox is the base of the built-in mailboxes, the queue decides the order and what happens when it is full
+type queueMailbox struct {
+	logger *zap.SugaredLogger
+	size   int
+	// block makes the sender wait for room instead of pushing to a full queue
+	block bool
+
+	mu     sync.Mutex
+	queue  mailboxQueue
+	closed bool
+
+	// notify wakes up the consumer, space wakes up a blocked sender
+	notify chan struct{}
+	space  chan struct{}
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	onDrop      func(msg Message)
+	metricsName string
+	metrics     MetricsSink
+}
+
+func newQueueMailbox(logger *zap.SugaredLogger, size int, queue mailboxQueue, block bool) *queueMailbox {
+	if size <= 0 {
+		size = defaultThrottle
+	}
+	return &queueMailbox{
+		logger:  logger,
+		size:    size,
+		block:   block,
+		queue:   queue,
+		notify:  make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		metrics: nopMetrics{},
+	}
+}
+
+func (q *queueMailbox) Source(msg any) error {
+	return q.SourceContext(context.Background(), msg)
+}
+
+func (q *queueMailbox) SourceContext(ctx context.Context, msg any) error {
+	m, ok := msg.(Message)
+	if !ok {
+		m = newMessage(uuid.New().String(), msg)
+	}
+
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return fmt.Errorf("mailbox is stopped, drop message")
+		}
+		if q.block && q.queue.len() >= q.size {
+			q.mu.Unlock()
+			select {
+			case <-q.space:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-q.stopCh:
+				return fmt.Errorf("mailbox is stopped, drop message")
+			}
+		}
+
+		dropped, err := q.queue.push(m, q.size)
+		occupied := q.queue.len()
+		q.mu.Unlock()
+
+		if err != nil {
+			q.metrics.MailboxDropped(q.metricsName)
+			return err
+		}
+		for _, d := range dropped {
+			q.metrics.MailboxDropped(q.metricsName)
+			if q.onDrop != nil {
+				q.onDrop(d)
+			}
+		}
+		q.metrics.MailboxOccupancy(q.metricsName, occupied, q.size)
+		signal(q.notify)
+		if occupied < q.size {
+			// pass the room on to another blocked sender
+			signal(q.space)
+		}
+		return nil
+	}
+}
+
+// Consume moves the messages to the returned channel in the queue's order, one at a time
+func (q *queueMailbox) Consume() chan Message {
+	c := make(chan Message)
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		for {
+			q.mu.Lock()
+			msg, ok := q.queue.pop()
+			occupied := q.queue.len()
+			q.mu.Unlock()
+
+			if !ok {
+				select {
+				case <-q.notify:
+					continue
+				case <-q.stopCh:
+					return
+				}
+			}
+
+			q.metrics.MailboxOccupancy(q.metricsName, occupied, q.size)
+			signal(q.space)
+			select {
+			case c <- msg:
+			case <-q.stopCh:
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// Stop stops the mailbox, the messages are not consumed yet will be dropped
+func (q *queueMailbox) Stop() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.stopCh)
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// SetDropHandler is called with every message dropped after it was accepted, it must be called before Consume
+func (q *queueMailbox) SetDropHandler(fn func(msg Message)) {
+	q.onDrop = fn
+}
+
+// SetMetrics reports the occupancy and drops of the mailbox to sink, it must be called before Consume
+func (q *queueMailbox) SetMetrics(actor string, sink MetricsSink) {
+	q.metricsName = actor
+	q.metrics = sink
+}
+
+// Len returns the number of messages in the mailbox
+func (q *queueMailbox) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queue.len()
+}
+
+// signal wakes up one waiter of ch, a pending signal is enough
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// PriorityMailbox consumes the message with the highest priority first, and in order within a priority
+// it rejects a message when it is full
+type PriorityMailbox struct {
+	*queueMailbox
+}
+
+// NewPriorityMailbox returns a PriorityMailbox of size messages, priority returns the priority of a message,
+// nil uses the message's Prioritized.Priority, a message that is not Prioritized has priority 0
+func NewPriorityMailbox(logger *zap.SugaredLogger, size int, priority func(msg any) int) *PriorityMailbox {
+	if priority == nil {
+		priority = func(msg any) int {
+			if p, ok := msg.(Prioritized); ok {
+				return p.Priority()
+			}
+			return 0
+		}
+	}
+	queue := &priorityQueue{priority: priority}
+	return &PriorityMailbox{newQueueMailbox(logger, size, queue, false)}
+}
+
+// BoundedMailbox blocks the sender while it is full, SourceContext gives up once the context is done
+type BoundedMailbox struct {
+	*queueMailbox
+}
+
+func NewBoundedMailbox(logger *zap.SugaredLogger, size int) *BoundedMailbox {
+	return &BoundedMailbox{newQueueMailbox(logger, size, &fifoQueue{}, true)}
+}
+
+// DropOldestMailbox drops the oldest message to accept a new one while it is full
+type DropOldestMailbox struct {
+	*queueMailbox
+}
+
+func NewDropOldestMailbox(logger *zap.SugaredLogger, size int) *DropOldestMailbox {
+	return &DropOldestMailbox{newQueueMailbox(logger, size, &fifoQueue{dropOldest: true}, false)}
+}
+
+// CoalescingMailbox replaces the pending message of the same key with the new one, the message keeps its place in the queue
+// a message with an empty key is never replaced, a new key is rejected when the mailbox is full
+type CoalescingMailbox struct {
+	*queueMailbox
+}
+
+// NewCoalescingMailbox returns a CoalescingMailbox of size messages, key returns the coalescing key of a message
+func NewCoalescingMailbox(logger *zap.SugaredLogger, size int, key func(msg any) string) *CoalescingMailbox {
+	queue := &coalescingQueue{key: key, keys: make(map[string]*list.Element)}
+	return &CoalescingMailbox{newQueueMailbox(logger, size, queue, false)}
+}
+
+// fifoQueue is in arrival order, it rejects or drops the oldest message when it is full
+type fifoQueue struct {
+	items      list.List
+	dropOldest bool
+}
+
+func (f *fifoQueue) push(msg Message, size int) ([]Message, error) {
+	var dropped []Message
+	for f.items.Len() >= size {
+		if !f.dropOldest {
+			return nil, fmt.Errorf("mailbox is full, drop message: %w", ErrBusy)
+		}
+		dropped = append(dropped, f.items.Remove(f.items.Front()).(Message))
+	}
+	f.items.PushBack(msg)
+	return dropped, nil
+}
+
+func (f *fifoQueue) pop() (Message, bool) {
+	front := f.items.Front()
+	if front == nil {
+		return Message{}, false
+	}
+	return f.items.Remove(front).(Message), true
+}
+
+func (f *fifoQueue) len() int {
+	return f.items.Len()
+}
+
+// priorityItem is a message in the priorityQueue, seq keeps the arrival order within a priority
+type priorityItem struct {
+	msg      Message
+	priority int
+	seq      uint64
+}
+
+// priorityQueue is a max heap of priority, then min heap of seq
+type priorityQueue struct {
+	items    []priorityItem
+	seq      uint64
+	priority func(msg any) int
+}
+
+func (p *priorityQueue) push(msg Message, size int) ([]Message, error) {
+	if len(p.items) >= size {
+		return nil, fmt.Errorf("mailbox is full, drop message: %w", ErrBusy)
+	}
+	p.seq++
+	heap.Push((*priorityHeap)(p), priorityItem{msg: msg, priority: p.priority(msg.data), seq: p.seq})
+	return nil, nil
+}
+
+func (p *priorityQueue) pop() (Message, bool) {
+	if len(p.items) == 0 {
+		return Message{}, false
+	}
+	return heap.Pop((*priorityHeap)(p)).(priorityItem).msg, true
+}
+
+func (p *priorityQueue) len() int {
+	return len(p.items)
+}
+
+// priorityHeap implements heap.Interface for the priorityQueue
+type priorityHeap priorityQueue
+
+func (h *priorityHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *priorityHeap) Less(i, j int) bool {
+	if h.items[i].priority != h.items[j].priority {
+		return h.items[i].priority > h.items[j].priority
+	}
+	return h.items[i].seq < h.items[j].seq
+}
+
+func (h *priorityHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *priorityHeap) Push(x any) {
+	h.items = append(h.items, x.(priorityItem))
+}
+
+func (h *priorityHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// coalescingQueue is in arrival order, a message replaces the pending message of the same key
+type coalescingQueue struct {
+	items list.List
+	keys  map[string]*list.Element
+	key   func(msg any) string
+}
+
+// coalescingItem is a message in the coalescingQueue
+type coalescingItem struct {
+	msg Message
+	key string
+}
+
+func (c *coalescingQueue) push(msg Message, size int) ([]Message, error) {
+	key := c.key(msg.data)
+	if elem, ok := c.keys[key]; ok && key != "" {
+		item := elem.Value.(*coalescingItem)
+		replaced := item.msg
+		item.msg = msg
+		return []Message{replaced}, nil
+	}
+	if c.items.Len() >= size {
+		return nil, fmt.Errorf("mailbox is full, drop message: %w", ErrBusy)
+	}
+
+	elem := c.items.PushBack(&coalescingItem{msg: msg, key: key})
+	if key != "" {
+		c.keys[key] = elem
+	}
+	return nil, nil
+}
+
+func (c *coalescingQueue) pop() (Message, bool) {
+	front := c.items.Front()
+	if front == nil {
+		return Message{}, false
+	}
+	item := c.items.Remove(front).(*coalescingItem)
+	if item.key != "" {
+		delete(c.keys, item.key)
+	}
+	return item.msg, true
+}
+
+func (c *coalescingQueue) len() int {
+	return c.items.Len()
+}
@@ -1,10 +1,54 @@
 package internel
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMessageExpired is the error of a message dropped because its deadline has passed or its context is canceled
+var ErrMessageExpired = errors.New("message expired")
+
+// expiredError is ErrMessageExpired with the cause, e.g. context.DeadlineExceeded
+type expiredError struct {
+	cause error
+}
+
+func (e *expiredError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrMessageExpired, e.cause)
+}
+
+func (e *expiredError) Is(target error) bool {
+	return target == ErrMessageExpired
+}
+
+func (e *expiredError) Unwrap() error {
+	return e.cause
+}
 
 type Message struct {
 	uid  string
 	data any
+
+	// from is the name of the actor that produced the message, empty if it comes from a mailbox
+	from string
+
+	// trace is the trace context of the message, links are the other parents' spans of a joined message
+	trace TraceContext
+	links []TraceContext
+
+	// headers are propagated across the edges, they are shared and never modified in place
+	headers  map[string]string
+	created  time.Time
+	hops     int
+	deadline time.Time
+
+	// attempt is the number of times the actor has failed the message and retried it, it starts over at every hop
+	attempt int
+
+	// ctx is the context of the sender, nil if the message is sent without one
+	ctx context.Context
 }
 
 func WrapMsg(uid string, data any) Message {
@@ -14,10 +58,142 @@ func WrapMsg(uid string, data any) Message {
 	}
 }
 
+// newMessage wraps a msg sent to a root actor, an Envelope is unwrapped into the message's metadata
+func newMessage(uid string, msg any) Message {
+	env, ok := msg.(Envelope)
+	if !ok {
+		m := WrapMsg(uid, msg)
+		m.created = time.Now()
+		return m
+	}
+
+	m := WrapMsg(uid, env.Data)
+	if env.Uid != "" {
+		m.uid = env.Uid
+	}
+	m.headers = copyHeaders(env.Headers)
+	m.created = env.Created
+	if m.created.IsZero() {
+		m.created = time.Now()
+	}
+	m.deadline = env.Deadline
+	return m
+}
+
+// next returns the message of the actor's output, it carries on the metadata of the input
+func (m Message) next(from string, data any, headers map[string]string) Message {
+	return Message{
+		uid:      m.uid,
+		data:     data,
+		from:     from,
+		headers:  headers,
+		created:  m.created,
+		hops:     m.hops + 1,
+		deadline: m.deadline,
+		ctx:      m.ctx,
+	}
+}
+
+// withContext attaches the sender's context, its deadline and cancellation follow the message
+func (m *Message) withContext(ctx context.Context) {
+	m.ctx = ctx
+	if deadline, ok := ctx.Deadline(); ok && (m.deadline.IsZero() || deadline.Before(m.deadline)) {
+		m.deadline = deadline
+	}
+}
+
+// expired returns an ErrMessageExpired error if the deadline has passed or the context is canceled
+func (m Message) expired(now time.Time) error {
+	if m.ctx != nil {
+		if err := m.ctx.Err(); err != nil {
+			return &expiredError{cause: err}
+		}
+	}
+	if !m.deadline.IsZero() && !now.Before(m.deadline) {
+		return &expiredError{cause: context.DeadlineExceeded}
+	}
+	return nil
+}
+
+// context returns the context of the message, context.Background if it is sent without one
+func (m Message) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// envelope returns the metadata of the message as seen by the actor
+func (m Message) envelope() Envelope {
+	return Envelope{
+		Uid:      m.uid,
+		Headers:  copyHeaders(m.headers),
+		Created:  m.created,
+		Source:   m.from,
+		Hops:     m.hops,
+		Deadline: m.deadline,
+		Attempt:  m.attempt + 1,
+		Data:     m.data,
+	}
+}
+
+// Envelope is a message with its metadata, an actor reads the envelope of the message it receives with Context.Envelope
+// an Envelope sent with Engine.Send or Ask is unwrapped, Data is what the root actor receives
+//
+//	engine.Send(Envelope{Headers: map[string]string{"tenant": "acme"}, Data: order})
+type Envelope struct {
+	// Uid is the message uid, assigned by the engine if empty
+	Uid string
+
+	// Headers are propagated to the children, an actor overrides them with Context.SetHeader
+	Headers map[string]string
+
+	// Created is when the message entered the DAG
+	Created time.Time
+
+	// Source is the name of the actor that produced the message, empty at a root actor
+	Source string
+
+	// Hops is the number of actors the message has gone through before this one
+	Hops int
+
+	// Deadline is when the message expires, zero means no deadline
+	// an expired message is dropped before the next actor receives it
+	Deadline time.Time
+
+	// Attempt is the number of times the actor receives the message, more than 1 on a retry, ignored when sent
+	Attempt int
+
+	Data any
+}
+
+// Header returns the value of the header
+func (e Envelope) Header(key string) string {
+	return e.Headers[key]
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(headers))
+	for k, v := range headers {
+		c[k] = v
+	}
+	return c
+}
+
 func (m Message) String() string {
 	return fmt.Sprintf("%v", m.data)
 }
 
+// Route is the output envelope of an actor that sends Data only to the named child actors
+// instead of all of them, the edge predicates still apply
+type Route struct {
+	To   []string
+	Data any
+}
+
 // StartMessage Define a start message struct
 type StartMessage struct{}
 
@@ -0,0 +1,106 @@
+package internel
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Tenant records the envelope it receives, and tags its output with a header
+type Tenant struct {
+	name      string
+	tag       string
+	envelopes chan Envelope
+}
+
+func (a *Tenant) Receive(ctx *Context, msg any) (any, error) {
+	a.envelopes <- ctx.Envelope()
+	if a.tag != "" {
+		ctx.SetHeader("stage", a.tag)
+		ctx.DeleteHeader("secret")
+	}
+	return msg, nil
+}
+
+func (a *Tenant) String() string {
+	return a.name
+}
+
+func newTenant(name string, tag string) *Tenant {
+	return &Tenant{name: name, tag: tag, envelopes: make(chan Envelope, 10)}
+}
+
+func TestEnvelope_Propagation(t *testing.T) {
+	src, mid, leaf := newTenant("src", ""), newTenant("mid", "enriched"), newTenant("leaf", "")
+	engine := NewEngine()
+	srcPid, err := engine.Spawn(src)
+	assert.Nil(t, err)
+	midPid, err := engine.Spawn(mid)
+	assert.Nil(t, err)
+	leafPid, err := engine.Spawn(leaf)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(srcPid, midPid))
+	assert.Nil(t, engine.AddEdge(midPid, leafPid))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	headers := map[string]string{"tenant": "acme", "secret": "s3cr3t"}
+	future, err := engine.Ask(ctx, Envelope{
+		Uid:      "order-1",
+		Headers:  headers,
+		Deadline: deadline,
+		Data:     "order",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "order-1", future.Uid())
+	outputs, err := future.Result()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"leaf": "order"}, outputs)
+
+	root := <-src.envelopes
+	assert.Equal(t, "order-1", root.Uid)
+	assert.Equal(t, "", root.Source)
+	assert.Equal(t, 0, root.Hops)
+	assert.Equal(t, "order", root.Data)
+	assert.Equal(t, headers, root.Headers)
+	assert.True(t, root.Deadline.Equal(deadline))
+	assert.False(t, root.Created.IsZero())
+
+	assert.Equal(t, headers, (<-mid.envelopes).Headers)
+
+	last := <-leaf.envelopes
+	assert.Equal(t, "mid", last.Source)
+	assert.Equal(t, 2, last.Hops)
+	assert.Equal(t, map[string]string{"tenant": "acme", "stage": "enriched"}, last.Headers)
+	assert.Equal(t, "acme", last.Header("tenant"))
+	assert.True(t, last.Created.Equal(root.Created))
+
+	// the sender's headers are not modified
+	assert.Equal(t, "s3cr3t", headers["secret"])
+
+	// a plain message has an envelope too
+	assert.Nil(t, engine.Send("plain"))
+	plain := <-src.envelopes
+	assert.NotEqual(t, "", plain.Uid)
+	assert.Nil(t, plain.Headers)
+	assert.True(t, plain.Deadline.IsZero())
+}
+
+func TestEnvelope_Join(t *testing.T) {
+	pj := &pendingJoin{inputs: map[string]Message{
+		"left":  {data: 1, hops: 1, headers: map[string]string{"k": "left", "l": "1"}},
+		"right": {data: 2, hops: 3, headers: map[string]string{"k": "right", "r": "1"}, deadline: time.Unix(10, 0)},
+	}}
+
+	msg := pj.message("uid", []string{"left", "right"})
+	assert.Equal(t, map[string]any{"left": 1, "right": 2}, msg.data)
+	assert.Equal(t, "left", msg.from)
+	assert.Equal(t, 3, msg.hops)
+	assert.Equal(t, time.Unix(10, 0), msg.deadline)
+	assert.Equal(t, map[string]string{"k": "left", "l": "1", "r": "1"}, msg.headers)
+}
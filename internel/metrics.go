@@ -1 +1,287 @@
 package internel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsSink receives the metrics of the actors and the root mailboxes
+// it is called from the actors' goroutines, implementations must be safe for concurrent use and cheap
+type MetricsSink interface {
+	// MessageReceived is called when the actor starts handling a message
+	MessageReceived(actor string)
+	// MessageSucceeded is called when the actor's Receive returns without error
+	MessageSucceeded(actor string, latency time.Duration)
+	// MessageFailed is called when the actor's Receive returns an error or panics
+	MessageFailed(actor string, latency time.Duration)
+	// InboxDepth is called every inboxDepthInterval with the number of messages waiting in the actor's inbox
+	InboxDepth(actor string, depth int)
+	// MailboxOccupancy is called with the number of messages held by the root actor's mailbox
+	MailboxOccupancy(actor string, occupied, capacity int)
+	// MailboxDropped is called when the root actor's mailbox is full and drops a message
+	MailboxDropped(actor string)
+}
+
+// inboxDepthInterval is how often the engine samples the inbox depth of every actor
+const inboxDepthInterval = 100 * time.Millisecond
+
+// nopMetrics is the MetricsSink of an engine without metrics
+type nopMetrics struct{}
+
+func (nopMetrics) MessageReceived(string)                 {}
+func (nopMetrics) MessageSucceeded(string, time.Duration) {}
+func (nopMetrics) MessageFailed(string, time.Duration)    {}
+func (nopMetrics) InboxDepth(string, int)                 {}
+func (nopMetrics) MailboxOccupancy(string, int, int)      {}
+func (nopMetrics) MailboxDropped(string)                  {}
+
+// DefaultLatencyBuckets are the upper bounds of the latency histogram, in seconds
+var DefaultLatencyBuckets = []float64{
+	0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10,
+}
+
+// Histogram counts observations into cumulative buckets, like a Prometheus histogram
+type Histogram struct {
+	// Buckets are the upper bounds, Counts[i] is the number of observations <= Buckets[i]
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.Buckets {
+		if v <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += v
+	h.Count++
+}
+
+func (h *Histogram) clone() *Histogram {
+	c := *h
+	c.Counts = append([]uint64(nil), h.Counts...)
+	return &c
+}
+
+// ActorMetrics is a snapshot of the metrics of one actor
+type ActorMetrics struct {
+	Received   uint64
+	Succeeded  uint64
+	Failed     uint64
+	Latency    *Histogram
+	InboxDepth int
+}
+
+// MailboxMetrics is a snapshot of the metrics of one root actor's mailbox
+type MailboxMetrics struct {
+	Occupied int
+	Capacity int
+	Dropped  uint64
+}
+
+// MemoryMetrics is a MetricsSink that keeps the metrics in memory
+type MemoryMetrics struct {
+	mu        sync.Mutex
+	buckets   []float64
+	actors    map[string]*ActorMetrics
+	mailboxes map[string]*MailboxMetrics
+}
+
+func NewMemoryMetrics() *MemoryMetrics {
+	return NewMemoryMetricsWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewMemoryMetricsWithBuckets returns a MemoryMetrics whose latency histograms use the given buckets, in seconds
+func NewMemoryMetricsWithBuckets(buckets []float64) *MemoryMetrics {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &MemoryMetrics{
+		buckets:   sorted,
+		actors:    make(map[string]*ActorMetrics),
+		mailboxes: make(map[string]*MailboxMetrics),
+	}
+}
+
+// actor must be called with mu held
+func (m *MemoryMetrics) actor(name string) *ActorMetrics {
+	a, ok := m.actors[name]
+	if !ok {
+		a = &ActorMetrics{Latency: NewHistogram(m.buckets)}
+		m.actors[name] = a
+	}
+	return a
+}
+
+// mailbox must be called with mu held
+func (m *MemoryMetrics) mailbox(name string) *MailboxMetrics {
+	mb, ok := m.mailboxes[name]
+	if !ok {
+		mb = &MailboxMetrics{}
+		m.mailboxes[name] = mb
+	}
+	return mb
+}
+
+func (m *MemoryMetrics) MessageReceived(actor string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.actor(actor).Received++
+}
+
+func (m *MemoryMetrics) MessageSucceeded(actor string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.actor(actor)
+	a.Succeeded++
+	a.Latency.Observe(latency.Seconds())
+}
+
+func (m *MemoryMetrics) MessageFailed(actor string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.actor(actor)
+	a.Failed++
+	a.Latency.Observe(latency.Seconds())
+}
+
+func (m *MemoryMetrics) InboxDepth(actor string, depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.actor(actor).InboxDepth = depth
+}
+
+func (m *MemoryMetrics) MailboxOccupancy(actor string, occupied, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mb := m.mailbox(actor)
+	mb.Occupied = occupied
+	mb.Capacity = capacity
+}
+
+func (m *MemoryMetrics) MailboxDropped(actor string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mailbox(actor).Dropped++
+}
+
+// Actors returns a snapshot of the metrics of every actor, actor name -> metrics
+func (m *MemoryMetrics) Actors() map[string]ActorMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]ActorMetrics, len(m.actors))
+	for name, a := range m.actors {
+		c := *a
+		c.Latency = a.Latency.clone()
+		snapshot[name] = c
+	}
+	return snapshot
+}
+
+// Mailboxes returns a snapshot of the metrics of every root actor's mailbox, actor name -> metrics
+func (m *MemoryMetrics) Mailboxes() map[string]MailboxMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]MailboxMetrics, len(m.mailboxes))
+	for name, mb := range m.mailboxes {
+		snapshot[name] = *mb
+	}
+	return snapshot
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (m *MemoryMetrics) WritePrometheus(w io.Writer) error {
+	actors := m.Actors()
+	mailboxes := m.Mailboxes()
+	actorNames := sortedKeys(actors)
+	mailboxNames := sortedKeys(mailboxes)
+
+	var b strings.Builder
+	counter := func(name, help string, value func(a ActorMetrics) uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, actor := range actorNames {
+			fmt.Fprintf(&b, "%s{actor=\"%s\"} %d\n", name, escapeLabel(actor), value(actors[actor]))
+		}
+	}
+	counter("actor_messages_received_total", "Messages received by the actor.", func(a ActorMetrics) uint64 { return a.Received })
+	counter("actor_messages_succeeded_total", "Messages handled by the actor without error.", func(a ActorMetrics) uint64 { return a.Succeeded })
+	counter("actor_messages_failed_total", "Messages the actor failed to handle.", func(a ActorMetrics) uint64 { return a.Failed })
+
+	b.WriteString("# HELP actor_processing_latency_seconds Time spent in the actor's Receive.\n")
+	b.WriteString("# TYPE actor_processing_latency_seconds histogram\n")
+	for _, actor := range actorNames {
+		h, label := actors[actor].Latency, escapeLabel(actor)
+		for i, bound := range h.Buckets {
+			fmt.Fprintf(&b, "actor_processing_latency_seconds_bucket{actor=\"%s\",le=\"%g\"} %d\n", label, bound, h.Counts[i])
+		}
+		fmt.Fprintf(&b, "actor_processing_latency_seconds_bucket{actor=\"%s\",le=\"+Inf\"} %d\n", label, h.Count)
+		fmt.Fprintf(&b, "actor_processing_latency_seconds_sum{actor=\"%s\"} %g\n", label, h.Sum)
+		fmt.Fprintf(&b, "actor_processing_latency_seconds_count{actor=\"%s\"} %d\n", label, h.Count)
+	}
+
+	b.WriteString("# HELP actor_inbox_depth Messages waiting in the actor's inbox.\n# TYPE actor_inbox_depth gauge\n")
+	for _, actor := range actorNames {
+		fmt.Fprintf(&b, "actor_inbox_depth{actor=\"%s\"} %d\n", escapeLabel(actor), actors[actor].InboxDepth)
+	}
+
+	b.WriteString("# HELP actor_mailbox_occupancy Messages held by the root actor's mailbox.\n# TYPE actor_mailbox_occupancy gauge\n")
+	for _, actor := range mailboxNames {
+		fmt.Fprintf(&b, "actor_mailbox_occupancy{actor=\"%s\"} %d\n", escapeLabel(actor), mailboxes[actor].Occupied)
+	}
+	b.WriteString("# HELP actor_mailbox_capacity Capacity of the root actor's mailbox.\n# TYPE actor_mailbox_capacity gauge\n")
+	for _, actor := range mailboxNames {
+		fmt.Fprintf(&b, "actor_mailbox_capacity{actor=\"%s\"} %d\n", escapeLabel(actor), mailboxes[actor].Capacity)
+	}
+	b.WriteString("# HELP actor_mailbox_dropped_total Messages dropped by the full root actor's mailbox.\n# TYPE actor_mailbox_dropped_total counter\n")
+	for _, actor := range mailboxNames {
+		fmt.Fprintf(&b, "actor_mailbox_dropped_total{actor=\"%s\"} %d\n", escapeLabel(actor), mailboxes[actor].Dropped)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// PrometheusHandler serves the metrics in the Prometheus text exposition format, e.g. on /metrics
+func PrometheusHandler(m *MemoryMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WritePrometheus(w)
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetricsMailbox is a Mailbox that reports its occupancy and drops
+type MetricsMailbox interface {
+	Mailbox
+	// SetMetrics is called at Ready with the name of the root actor
+	SetMetrics(actor string, sink MetricsSink)
+}
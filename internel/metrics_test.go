@@ -0,0 +1,118 @@
+package internel
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram_Observe(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	assert.Equal(t, []uint64{1, 2}, h.Counts)
+	assert.Equal(t, uint64(3), h.Count)
+	assert.InDelta(t, 5.55, h.Sum, 1e-9)
+}
+
+func TestMemoryMetrics_Engine(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	engine := NewEngine()
+	engine.SetMetrics(metrics)
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	picky, err := engine.Spawn(&Picky{})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, picky))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, msg := range []string{"good", "bad", "good"} {
+		engine.SendAndWait(ctx, msg)
+	}
+
+	actors := metrics.Actors()
+	assert.Equal(t, uint64(3), actors["src"].Received)
+	assert.Equal(t, uint64(3), actors["src"].Succeeded)
+	assert.Equal(t, uint64(3), actors["src"].Latency.Count)
+	assert.Equal(t, uint64(3), actors["picky"].Received)
+	assert.Equal(t, uint64(2), actors["picky"].Succeeded)
+	assert.Equal(t, uint64(1), actors["picky"].Failed)
+
+	mailbox := metrics.Mailboxes()["src"]
+	assert.Equal(t, defaultThrottle, mailbox.Capacity)
+	assert.Equal(t, uint64(0), mailbox.Dropped)
+}
+
+func TestMemoryMetrics_MailboxDropped(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	mailbox := NewDefaultMailboxWithSize(NewEngine().logger, 2)
+	mailbox.SetMetrics("root", metrics)
+	defer mailbox.Stop()
+
+	for i := 0; i < 3; i++ {
+		mailbox.Source(i)
+	}
+
+	assert.Equal(t, MailboxMetrics{Occupied: 2, Capacity: 2, Dropped: 1}, metrics.Mailboxes()["root"])
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	metrics := NewMemoryMetricsWithBuckets([]float64{1, 0.1})
+	metrics.MessageReceived(`a"b`)
+	metrics.MessageSucceeded(`a"b`, 50*time.Millisecond)
+	metrics.MailboxDropped("root")
+
+	rec := httptest.NewRecorder()
+	PrometheusHandler(metrics).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+	for _, line := range []string{
+		"# TYPE actor_messages_received_total counter",
+		`actor_messages_received_total{actor="a\"b"} 1`,
+		`actor_messages_failed_total{actor="a\"b"} 0`,
+		"# TYPE actor_processing_latency_seconds histogram",
+		`actor_processing_latency_seconds_bucket{actor="a\"b",le="0.1"} 1`,
+		`actor_processing_latency_seconds_bucket{actor="a\"b",le="+Inf"} 1`,
+		`actor_processing_latency_seconds_count{actor="a\"b"} 1`,
+		`actor_mailbox_dropped_total{actor="root"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+}
+
+func TestMemoryMetrics_InboxDepth(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	engine := NewEngine()
+	engine.SetMetrics(metrics)
+	gate := &Gate{started: make(chan any, 10), open: make(chan struct{})}
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	child, err := engine.Spawn(gate)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, child))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	// the gauge follows the inbox while the actor is blocked on the first message
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, engine.Send(i))
+	}
+	<-gate.started
+	assert.Eventually(t, func() bool {
+		return metrics.Actors()["gate"].InboxDepth == 3
+	}, time.Second, 10*time.Millisecond)
+
+	close(gate.open)
+	assert.Eventually(t, func() bool {
+		return metrics.Actors()["gate"].InboxDepth == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -2,8 +2,11 @@ package internel
 
 import (
 	"fmt"
+	"github.com/fzft/my-actor/pkg"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
 )
 
 // ActorState is the state of the actor
@@ -25,16 +28,79 @@ type Pid struct {
 	logger    *zap.SugaredLogger
 	uuid      string
 	actorName string
-	state     ActorState
+	// state is an ActorState, it is read from other goroutines, e.g. by the draining engine
+	state int32
 
 	actor   Actor
 	context *Context
 
 	TickInMsgCh  chan TickInMsg
 	TickOutMsgCh chan TickOutMsg
+
+	// supervisor decides what to do when the actor fails
+	supervisor *supervisor
+	// restartRequested is set by a child whose escalated failure restarts the actor, the actor restarts before its next message
+	restartRequested int32
+
+	// retry retries a failed Receive before the supervisor sees the failure, nil means no retry
+	retry *RetryPolicy
+
+	// journal persists the events of an EventSourcedActor, seq is the last applied event
+	journal       Journal
+	seq           uint64
+	snapshotEvery int
+	sinceSnapshot int
+
+	// mailbox is the entry point of a root actor, nil for the other actors
+	mailbox Mailbox
+
+	// joiner buffers the parents' outputs of a JoinActor
+	joiner *joiner
+	// feedsJoin is true if the actor is a JoinActor or on the way to one, it is told about the uids its parents skip
+	feedsJoin bool
+
+	// metrics receives the actor's counters and latencies
+	metrics MetricsSink
+
+	// exporter receives a span per Receive, nil if tracing is off
+	exporter SpanExporter
+}
+
+// PidOption configures the Pid at Spawn time
+type PidOption func(p *Pid)
+
+// WithWaitStrategy sets how the actor waits on an empty inbox, e.g. pkg.NewYieldingWaitStrategy for a hot actor
+// every actor needs its own wait strategy instance
+func WithWaitStrategy(wait pkg.WaitStrategy) PidOption {
+	return func(p *Pid) {
+		p.context.inbox = *NewInBox(p.context.inbox.size, wait)
+	}
+}
+
+// WithInboxSize sets the capacity of the actor's inbox
+func WithInboxSize(size int) PidOption {
+	return func(p *Pid) {
+		p.context.inbox = *NewInBox(size, p.context.inbox.wait)
+	}
+}
+
+// WithStore sets the actor's store, e.g. a FileStore opened with OpenFileStore, a MemoryStore is used if not set
+// the store keeps its state across restarts of the actor, and is closed once the actor is stopped
+func WithStore(store Storer) PidOption {
+	return func(p *Pid) {
+		p.context.store.Close()
+		p.context.store = store
+	}
 }
 
-func NewPid(logger *zap.SugaredLogger, actor Actor) *Pid {
+// WithMailbox sets the mailbox of a root actor, a default mailbox is used if not set
+func WithMailbox(mailbox Mailbox) PidOption {
+	return func(p *Pid) {
+		p.mailbox = mailbox
+	}
+}
+
+func NewPid(logger *zap.SugaredLogger, actor Actor, opts ...PidOption) *Pid {
 	id := uuid.New().String()
 	pid := &Pid{
 		actorName:    actor.String(),
@@ -44,14 +110,19 @@ func NewPid(logger *zap.SugaredLogger, actor Actor) *Pid {
 		logger:       logger,
 		TickInMsgCh:  make(chan TickInMsg, defaultBufferSize),
 		TickOutMsgCh: make(chan TickOutMsg, defaultBufferSize),
-		state:        ActorStateInit,
+		state:        int32(ActorStateInit),
+		supervisor:   newSupervisor(DefaultSupervisorStrategy()),
+		metrics:      nopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(pid)
 	}
 	return pid
 }
 
 func (p *Pid) Stop() {
 	p.context.stop()
-	p.state = ActorStateStopped
+	atomic.StoreInt32(&p.state, int32(ActorStateStopped))
 }
 
 func (p *Pid) String() string {
@@ -61,56 +132,209 @@ func (p *Pid) String() string {
 	return fmt.Sprintf("pid:%s", p.actorName)
 }
 
+// Pending returns the number of messages sent to the actor but not handled yet
+func (p *Pid) Pending() int64 {
+	return atomic.LoadInt64(&p.context.pending)
+}
+
 // State returns the actor's state
 func (p *Pid) State() ActorState {
-	return p.state
+	return ActorState(atomic.LoadInt32(&p.state))
 }
 
-// run is the actor's main loop
+// run is the actor's main loop, it returns after the actor is stopped and PostStop is called
 func (p *Pid) run() {
-	p.state = ActorStateRunning
-	go p.context.buffered()
+	// an actor stopped before it runs stays stopped
+	atomic.CompareAndSwapInt32(&p.state, int32(ActorStateInit), int32(ActorStateRunning))
+	bufferedDone := make(chan struct{})
+	go func() {
+		defer close(bufferedDone)
+		p.context.buffered()
+	}()
+
+	if d, ok := p.actor.(JoinActor); ok && len(p.context.parentActors()) > 0 {
+		p.joiner = newJoiner(d.JoinPolicy(), p.context.parentActors())
+	}
 
-	if d, ok := p.actor.(PreStartHookActor); ok {
+	if err := p.replay(); err != nil {
+		// the state is incomplete, the actor must not receive anything
+		p.logger.Errorw("replay journal, stop actor", "pid", p.String(), "err", err)
+		p.context.stop()
+	} else if d, ok := p.actor.(PreStartHookActor); ok {
 		d.PreStart()
 	}
+
+loop:
 	for {
-		msg, ok := p.context.inbox.Dequeue()
-		if ok {
-			input, ok := msg.(Message)
-			if !ok {
-				continue
-			}
-			p.TickInMsgCh <- NewTickInMsg(input.uid, p.String(), input.data)
-
-			p.logger.Debugw("run", "pid", p.String(), "msg", input)
-			if d, ok := p.actor.(PreHandleMsgHookActor); ok {
-				d.PreHandleMsg(p.context, input)
-			}
-			output, err := p.actor.Receive(p.context, input.data)
-			if err == nil {
-				p.logger.Debugw("run", "pid", p.String(), "output", output)
-				if d, ok := p.actor.(PostHandleMsgHookActor); ok {
-					d.PostHandleMsg(p.context, output)
-				}
-
-				p.TickOutMsgCh <- NewTickOutMsg(input.uid, p.String(), output)
-				p.context.broadcast(WrapMsg(input.uid, output))
-			} else {
-				p.logger.Errorw("run", "pid", p.String(), "err", err)
-				p.TickOutMsgCh <- NewTickOutMsg(input.uid, p.String(), output)
-				if d, ok := p.actor.(ErrHandlerActor); ok {
-					d.ErrHandler(p.context, err)
-				}
-			}
+		select {
+		case <-p.context.stopCh:
+			break loop
+		default:
 		}
 
-		if p.state == ActorStateStopped {
-			break
+		msg, ok := p.context.inbox.Dequeue(p.context.stopCh)
+		if !ok {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&p.restartRequested, 1, 0) {
+			p.restart()
+		}
+		switch m := msg.(type) {
+		case joinTimeout:
+			p.expireJoin(m.uid)
+		case joinSkip:
+			p.skipped(m)
+		case retryAttempt:
+			p.retried(m)
+		default:
+			p.handle(msg)
 		}
 	}
 
+	<-bufferedDone
+	if p.joiner != nil {
+		p.joiner.stop()
+	}
 	if d, ok := p.actor.(PostStopHookActor); ok {
 		d.PostStop()
 	}
+
+	// no more ticks after the actor is stopped
+	close(p.TickInMsgCh)
+	close(p.TickOutMsgCh)
+	p.context.store.Close()
+	if p.journal != nil {
+		if err := p.journal.Close(); err != nil {
+			p.logger.Errorw("close journal", "pid", p.String(), "err", err)
+		}
+	}
+}
+
+// handle handles one message from the inbox
+func (p *Pid) handle(msg any) {
+	defer atomic.AddInt64(&p.context.pending, -1)
+
+	input, ok := msg.(Message)
+	if !ok {
+		p.logger.Warnw("drop invalid message", "pid", p.String(), "msg", msg)
+		p.context.deadLetters.add(p.actorName, Message{data: msg}, DeadLetterInvalid, nil)
+		return
+	}
+	if input.from == "" {
+		// taken from the root actor's mailbox
+		p.context.futures.begin(input.uid)
+		if p.exporter != nil && !input.trace.IsValid() {
+			input.trace = TraceContext{TraceID: newTraceID()}
+		}
+	}
+
+	if p.joiner != nil {
+		joined, ok := p.join(input)
+		if !ok {
+			return
+		}
+		input = joined
+	}
+	p.process(input)
+}
+
+// process calls the actor with the input, and broadcasts the output to the children
+func (p *Pid) process(input Message) {
+	if err := input.expired(time.Now()); err != nil {
+		p.expire(input, err)
+		return
+	}
+
+	in := NewTickInMsg(input.uid, p.String(), input.data)
+	p.TickInMsgCh <- in
+	p.metrics.MessageReceived(p.actorName)
+
+	p.logger.Debugw("run", "pid", p.String(), "msg", input)
+	p.context.receiving(input)
+	if d, ok := p.actor.(PreHandleMsgHookActor); ok {
+		d.PreHandleMsg(p.context, input)
+	}
+	output, err := p.receive(input.data)
+	if err == nil {
+		err = p.persist()
+	}
+	trace := p.span(input, in, err)
+	if err == nil {
+		p.logger.Debugw("run", "pid", p.String(), "output", output)
+		if d, ok := p.actor.(PostHandleMsgHookActor); ok {
+			d.PostHandleMsg(p.context, output)
+		}
+
+		children, data := p.context.route(output)
+		out := NewTickOutMsg(input.uid, p.String(), data, nil)
+		p.TickOutMsgCh <- out
+		p.metrics.MessageSucceeded(p.actorName, time.Duration(out.timestamp-in.timestamp))
+
+		// count the deliveries before broadcasting, the children may handle them right away
+		leaf := len(p.context.childActors()) == 0
+		p.context.futures.handled(input.uid, p.actorName, leaf, data, nil, len(children))
+
+		msg := input.next(p.actorName, data, p.context.outputHeaders())
+		msg.trace = trace
+		p.context.broadcast(msg, children)
+		p.skipJoins(input.uid, children, nil)
+	} else {
+		p.logger.Errorw("run", "pid", p.String(), "err", err)
+		out := NewTickOutMsg(input.uid, p.String(), output, err)
+		p.TickOutMsgCh <- out
+		p.metrics.MessageFailed(p.actorName, time.Duration(out.timestamp-in.timestamp))
+		if p.retry != nil && p.retry.retryable(input, err) {
+			p.context.futures.retried(input.uid)
+			p.scheduleRetry(input, err)
+			return
+		}
+		p.context.futures.handled(input.uid, p.actorName, false, nil, err, 0)
+		p.context.deadLetters.add(p.actorName, input, DeadLetterFailed, err)
+		p.skipJoins(input.uid, nil, err)
+		if d, ok := p.actor.(ErrHandlerActor); ok {
+			d.ErrHandler(p.context, err)
+		}
+		p.supervise(err)
+	}
+}
+
+// expire drops the expired input without calling the actor, it is recorded as timed out in the SinkPool
+func (p *Pid) expire(input Message, err error) {
+	p.logger.Debugw("drop expired message", "pid", p.String(), "uid", input.uid, "err", err)
+	p.TickInMsgCh <- NewTickInMsg(input.uid, p.String(), input.data)
+	p.TickOutMsgCh <- NewTickOutMsg(input.uid, p.String(), nil, err)
+	p.context.futures.handled(input.uid, p.actorName, false, nil, err, 0)
+	p.context.deadLetters.add(p.actorName, input, DeadLetterExpired, err)
+	p.skipJoins(input.uid, nil, err)
+}
+
+// span exports the span of the Receive of the input, and returns the trace context of the output
+func (p *Pid) span(input Message, in TickInMsg, err error) TraceContext {
+	if p.exporter == nil || !input.trace.IsValid() {
+		return input.trace
+	}
+
+	span := Span{
+		TraceID:      input.trace.TraceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: input.trace.SpanID,
+		Links:        input.links,
+		Name:         p.actorName,
+		Uid:          input.uid,
+		Start:        time.Unix(0, in.timestamp),
+		End:          time.Now(),
+		Err:          err,
+	}
+	p.exporter.Export(span)
+	return TraceContext{TraceID: span.TraceID, SpanID: span.SpanID}
+}
+
+// receive calls the actor's Receive, a panic is recovered as a PanicError
+func (p *Pid) receive(data any) (output any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			output, err = nil, &PanicError{Value: r}
+		}
+	}()
+	return p.actor.Receive(p.context, data)
 }
@@ -0,0 +1,541 @@
+package internel
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RemotePid is a root actor of an engine in another process, listening with Engine.Listen on Addr
+type RemotePid struct {
+	Addr string
+	Name string
+}
+
+func (r RemotePid) String() string {
+	return r.Name + "@" + r.Addr
+}
+
+const (
+	defaultRemoteWindow = 256
+	maxFrameSize        = 64 << 20
+
+	frameMessage byte = 1
+	frameAck     byte = 2
+)
+
+// errRemoteClosed is the error of a send on a closed connection
+var errRemoteClosed = errors.New("remote connection is closed")
+
+// RemoteOption configures the remote edges and the listener of an engine
+type RemoteOption func(o *remoteOptions)
+
+type remoteOptions struct {
+	codec  Codec
+	window int
+	// backoff is the wait between the dial attempts
+	backoff RetryPolicy
+}
+
+func newRemoteOptions(opts []RemoteOption) remoteOptions {
+	o := remoteOptions{
+		window:  defaultRemoteWindow,
+		backoff: RetryPolicy{InitialBackoff: 50 * time.Millisecond, MaxBackoff: 5 * time.Second, Jitter: 0.2},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithRemoteCodec sets the codec of the payloads, both ends must use the same one
+// by default it is a JSONCodec of the engine's type registry, see Engine.SetTypeRegistry
+func WithRemoteCodec(codec Codec) RemoteOption {
+	return func(o *remoteOptions) {
+		o.codec = codec
+	}
+}
+
+// WithRemoteWindow sets the max number of messages sent and not acknowledged yet by the remote engine
+// once the window is full, the proxy actor waits, and slows its parents down like a slow local child
+func WithRemoteWindow(n int) RemoteOption {
+	return func(o *remoteOptions) {
+		o.window = n
+	}
+}
+
+// WithReconnectBackoff sets the exponential backoff between the dial attempts, from min up to max
+func WithReconnectBackoff(min, max time.Duration) RemoteOption {
+	return func(o *remoteOptions) {
+		o.backoff.InitialBackoff = min
+		o.backoff.MaxBackoff = max
+	}
+}
+
+// remoteMessage is a message on the wire
+type remoteMessage struct {
+	Seq      uint64            `json:"seq"`
+	Target   string            `json:"target"`
+	Uid      string            `json:"uid"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Created  int64             `json:"created"`
+	Hops     int               `json:"hops"`
+	Deadline int64             `json:"deadline,omitempty"`
+	TraceID  string            `json:"traceId,omitempty"`
+	SpanID   string            `json:"spanId,omitempty"`
+	Data     []byte            `json:"data"`
+}
+
+// remoteAck acknowledges a message once the remote root's mailbox has accepted it, or with the error that rejected it
+type remoteAck struct {
+	Seq uint64 `json:"seq"`
+	Err string `json:"err,omitempty"`
+}
+
+// writeFrame writes the length of the payload as a big endian uint32, the kind of the frame, then the payload
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	frame[4] = kind
+	copy(frame[5:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads one frame written by writeFrame
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// remoteActor is the local proxy of a RemotePid, it forwards what it receives to the remote engine
+// it is a leaf of the local DAG, its output is nil once the message is handed over to the connection
+type remoteActor struct {
+	remote RemotePid
+	conn   *remoteConn
+}
+
+func (r *remoteActor) Receive(ctx *Context, msg any) (any, error) {
+	return nil, r.conn.send(ctx.Context(), ctx.current)
+}
+
+func (r *remoteActor) String() string {
+	return r.remote.String()
+}
+
+// SpawnRemote spawns the local proxy of a remote root actor, add edges to it like to any other actor
+// the messages are delivered at least once, they are sent again after a reconnect until the remote engine acknowledges them
+func (e *Engine[Actor]) SpawnRemote(remote RemotePid, opts ...RemoteOption) (*Pid, error) {
+	proxy := &remoteActor{remote: remote}
+	actor, ok := any(proxy).(Actor)
+	if !ok {
+		return nil, fmt.Errorf("engine does not accept remote actors")
+	}
+	pid, err := e.Spawn(actor)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy.conn = newRemoteConn(e.logger, remote, newRemoteOptions(opts))
+	proxy.conn.onReject = func(msg Message, err error) {
+		e.deadLetters.add(remote.String(), msg, DeadLetterRejected, err)
+	}
+	e.remotes = append(e.remotes, proxy.conn)
+	return pid, nil
+}
+
+// remoteConn is the connection to a remote engine, it reconnects with backoff and sends the unacknowledged messages again
+type remoteConn struct {
+	logger *zap.SugaredLogger
+	remote RemotePid
+	opts   remoteOptions
+
+	// credits holds a token per message in flight, a send waits while it is full
+	credits chan struct{}
+
+	// writeMu serializes the writes to conn in seq order, it is taken before mu, mu guards the rest
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	conn    net.Conn
+	seq     uint64
+	pending map[uint64]remoteFrame
+	// acked is signalled when a message is acknowledged, for flush
+	acked chan struct{}
+
+	onReject func(msg Message, err error)
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// remoteFrame is a message in flight, and its encoding
+type remoteFrame struct {
+	msg     Message
+	payload []byte
+}
+
+func newRemoteConn(logger *zap.SugaredLogger, remote RemotePid, opts remoteOptions) *remoteConn {
+	if opts.window <= 0 {
+		opts.window = defaultRemoteWindow
+	}
+	return &remoteConn{
+		logger:  logger,
+		remote:  remote,
+		opts:    opts,
+		credits: make(chan struct{}, opts.window),
+		pending: make(map[uint64]remoteFrame),
+		acked:   make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// send hands the message over to the connection, it waits for a credit until ctx is done
+func (c *remoteConn) send(ctx context.Context, msg Message) error {
+	c.startOnce.Do(func() {
+		c.wg.Add(1)
+		go c.run()
+	})
+
+	data, err := c.opts.codec.Marshal(msg.data)
+	if err != nil {
+		return Permanent(fmt.Errorf("encode message: %w", err))
+	}
+
+	select {
+	case c.credits <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.stopCh:
+		return errRemoteClosed
+	}
+
+	// the seq is taken and the frame written under writeMu, the frames go out in seq order
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	c.seq++
+	wire := remoteMessage{
+		Seq:     c.seq,
+		Target:  c.remote.Name,
+		Uid:     msg.uid,
+		Headers: msg.headers,
+		Created: msg.created.UnixNano(),
+		Hops:    msg.hops + 1,
+		TraceID: msg.trace.TraceID,
+		SpanID:  msg.trace.SpanID,
+		Data:    data,
+	}
+	if !msg.deadline.IsZero() {
+		wire.Deadline = msg.deadline.UnixNano()
+	}
+	payload, err := json.Marshal(wire)
+	if err != nil {
+		c.mu.Unlock()
+		<-c.credits
+		return Permanent(err)
+	}
+	c.pending[wire.Seq] = remoteFrame{msg: msg, payload: payload}
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn != nil {
+		c.write(conn, payload)
+	}
+	return nil
+}
+
+// write writes a message frame, a failed write closes the connection, the message is sent again after the reconnect
+// must be called with writeMu held
+func (c *remoteConn) write(conn net.Conn, payload []byte) {
+	if err := writeFrame(conn, frameMessage, payload); err != nil {
+		c.logger.Warnw("remote write", "remote", c.remote.String(), "err", err)
+		conn.Close()
+	}
+}
+
+// run dials the remote engine, and reads the acks until the connection breaks, then dials again
+func (c *remoteConn) run() {
+	defer c.wg.Done()
+	for attempt := 0; ; {
+		conn, err := net.Dial("tcp", c.remote.Addr)
+		if err != nil {
+			attempt++
+			c.logger.Debugw("remote dial", "remote", c.remote.String(), "attempt", attempt, "err", err)
+			timer := time.NewTimer(c.opts.backoff.backoff(attempt))
+			select {
+			case <-timer.C:
+				continue
+			case <-c.stopCh:
+				timer.Stop()
+				return
+			}
+		}
+		attempt = 0
+
+		// hold the sends back until the messages in flight are sent again, in order
+		// the connection is installed under writeMu, a send can not write to it before them
+		c.writeMu.Lock()
+		c.mu.Lock()
+		c.conn = conn
+		frames := c.inflight()
+		c.mu.Unlock()
+		for _, frame := range frames {
+			if err := writeFrame(conn, frameMessage, frame.payload); err != nil {
+				conn.Close()
+				break
+			}
+		}
+		c.writeMu.Unlock()
+
+		c.readAcks(conn)
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+
+		select {
+		case <-c.stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// inflight returns the messages not acknowledged yet in send order, must be called with mu held
+func (c *remoteConn) inflight() []remoteFrame {
+	seqs := make([]uint64, 0, len(c.pending))
+	for seq := range c.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	frames := make([]remoteFrame, len(seqs))
+	for i, seq := range seqs {
+		frames[i] = c.pending[seq]
+	}
+	return frames
+}
+
+// readAcks releases the credits of the acknowledged messages until the connection breaks
+func (c *remoteConn) readAcks(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		kind, payload, err := readFrame(r)
+		if err != nil {
+			c.logger.Debugw("remote read", "remote", c.remote.String(), "err", err)
+			return
+		}
+		var ack remoteAck
+		if kind != frameAck || json.Unmarshal(payload, &ack) != nil {
+			c.logger.Warnw("remote sent an invalid frame", "remote", c.remote.String(), "kind", kind)
+			return
+		}
+
+		c.mu.Lock()
+		frame, ok := c.pending[ack.Seq]
+		delete(c.pending, ack.Seq)
+		c.mu.Unlock()
+		if !ok {
+			// a message sent again after a reconnect is acknowledged twice
+			continue
+		}
+		<-c.credits
+		select {
+		case c.acked <- struct{}{}:
+		default:
+		}
+		if ack.Err != "" && c.onReject != nil {
+			c.onReject(frame.msg, fmt.Errorf("remote %s: %s", c.remote.String(), ack.Err))
+		}
+	}
+}
+
+// flush waits until the remote engine has acknowledged every message, or ctx is done
+func (c *remoteConn) flush(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		n := len(c.pending)
+		c.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.acked:
+		}
+	}
+}
+
+// close stops reconnecting, the messages not acknowledged yet are dropped
+func (c *remoteConn) close() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		if len(c.pending) > 0 {
+			c.logger.Warnw("remote connection closed with messages in flight", "remote", c.remote.String(), "pending", len(c.pending))
+		}
+		c.mu.Unlock()
+	})
+	c.wg.Wait()
+}
+
+// remoteListener accepts the connections of the remote engines
+type remoteListener struct {
+	listener net.Listener
+	codec    Codec
+	backoff  RetryPolicy
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Listen accepts the messages of remote engines on addr, e.g. ":7000", they are sent to the root actor they name
+// a root whose mailbox is full stops the reading of the connection, so the remote senders slow down
+// it must be called after Ready, it returns the address it listens on, e.g. with the port chosen for ":0"
+func (e *Engine[Actor]) Listen(addr string, opts ...RemoteOption) (net.Addr, error) {
+	if !e.isReady {
+		return nil, fmt.Errorf("engine is not ready")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	o := newRemoteOptions(opts)
+	if o.codec == nil {
+		o.codec = NewJSONCodec(e.types)
+	}
+	l := &remoteListener{
+		listener: listener,
+		codec:    o.codec,
+		backoff:  RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 100 * time.Millisecond},
+		conns:    make(map[net.Conn]struct{}),
+		stopCh:   make(chan struct{}),
+	}
+	e.listeners = append(e.listeners, l)
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			l.mu.Lock()
+			l.conns[conn] = struct{}{}
+			l.mu.Unlock()
+
+			l.wg.Add(1)
+			go func() {
+				defer l.wg.Done()
+				e.serveRemote(l, conn)
+				l.mu.Lock()
+				delete(l.conns, conn)
+				l.mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// serveRemote delivers the messages of a connection in order, and acknowledges each one
+func (e *Engine[Actor]) serveRemote(l *remoteListener, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		kind, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		var wire remoteMessage
+		if kind != frameMessage || json.Unmarshal(payload, &wire) != nil {
+			e.logger.Warnw("remote sent an invalid frame", "remote", conn.RemoteAddr().String(), "kind", kind)
+			return
+		}
+
+		ack := remoteAck{Seq: wire.Seq}
+		if err := e.deliverRemote(l, wire); err != nil {
+			ack.Err = err.Error()
+		}
+		payload, _ = json.Marshal(ack)
+		if err := writeFrame(conn, frameAck, payload); err != nil {
+			return
+		}
+	}
+}
+
+// deliverRemote sends the message to the root actor, it waits while the root's mailbox is busy
+func (e *Engine[Actor]) deliverRemote(l *remoteListener, wire remoteMessage) error {
+	data, err := l.codec.Unmarshal(wire.Data)
+	if err != nil {
+		return fmt.Errorf("decode message: %w", err)
+	}
+	root, err := e.rootByName(wire.Target)
+	if err != nil {
+		return err
+	}
+
+	msg := WrapMsg(wire.Uid, data)
+	msg.headers = wire.Headers
+	msg.created = time.Unix(0, wire.Created)
+	msg.hops = wire.Hops
+	msg.trace = TraceContext{TraceID: wire.TraceID, SpanID: wire.SpanID}
+	if wire.Deadline != 0 {
+		msg.deadline = time.Unix(0, wire.Deadline)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := e.enqueue(context.Background(), root, msg)
+		if !errors.Is(err, ErrBusy) {
+			return err
+		}
+		timer := time.NewTimer(l.backoff.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-l.stopCh:
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// close stops accepting, and closes the connections
+func (l *remoteListener) close() {
+	close(l.stopCh)
+	l.listener.Close()
+	l.mu.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+}
@@ -0,0 +1,212 @@
+package internel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newRemoteSink returns a ready engine with a Tenant root listening on loopback
+func newRemoteSink(t *testing.T, name string, addr string) (*Engine[Actor], *Tenant, net.Addr) {
+	sink := newTenant(name, "")
+	engine := NewEngine()
+	_, err := engine.Spawn(sink)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	listenAddr, err := engine.Listen(addr)
+	assert.Nil(t, err)
+	return engine, sink, listenAddr
+}
+
+// newRemoteSource returns a ready engine whose Echo root sends its output to the remote actor
+func newRemoteSource(t *testing.T, remote RemotePid, opts ...RemoteOption) *Engine[Actor] {
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	proxy, err := engine.SpawnRemote(remote, opts...)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, proxy))
+	assert.Nil(t, engine.Ready())
+	return engine
+}
+
+func TestEngine_Remote(t *testing.T) {
+	server, sink, addr := newRemoteSink(t, "sink", "127.0.0.1:0")
+	defer server.Shutdown(context.Background())
+	remote := RemotePid{Addr: addr.String(), Name: "sink"}
+	client := newRemoteSource(t, remote)
+
+	deadline := time.Now().Add(time.Minute)
+	outputs, err := client.SendAndWait(context.Background(), Envelope{
+		Uid:      "order-1",
+		Headers:  map[string]string{"tenant": "acme"},
+		Deadline: deadline,
+		Data:     "order",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{remote.String(): nil}, outputs)
+
+	envelope := <-sink.envelopes
+	assert.Equal(t, "order-1", envelope.Uid)
+	assert.Equal(t, "src(order)", envelope.Data)
+	assert.Equal(t, map[string]string{"tenant": "acme"}, envelope.Headers)
+	assert.Equal(t, 2, envelope.Hops)
+	assert.True(t, envelope.Deadline.Equal(deadline))
+
+	// an unknown remote actor rejects the messages, they end up in the sender's dead letters
+	unknown := newRemoteSource(t, RemotePid{Addr: addr.String(), Name: "nobody"})
+	assert.Nil(t, unknown.Send("order"))
+	assert.Nil(t, unknown.Shutdown(context.Background()))
+	letters := unknown.DeadLetters().Query(nil)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, DeadLetterRejected, letters[0].Reason)
+	assert.True(t, strings.Contains(letters[0].Err.Error(), "nobody not found"))
+
+	assert.Nil(t, client.Shutdown(context.Background()))
+}
+
+func TestEngine_RemoteReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	assert.Nil(t, listener.Close())
+
+	client := newRemoteSource(t, RemotePid{Addr: addr, Name: "sink"}, WithReconnectBackoff(time.Millisecond, 10*time.Millisecond))
+	for _, msg := range []string{"a", "b"} {
+		assert.Nil(t, client.Send(msg))
+	}
+
+	// the messages sent while the remote engine was down are delivered once it is up
+	server, sink, _ := newRemoteSink(t, "sink", addr)
+	for _, want := range []string{"src(a)", "src(b)"} {
+		assert.Equal(t, want, (<-sink.envelopes).Data)
+	}
+	assert.Nil(t, client.Shutdown(context.Background()))
+	assert.Nil(t, server.Shutdown(context.Background()))
+}
+
+func TestRemoteConn_Window(t *testing.T) {
+	engine := NewEngine()
+	conn := newRemoteConn(engine.logger, RemotePid{Addr: "127.0.0.1:1", Name: "sink"}, newRemoteOptions([]RemoteOption{WithRemoteWindow(2), WithRemoteCodec(NewJSONCodec(nil))}))
+	defer conn.close()
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, conn.send(context.Background(), WrapMsg("", i)))
+	}
+	// the window is full until the remote engine acknowledges a message
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, conn.send(ctx, WrapMsg("", 2)))
+}
+
+func TestRemoteConn_ResendOrder(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	// every connection reports the seqs it reads in order, the first one breaks after 10 frames without an ack
+	received := make(chan []uint64, 2)
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, first bool) {
+				var seqs []uint64
+				defer func() {
+					conn.Close()
+					received <- seqs
+				}()
+				r := bufio.NewReader(conn)
+				for !first || len(seqs) < 10 {
+					_, payload, err := readFrame(r)
+					if err != nil {
+						return
+					}
+					var wire remoteMessage
+					assert.Nil(t, json.Unmarshal(payload, &wire))
+					seqs = append(seqs, wire.Seq)
+					if !first {
+						ack, _ := json.Marshal(remoteAck{Seq: wire.Seq})
+						assert.Nil(t, writeFrame(conn, frameAck, ack))
+					}
+				}
+			}(conn, first)
+		}
+	}()
+
+	engine := NewEngine()
+	conn := newRemoteConn(engine.logger, RemotePid{Addr: listener.Addr().String(), Name: "sink"}, newRemoteOptions([]RemoteOption{
+		WithRemoteCodec(NewJSONCodec(nil)),
+		WithReconnectBackoff(time.Millisecond, 10*time.Millisecond),
+	}))
+
+	// the senders race with the reconnect, the new connection still reads the seqs in order
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.Nil(t, conn.send(context.Background(), WrapMsg("", j)))
+			}
+		}()
+	}
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, conn.flush(ctx))
+	conn.close()
+
+	assert.Len(t, <-received, 10)
+	seqs := <-received
+	want := make([]uint64, 200)
+	for i := range want {
+		want[i] = uint64(i + 1)
+	}
+	assert.Equal(t, want, seqs)
+}
+
+func TestEngine_RemoteShutdownTimeout(t *testing.T) {
+	// the remote engine accepts the connection and never acknowledges
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	remote, err := engine.SpawnRemote(RemotePid{Addr: listener.Addr().String(), Name: "sink"})
+	assert.Nil(t, err)
+	sleeper, err := engine.Spawn(&Sleeper{name: "sleeper", delay: 300 * time.Millisecond})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, remote))
+	assert.Nil(t, engine.AddEdge(src, sleeper))
+	assert.Nil(t, engine.Ready())
+	assert.Nil(t, engine.Send("hello"))
+	conn := <-accepted
+	defer conn.Close()
+
+	// the drain of sleeper times out, the connection is closed anyway
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, engine.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = io.Copy(io.Discard, conn)
+	assert.Nil(t, err)
+}
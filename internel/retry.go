@@ -0,0 +1,155 @@
+package internel
+
+import (
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy retries a failed Receive before the failure reaches the ErrHandlerActor, the supervisor and the dead letters
+// a retry is rescheduled onto the actor's inbox after the backoff, the actor keeps receiving the other messages meanwhile
+type RetryPolicy struct {
+	// MaxAttempts is the max number of Receive calls of a message, including the first one
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, it grows by Multiplier after every retry, up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Multiplier is 2 if not set
+	Multiplier float64
+
+	// Jitter randomizes every backoff by up to ±Jitter of it, between 0 and 1
+	Jitter float64
+
+	// Retryable decides whether the error is worth a retry, every error is if nil
+	// an error implementing RetryableError, e.g. Permanent, decides for itself first
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy retries 3 times, from 100ms up to 10s with 20% jitter
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// WithRetry sets the retry policy of the actor
+func WithRetry(policy RetryPolicy) PidOption {
+	return func(p *Pid) {
+		p.retry = &policy
+	}
+}
+
+// RetryableError is an error that tells whether it is worth a retry
+type RetryableError interface {
+	error
+	Retryable() bool
+}
+
+// Permanent wraps an error that must not be retried, e.g. a validation error
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func (e *permanentError) Retryable() bool {
+	return false
+}
+
+// RetryOn returns a Retryable that retries the errors matching one of targets with errors.Is
+func RetryOn(targets ...error) func(err error) bool {
+	return func(err error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// retryable reports whether the failed attempt of the message is retried
+func (r *RetryPolicy) retryable(msg Message, err error) bool {
+	if msg.attempt+1 >= r.MaxAttempts {
+		return false
+	}
+	if msg.expired(time.Now()) != nil {
+		return false
+	}
+	var re RetryableError
+	if errors.As(err, &re) {
+		return re.Retryable()
+	}
+	if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+	return true
+}
+
+// backoff returns the wait before the retry that follows the given number of failed attempts
+func (r *RetryPolicy) backoff(failed int) time.Duration {
+	multiplier := r.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	backoff := float64(r.InitialBackoff)
+	for i := 1; i < failed; i++ {
+		backoff *= multiplier
+		if r.MaxBackoff > 0 && backoff >= float64(r.MaxBackoff) {
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && backoff > float64(r.MaxBackoff) {
+		backoff = float64(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		backoff += backoff * r.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// retryAttempt is a failed message queued again in the actor's inbox
+type retryAttempt struct {
+	msg Message
+}
+
+// scheduleRetry queues the failed input in the actor's inbox once the backoff is over
+// the input stays pending, so a draining engine waits for the retry
+func (p *Pid) scheduleRetry(input Message, err error) {
+	input.attempt++
+	backoff := p.retry.backoff(input.attempt)
+	p.logger.Warnw("retry", "pid", p.String(), "uid", input.uid, "attempt", input.attempt, "backoff", backoff, "err", err)
+
+	atomic.AddInt64(&p.context.pending, 1)
+	time.AfterFunc(backoff, func() {
+		if p.context.inbox.EnqueueWait(retryAttempt{msg: input}, p.context.stopCh) {
+			return
+		}
+		atomic.AddInt64(&p.context.pending, -1)
+		p.context.futures.dropped(input.uid)
+		p.context.deadLetters.add(p.actorName, input, DeadLetterStopped, err)
+	})
+}
+
+// retried handles a retry taken from the inbox
+func (p *Pid) retried(r retryAttempt) {
+	defer atomic.AddInt64(&p.context.pending, -1)
+	p.process(r.msg)
+}
@@ -0,0 +1,116 @@
+package internel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New("backend unavailable")
+
+// Enricher fails every message until it has been received failures[msg] times
+type Enricher struct {
+	mu       sync.Mutex
+	failures map[any]int
+	attempts map[any][]int
+	received chan any
+	errors   int
+}
+
+func (e *Enricher) Receive(ctx *Context, msg any) (any, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attempts[msg] = append(e.attempts[msg], ctx.Envelope().Attempt)
+	if e.failures[msg] > 0 {
+		e.failures[msg]--
+		if msg == "invalid" {
+			return nil, Permanent(fmt.Errorf("invalid order"))
+		}
+		return nil, errUnavailable
+	}
+	e.received <- msg
+	return msg, nil
+}
+
+func (e *Enricher) ErrHandler(ctx *Context, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errors++
+}
+
+func (e *Enricher) String() string {
+	return "enricher"
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	var backoffs []time.Duration
+	for failed := 1; failed <= 4; failed++ {
+		backoffs = append(backoffs, policy.backoff(failed))
+	}
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}, backoffs)
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(2)
+		assert.True(t, backoff >= 10*time.Millisecond && backoff <= 30*time.Millisecond, backoff)
+	}
+}
+
+func TestRetryPolicy_Retryable(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 2, Retryable: RetryOn(errUnavailable)}
+	assert.True(t, policy.retryable(Message{}, fmt.Errorf("enrich: %w", errUnavailable)))
+	assert.False(t, policy.retryable(Message{}, fmt.Errorf("boom")))
+	assert.False(t, policy.retryable(Message{}, Permanent(errUnavailable)))
+	assert.False(t, policy.retryable(Message{attempt: 1}, errUnavailable))
+	assert.False(t, policy.retryable(Message{deadline: time.Now()}, errUnavailable))
+}
+
+func TestEngine_Retry(t *testing.T) {
+	enricher := &Enricher{
+		failures: map[any]int{"slow": 2, "lost": 5, "invalid": 1},
+		attempts: make(map[any][]int),
+		received: make(chan any, 10),
+	}
+	engine := NewEngine()
+	_, err := engine.Spawn(enricher, WithRetry(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 20 * time.Millisecond,
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	slow, err := engine.Ask(ctx, "slow")
+	assert.Nil(t, err)
+	fast, err := engine.Ask(ctx, "fast")
+	assert.Nil(t, err)
+
+	// the retries of slow do not hold fast back
+	assert.Equal(t, "fast", <-enricher.received)
+	_, err = fast.Result()
+	assert.Nil(t, err)
+	outputs, err := slow.Result()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"enricher": "slow"}, outputs)
+
+	_, err = engine.SendAndWait(ctx, "lost")
+	assert.ErrorIs(t, err, errUnavailable)
+	_, err = engine.SendAndWait(ctx, "invalid")
+	assert.NotNil(t, err)
+
+	enricher.mu.Lock()
+	defer enricher.mu.Unlock()
+	assert.Equal(t, []int{1, 2, 3}, enricher.attempts["slow"])
+	assert.Equal(t, []int{1, 2, 3}, enricher.attempts["lost"])
+	assert.Equal(t, []int{1}, enricher.attempts["invalid"])
+	// only the final failures reach the error handler and the dead letters
+	assert.Equal(t, 2, enricher.errors)
+	assert.Equal(t, 2, engine.DeadLetters().Len())
+}
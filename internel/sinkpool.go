@@ -1,8 +1,12 @@
 package internel
 
 import (
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/fzft/my-actor/pkg"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +26,23 @@ func NewTickInMsg(uid string, pid string, input any) TickInMsg {
 	}
 }
 
+func (t TickInMsg) Uid() string {
+	return t.uid
+}
+
+// Pid returns the String() of the actor's pid, e.g. pid:enrich
+func (t TickInMsg) Pid() string {
+	return t.pid
+}
+
+func (t TickInMsg) Input() any {
+	return t.input
+}
+
+func (t TickInMsg) Time() time.Time {
+	return time.Unix(0, t.timestamp)
+}
+
 func (t TickInMsg) String() string {
 	return fmt.Sprintf("uid %s, pid %s, input %v, timestamp %d", t.uid, t.pid, t.input, t.timestamp)
 }
@@ -30,18 +51,47 @@ type TickOutMsg struct {
 	uid       string
 	pid       string
 	output    any
+	err       error
 	timestamp int64
 }
 
+func (t TickOutMsg) Uid() string {
+	return t.uid
+}
+
+// Pid returns the String() of the actor's pid, e.g. pid:enrich
+func (t TickOutMsg) Pid() string {
+	return t.pid
+}
+
+func (t TickOutMsg) Output() any {
+	return t.output
+}
+
+// Err returns the error of the actor, nil if it succeeded
+func (t TickOutMsg) Err() error {
+	return t.err
+}
+
+// TimedOut reports whether the message expired before the actor received it
+func (t TickOutMsg) TimedOut() bool {
+	return errors.Is(t.err, ErrMessageExpired)
+}
+
+func (t TickOutMsg) Time() time.Time {
+	return time.Unix(0, t.timestamp)
+}
+
 func (t TickOutMsg) String() string {
-	return fmt.Sprintf("uid %s, pid %s, output %v, timestamp %d", t.uid, t.pid, t.output, t.timestamp)
+	return fmt.Sprintf("uid %s, pid %s, output %v, err %v, timestamp %d", t.uid, t.pid, t.output, t.err, t.timestamp)
 }
 
-func NewTickOutMsg(uid string, pid string, output any) TickOutMsg {
+func NewTickOutMsg(uid string, pid string, output any, err error) TickOutMsg {
 	return TickOutMsg{
 		uid:       uid,
 		pid:       pid,
 		output:    output,
+		err:       err,
 		timestamp: time.Now().UnixNano(),
 	}
 }
@@ -51,14 +101,47 @@ type SinkResult struct {
 	uid string
 	in  []TickInMsg
 	out []TickOutMsg
+
+	created time.Time
+	// inTicks and outTicks are the number of ticks put into the pool, kept or not
+	inTicks  int
+	outTicks int
 }
 
 func NewSinkResult(uid string) *SinkResult {
 	return &SinkResult{
-		uid: uid,
+		uid:     uid,
+		created: time.Now(),
 	}
 }
 
+func (s SinkResult) Uid() string {
+	return s.uid
+}
+
+// In returns the ticks of the actors that received the message, in arrival order
+func (s SinkResult) In() []TickInMsg {
+	return s.in
+}
+
+// Out returns the ticks of the actors that handled the message, in arrival order
+func (s SinkResult) Out() []TickOutMsg {
+	return s.out
+}
+
+// Created returns when the first tick of the message is put into the pool
+func (s SinkResult) Created() time.Time {
+	return s.created
+}
+
+// clone copies the result, so it can be read while the pool keeps adding ticks
+func (s *SinkResult) clone() SinkResult {
+	c := *s
+	c.in = append([]TickInMsg(nil), s.in...)
+	c.out = append([]TickOutMsg(nil), s.out...)
+	return c
+}
+
 // String
 func (s *SinkResult) String() string {
 	return fmt.Sprintf("uid: %s; in: %v; out: %v", s.uid, s.in, s.out)
@@ -72,54 +155,585 @@ func (s *SinkResult) AddOutMsg(msg TickOutMsg) {
 	s.out = append(s.out, msg)
 }
 
+// EvictionPolicy decides which result is evicted when the SinkPool is full
+type EvictionPolicy int
+
+const (
+	// EvictFIFO evicts the result created first
+	EvictFIFO EvictionPolicy = iota
+	// EvictLRU evicts the result put or read least recently
+	EvictLRU
+)
+
+// EvictReason is why a result is evicted from the SinkPool
+type EvictReason int
+
+const (
+	// EvictedCapacity the pool is full
+	EvictedCapacity EvictReason = iota
+	// EvictedExpired the result has outlived the TTL
+	EvictedExpired
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictedCapacity:
+		return "capacity"
+	case EvictedExpired:
+		return "expired"
+	default:
+		return fmt.Sprintf("EvictReason(%d)", int(r))
+	}
+}
+
+// SinkPoolOption configures the retention of the SinkPool, by default every result is kept until PopAll
+type SinkPoolOption func(s *SinkPool)
+
+// WithMaxEntries keeps at most max results, the policy decides which one is evicted
+func WithMaxEntries(max int, policy EvictionPolicy) SinkPoolOption {
+	return func(s *SinkPool) {
+		s.maxEntries = max
+		s.policy = policy
+	}
+}
+
+// WithTTL evicts a result ttl after its first tick
+func WithTTL(ttl time.Duration) SinkPoolOption {
+	return func(s *SinkPool) {
+		s.ttl = ttl
+	}
+}
+
+// WithLeafOnly keeps only the out ticks of the leaf actors and the failed out ticks, instead of every tick
+func WithLeafOnly() SinkPoolOption {
+	return func(s *SinkPool) {
+		s.leafOnly = true
+	}
+}
+
+// WithEvictHandler hands every evicted result to fn, e.g. to archive it
+// fn is called without holding the pool, it may read the pool
+func WithEvictHandler(fn func(result SinkResult, reason EvictReason)) SinkPoolOption {
+	return func(s *SinkPool) {
+		s.onEvict = fn
+	}
+}
+
+// defaultStreamBuffer is the number of results a reader of Stream may fall behind by default
+const defaultStreamBuffer = 1024
+
+// WithStreamBuffer buffers at most n results for every reader of Stream, the oldest one is dropped when a reader falls behind
+// the dropped results are counted, see StreamDropped, 0 buffers them all, by default it is defaultStreamBuffer
+func WithStreamBuffer(n int) SinkPoolOption {
+	return func(s *SinkPool) {
+		s.streamBuffer = n
+	}
+}
+
+// WithBackend persists every completed result to backend, e.g. a FileSink
+// the results are appended in the background, the backend is closed when the pool is closed
+// the results waiting for a slow backend are all buffered, none is dropped before it is persisted
+func WithBackend(backend SinkBackend) SinkPoolOption {
+	return func(s *SinkPool) {
+		s.backend = backend
+	}
+}
+
 // SinkPool is a storage for SinkResult that are returned by LocalActor
+// results are indexed by message uid and by actor pid
 type SinkPool struct {
-	pool *pkg.KeyValueStore[string, *SinkResult]
+	mu      sync.Mutex
+	results map[string]*list.Element       // uid -> element of order
+	byPid   map[string]map[string]struct{} // pid -> uids
+
+	// order is the results in eviction order, the front is evicted first
+	order *list.List
+
+	// expected is the number of in and out ticks of a uid that has gone through the DAG, it is streamed once they all arrive
+	expected map[string]int
+
+	// retention
+	maxEntries int
+	policy     EvictionPolicy
+	ttl        time.Duration
+	leafOnly   bool
+	leaves     map[string]bool // pid -> is a leaf actor
+	onEvict    func(result SinkResult, reason EvictReason)
+	evicted    uint64
+
+	// backend persists the completed results, backendDone is closed once it is closed
+	backend     SinkBackend
+	backendErr  error
+	backendDone chan struct{}
+
+	// streamBuffer is the capacity of every Stream, streamDropped counts the results dropped from them
+	streamBuffer  int
+	streamDropped uint64
+
+	streams []*sinkStream
+	done    chan struct{}
+	closed  bool
+}
+
+func NewSinkPool(opts ...SinkPoolOption) *SinkPool {
+	s := &SinkPool{
+		results:  make(map[string]*list.Element),
+		byPid:    make(map[string]map[string]struct{}),
+		order:    list.New(),
+		expected: make(map[string]int),
+		leaves:   make(map[string]bool),
+		done:     make(chan struct{}),
+
+		streamBuffer: defaultStreamBuffer,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.ttl > 0 {
+		go s.expireLoop()
+	}
+	if s.backend != nil {
+		stream := &sinkStream{
+			ch:     make(chan SinkResult),
+			notify: make(chan struct{}, 1),
+		}
+		s.streams = append(s.streams, stream)
+		s.backendDone = make(chan struct{})
+		go stream.pump(context.Background(), s.done)
+		go s.persist(stream.ch)
+	}
+	return s
+}
+
+// persist appends the completed results to the backend until the pool is closed
+func (s *SinkPool) persist(results <-chan SinkResult) {
+	defer close(s.backendDone)
+	for result := range results {
+		if err := s.backend.Append(result); err != nil {
+			s.setBackendErr(err)
+		}
+	}
+	if err := s.backend.Close(); err != nil {
+		s.setBackendErr(err)
+	}
+}
+
+func (s *SinkPool) setBackendErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backendErr == nil {
+		s.backendErr = err
+	}
+}
+
+// BackendErr returns the first error of the backend, the results that failed to append are only in the pool
+func (s *SinkPool) BackendErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backendErr
+}
+
+// Len returns the number of results in the pool
+func (s *SinkPool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.results)
+}
+
+// Evicted returns the number of results evicted since the pool is created
+func (s *SinkPool) Evicted() uint64 {
+	return atomic.LoadUint64(&s.evicted)
+}
+
+// StreamDropped returns the number of results dropped from the readers of Stream that fell behind, since the pool is created
+func (s *SinkPool) StreamDropped() uint64 {
+	return atomic.LoadUint64(&s.streamDropped)
+}
+
+// GetByPid returns the results of the messages the actor has received or handled, pid is the Pid's String()
+func (s *SinkPool) GetByPid(pid string) []SinkResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]SinkResult, 0, len(s.byPid[pid]))
+	for uid := range s.byPid[pid] {
+		if result, ok := s.get(uid); ok {
+			results = append(results, result.clone())
+		}
+	}
+	return results
 }
 
-func NewSinkPool() *SinkPool {
-	return &SinkPool{pool: pkg.NewKeyValueStore[string, *SinkResult]()}
+// GetByMsg returns the result of the message uid
+func (s *SinkPool) GetByMsg(uid string) (SinkResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.get(uid)
+	if !ok {
+		return SinkResult{}, false
+	}
+	return result.clone(), true
 }
 
-// GetByPid returns a SinkResult by pid
-func (s *SinkPool) GetByPid(pid string) []*SinkResult {
+// Query returns the results that match
+func (s *SinkPool) Query(match func(result SinkResult) bool) []SinkResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return nil
+	var results []SinkResult
+	for uid := range s.results {
+		result, ok := s.get(uid)
+		if !ok {
+			continue
+		}
+		if c := result.clone(); match(c) {
+			results = append(results, c)
+		}
+	}
+	return results
 }
 
-// GetByMsg returns a SinkResult by msg
-func (s *SinkPool) GetByMsg(msg any) []*SinkResult {
-	// TODO: implement me
-	return nil
+// Stream returns a stream of SinkResult, a result is emitted once its message has gone through every path of the DAG
+// the stream is closed when ctx is done, or the pool is closed and the emitted results are read
+// ticks that arrive after the result is emitted, e.g. of a partial join, are only in the pool
+// a reader that falls behind loses the oldest results, see WithStreamBuffer
+func (s *SinkPool) Stream(ctx context.Context) <-chan SinkResult {
+	stream := &sinkStream{
+		ch:       make(chan SinkResult),
+		notify:   make(chan struct{}, 1),
+		capacity: s.streamBuffer,
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		close(stream.ch)
+		return stream.ch
+	}
+	s.streams = append(s.streams, stream)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.unsubscribe(stream)
+		stream.pump(ctx, s.done)
+	}()
+	return stream.ch
 }
 
-// Stream returns a stream of SinkResult
-func (s *SinkPool) Stream() <-chan SinkResult {
-	// TODO: implement me
-	return nil
+func (s *SinkPool) unsubscribe(stream *sinkStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, st := range s.streams {
+		if st == stream {
+			s.streams = append(s.streams[:i], s.streams[i+1:]...)
+			break
+		}
+	}
 }
 
 // PutInMsg puts a tick into the pool, if sinkResult not exists, create a new one
 func (s *SinkPool) PutInMsg(key string, tick TickInMsg) {
-	sinkResult, ok := s.pool.Get(key)
-	if !ok {
-		sinkResult = NewSinkResult(key)
-		s.pool.Put(key, sinkResult)
+	s.mu.Lock()
+	result, evicted := s.result(key)
+	result.inTicks++
+	if !s.leafOnly {
+		result.AddInMsg(tick)
+		s.index(key, tick.pid)
 	}
-	sinkResult.AddInMsg(tick)
+	s.emitIfComplete(key)
+	s.mu.Unlock()
+
+	s.evict(evicted, EvictedCapacity)
 }
 
 // PutOutMsg puts a tick into the pool, if sinkResult not exists, create a new one
 func (s *SinkPool) PutOutMsg(key string, tick TickOutMsg) {
-	sinkResult, ok := s.pool.Get(key)
+	s.mu.Lock()
+	result, evicted := s.result(key)
+	result.outTicks++
+	if !s.leafOnly || s.leaves[tick.pid] || tick.err != nil {
+		result.AddOutMsg(tick)
+		s.index(key, tick.pid)
+	}
+	s.emitIfComplete(key)
+	s.mu.Unlock()
+
+	s.evict(evicted, EvictedCapacity)
+}
+
+// setLeaves sets the pids of the leaf actors, the pool keeps their ticks if it is leaf only
+func (s *SinkPool) setLeaves(pids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pid := range pids {
+		s.leaves[pid] = true
+	}
+}
+
+// complete records that the uid has gone through the DAG, handled ticks times
+// the ticks may not have reached the pool yet, the result is created to wait for them
+func (s *SinkPool) complete(uid string, ticks int) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	_, evicted := s.result(uid)
+	s.expected[uid] = ticks
+	s.emitIfComplete(uid)
+	s.mu.Unlock()
+
+	s.evict(evicted, EvictedCapacity)
+}
+
+// get returns the result of the uid, and marks it used, must be called with mu held
+func (s *SinkPool) get(uid string) (*SinkResult, bool) {
+	elem, ok := s.results[uid]
+	if !ok {
+		return nil, false
+	}
+	result := elem.Value.(*SinkResult)
+	if s.expired(result, time.Now()) {
+		// the expire loop evicts it
+		return nil, false
+	}
+	if s.policy == EvictLRU {
+		s.order.MoveToBack(elem)
+	}
+	return result, true
+}
+
+// result returns the result of the uid, creating it may evict the first result if the pool is full
+// must be called with mu held
+func (s *SinkPool) result(uid string) (*SinkResult, []*SinkResult) {
+	if elem, ok := s.results[uid]; ok {
+		if s.policy == EvictLRU {
+			s.order.MoveToBack(elem)
+		}
+		return elem.Value.(*SinkResult), nil
+	}
+
+	var evicted []*SinkResult
+	for s.maxEntries > 0 && len(s.results) >= s.maxEntries {
+		evicted = append(evicted, s.remove(s.order.Front()))
+	}
+	result := NewSinkResult(uid)
+	s.results[uid] = s.order.PushBack(result)
+	return result, evicted
+}
+
+// index indexes the uid by the pid, must be called with mu held
+func (s *SinkPool) index(uid string, pid string) {
+	uids, ok := s.byPid[pid]
+	if !ok {
+		uids = make(map[string]struct{})
+		s.byPid[pid] = uids
+	}
+	uids[uid] = struct{}{}
+}
+
+// remove removes the result and its indexes, must be called with mu held
+func (s *SinkPool) remove(elem *list.Element) *SinkResult {
+	result := s.order.Remove(elem).(*SinkResult)
+	delete(s.results, result.uid)
+	delete(s.expected, result.uid)
+	unindex := func(pid string) {
+		if uids, ok := s.byPid[pid]; ok {
+			delete(uids, result.uid)
+			if len(uids) == 0 {
+				delete(s.byPid, pid)
+			}
+		}
+	}
+	for _, tick := range result.in {
+		unindex(tick.pid)
+	}
+	for _, tick := range result.out {
+		unindex(tick.pid)
+	}
+	return result
+}
+
+// evict counts the evicted results and hands them to the evict handler, must be called without mu held
+func (s *SinkPool) evict(results []*SinkResult, reason EvictReason) {
+	if len(results) == 0 {
+		return
+	}
+	atomic.AddUint64(&s.evicted, uint64(len(results)))
+	if s.onEvict == nil {
+		return
+	}
+	for _, result := range results {
+		s.onEvict(result.clone(), reason)
+	}
+}
+
+func (s *SinkPool) expired(result *SinkResult, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(result.created) >= s.ttl
+}
+
+// expireLoop evicts the expired results until the pool is closed
+func (s *SinkPool) expireLoop() {
+	interval := s.ttl / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.evict(s.removeExpired(now), EvictedExpired)
+		}
+	}
+}
+
+func (s *SinkPool) removeExpired(now time.Time) []*SinkResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*SinkResult
+	for elem := s.order.Front(); elem != nil; {
+		next := elem.Next()
+		if s.expired(elem.Value.(*SinkResult), now) {
+			expired = append(expired, s.remove(elem))
+		}
+		elem = next
+	}
+	return expired
+}
+
+// emitIfComplete streams the result once all its ticks have arrived, must be called with mu held
+func (s *SinkPool) emitIfComplete(uid string) {
+	ticks, ok := s.expected[uid]
 	if !ok {
-		sinkResult = NewSinkResult(key)
-		s.pool.Put(key, sinkResult)
+		return
+	}
+	elem, ok := s.results[uid]
+	if !ok {
+		return
+	}
+	// the in and out ticks of an actor arrive on different channels
+	if result := elem.Value.(*SinkResult); result.inTicks < ticks || result.outTicks < ticks {
+		return
+	}
+	delete(s.expected, uid)
+
+	c := elem.Value.(*SinkResult).clone()
+	for _, stream := range s.streams {
+		if !stream.push(c) {
+			atomic.AddUint64(&s.streamDropped, 1)
+		}
+	}
+}
+
+// Close releases the pool, results should be read before the engine is shut down
+// it returns once the completed results are persisted to the backend
+func (s *SinkPool) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	if s.backendDone != nil {
+		<-s.backendDone
 	}
-	sinkResult.AddOutMsg(tick)
 }
 
 // PopAll returns all SinkResult in the pool
 func (s *SinkPool) PopAll() []*SinkResult {
-	return s.pool.PopAllVal()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]*SinkResult, 0, len(s.results))
+	for elem := s.order.Front(); elem != nil; elem = elem.Next() {
+		results = append(results, elem.Value.(*SinkResult))
+	}
+	s.results = make(map[string]*list.Element)
+	s.byPid = make(map[string]map[string]struct{})
+	s.expected = make(map[string]int)
+	s.order.Init()
+	return results
+}
+
+// sinkStream buffers the emitted results of a Stream, so a slow reader does not block the pool
+// it holds at most capacity results, the oldest one is dropped to make room, 0 holds them all
+type sinkStream struct {
+	ch       chan SinkResult
+	notify   chan struct{}
+	capacity int
+
+	mu      sync.Mutex
+	pending []SinkResult
+}
+
+// push buffers the result, it returns false if the oldest result is dropped to make room
+func (st *sinkStream) push(result SinkResult) bool {
+	st.mu.Lock()
+	full := st.capacity > 0 && len(st.pending) >= st.capacity
+	if full {
+		st.pending[0] = SinkResult{}
+		st.pending = st.pending[1:]
+	}
+	st.pending = append(st.pending, result)
+	st.mu.Unlock()
+
+	select {
+	case st.notify <- struct{}{}:
+	default:
+	}
+	return !full
+}
+
+// next removes the oldest pending result
+func (st *sinkStream) next() (SinkResult, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.pending) == 0 {
+		return SinkResult{}, false
+	}
+	result := st.pending[0]
+	st.pending[0] = SinkResult{}
+	st.pending = st.pending[1:]
+	return result, true
+}
+
+// pump sends the pending results to the reader until ctx is done, or the pool is done and the results are flushed
+// the result being sent is out of pending, the reader may be one result behind the capacity
+func (st *sinkStream) pump(ctx context.Context, done <-chan struct{}) {
+	defer close(st.ch)
+	for {
+		if !st.flush(ctx) {
+			return
+		}
+
+		select {
+		case <-st.notify:
+		case <-ctx.Done():
+			return
+		case <-done:
+			st.flush(ctx)
+			return
+		}
+	}
+}
+
+// flush sends the pending results to the reader, it returns false if ctx is done
+func (st *sinkStream) flush(ctx context.Context) bool {
+	for result, ok := st.next(); ok; result, ok = st.next() {
+		select {
+		case st.ch <- result:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,217 @@
+package internel
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSinkPool_Get(t *testing.T) {
+	pool := NewSinkPool()
+	defer pool.Close()
+
+	pool.PutInMsg("1", NewTickInMsg("1", "pid:a", "x"))
+	pool.PutOutMsg("1", NewTickOutMsg("1", "pid:a", "a(x)", nil))
+	pool.PutInMsg("1", NewTickInMsg("1", "pid:b", "a(x)"))
+	pool.PutOutMsg("1", NewTickOutMsg("1", "pid:b", nil, fmt.Errorf("b failed")))
+	pool.PutInMsg("2", NewTickInMsg("2", "pid:a", "y"))
+
+	result, ok := pool.GetByMsg("1")
+	assert.True(t, ok)
+	assert.Equal(t, "1", result.Uid())
+	assert.Equal(t, 2, len(result.In()))
+	assert.Equal(t, "a(x)", result.Out()[0].Output())
+
+	_, ok = pool.GetByMsg("3")
+	assert.False(t, ok)
+
+	assert.Equal(t, 2, len(pool.GetByPid("pid:a")))
+	assert.Equal(t, 1, len(pool.GetByPid("pid:b")))
+	assert.Equal(t, 0, len(pool.GetByPid("pid:c")))
+
+	failed := pool.Query(func(result SinkResult) bool {
+		for _, out := range result.Out() {
+			if out.Err() != nil {
+				return true
+			}
+		}
+		return false
+	})
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, "1", failed[0].Uid())
+
+	assert.Equal(t, 2, len(pool.PopAll()))
+	assert.Equal(t, 0, len(pool.GetByPid("pid:a")))
+}
+
+func TestSinkPool_Stream(t *testing.T) {
+	engine := NewEngine()
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	left, err := engine.Spawn(newEcho("left"))
+	assert.Nil(t, err)
+	right, err := engine.Spawn(newEcho("right"))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, left))
+	assert.Nil(t, engine.AddEdge(src, right))
+	assert.Nil(t, engine.Ready())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := engine.SinkPool().Stream(ctx)
+
+	uids := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		future, err := engine.Ask(context.Background(), i)
+		assert.Nil(t, err)
+		uids[future.Uid()] = true
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case result := <-stream:
+			assert.True(t, uids[result.Uid()])
+			delete(uids, result.Uid())
+			// every leaf has reported
+			assert.Equal(t, 3, len(result.Out()))
+		case <-time.After(time.Second):
+			t.Fatal("result is not streamed")
+		}
+	}
+
+	// the stream is closed once the engine is shut down
+	assert.Nil(t, engine.Shutdown(context.Background()))
+	select {
+	case _, ok := <-stream:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("stream is not closed")
+	}
+}
+
+func TestSinkPool_StreamCanceled(t *testing.T) {
+	pool := NewSinkPool()
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := pool.Stream(ctx)
+	cancel()
+
+	select {
+	case _, ok := <-stream:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("stream is not closed")
+	}
+}
+
+func TestSinkPool_StreamSlowReader(t *testing.T) {
+	pool := NewSinkPool(WithStreamBuffer(4))
+	defer pool.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := pool.Stream(ctx)
+
+	// nobody reads the stream, the pool does not block and keeps the newest results for the reader
+	for i := 0; i < 100; i++ {
+		uid := fmt.Sprint(i)
+		pool.PutInMsg(uid, NewTickInMsg(uid, "pid:a", i))
+		pool.PutOutMsg(uid, NewTickOutMsg(uid, "pid:a", i, nil))
+		pool.complete(uid, 1)
+	}
+	assert.Equal(t, 100, pool.Len())
+
+	var uids []string
+	for len(uids)+int(pool.StreamDropped()) < 100 {
+		select {
+		case result := <-stream:
+			uids = append(uids, result.Uid())
+		case <-time.After(time.Second):
+			t.Fatalf("stream is not flushed, read %v, dropped %d", uids, pool.StreamDropped())
+		}
+	}
+	assert.LessOrEqual(t, len(uids), 5)
+	assert.Equal(t, []string{"96", "97", "98", "99"}, uids[len(uids)-4:])
+}
+
+func TestSinkPool_MaxEntries(t *testing.T) {
+	for _, tc := range []struct {
+		policy  EvictionPolicy
+		evicted string
+	}{
+		{EvictFIFO, "1"},
+		{EvictLRU, "2"},
+	} {
+		var evicted []string
+		pool := NewSinkPool(WithMaxEntries(2, tc.policy), WithEvictHandler(func(result SinkResult, reason EvictReason) {
+			assert.Equal(t, EvictedCapacity, reason)
+			evicted = append(evicted, result.Uid())
+		}))
+
+		pool.PutInMsg("1", NewTickInMsg("1", "pid:a", 1))
+		pool.PutInMsg("2", NewTickInMsg("2", "pid:a", 2))
+		// uid 1 is used most recently
+		pool.GetByMsg("1")
+		pool.PutInMsg("3", NewTickInMsg("3", "pid:a", 3))
+
+		assert.Equal(t, []string{tc.evicted}, evicted)
+		assert.Equal(t, uint64(1), pool.Evicted())
+		assert.Equal(t, 2, pool.Len())
+		assert.Equal(t, 2, len(pool.GetByPid("pid:a")))
+		_, ok := pool.GetByMsg(tc.evicted)
+		assert.False(t, ok)
+		pool.Close()
+	}
+}
+
+func TestSinkPool_TTL(t *testing.T) {
+	evicted := make(chan EvictReason, 1)
+	pool := NewSinkPool(WithTTL(20*time.Millisecond), WithEvictHandler(func(result SinkResult, reason EvictReason) {
+		evicted <- reason
+	}))
+	defer pool.Close()
+
+	pool.PutInMsg("1", NewTickInMsg("1", "pid:a", 1))
+	_, ok := pool.GetByMsg("1")
+	assert.True(t, ok)
+
+	select {
+	case reason := <-evicted:
+		assert.Equal(t, EvictedExpired, reason)
+	case <-time.After(time.Second):
+		t.Fatal("result is not expired")
+	}
+	assert.Equal(t, 0, pool.Len())
+	assert.Equal(t, 0, len(pool.GetByPid("pid:a")))
+}
+
+func TestSinkPool_LeafOnly(t *testing.T) {
+	engine := NewEngine()
+	engine.SetSinkPool(NewSinkPool(WithLeafOnly()))
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	sink, err := engine.Spawn(newEcho("sink"))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, sink))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream := engine.SinkPool().Stream(ctx)
+
+	_, err = engine.SendAndWait(ctx, 1)
+	assert.Nil(t, err)
+
+	select {
+	case result := <-stream:
+		assert.Equal(t, 0, len(result.In()))
+		assert.Equal(t, 1, len(result.Out()))
+		assert.Equal(t, "sink(src(1))", result.Out()[0].Output())
+	case <-ctx.Done():
+		t.Fatal("result is not streamed")
+	}
+	assert.Equal(t, 0, len(engine.SinkPool().GetByPid(src.String())))
+}
@@ -0,0 +1,303 @@
+package internel
+
+import (
+	"fmt"
+	"github.com/fzft/my-actor/pkg"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ActorFactory creates an actor named name from its config in a pipeline spec
+// the actor's String() must return name
+type ActorFactory func(name string, config map[string]any) (Actor, error)
+
+var (
+	actorTypesMu sync.RWMutex
+	actorTypes   = make(map[string]ActorFactory)
+)
+
+// RegisterActorType registers an actor type, so pipeline specs can refer to it by type name
+func RegisterActorType(typeName string, factory ActorFactory) {
+	actorTypesMu.Lock()
+	defer actorTypesMu.Unlock()
+	actorTypes[typeName] = factory
+}
+
+// ActorTypes returns the registered actor type names
+func ActorTypes() []string {
+	actorTypesMu.RLock()
+	defer actorTypesMu.RUnlock()
+
+	names := make([]string, 0, len(actorTypes))
+	for name := range actorTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupActorType(typeName string) (ActorFactory, bool) {
+	actorTypesMu.RLock()
+	defer actorTypesMu.RUnlock()
+	factory, ok := actorTypes[typeName]
+	return factory, ok
+}
+
+// Spec is a declarative pipeline definition, it is read from YAML or JSON
+//
+//	actors:
+//	  - name: parse
+//	    type: parser
+//	    mailbox_size: 4096
+//	  - name: enrich
+//	    type: enricher
+//	    config: {endpoint: "http://localhost:8080"}
+//	    supervisor: {directive: restart, max_retries: 3, window: 1m}
+//	edges:
+//	  - {from: parse, to: enrich}
+type Spec struct {
+	Actors []ActorSpec `yaml:"actors" json:"actors"`
+	Edges  []EdgeSpec  `yaml:"edges" json:"edges"`
+}
+
+// ActorSpec is an actor in a pipeline spec
+type ActorSpec struct {
+	Name   string         `yaml:"name" json:"name"`
+	Type   string         `yaml:"type" json:"type"`
+	Config map[string]any `yaml:"config" json:"config"`
+
+	// MailboxSize is the size of the root actor's mailbox, only allowed on root actors
+	MailboxSize int `yaml:"mailbox_size" json:"mailbox_size"`
+	// InboxSize is the capacity of the actor's inbox
+	InboxSize int `yaml:"inbox_size" json:"inbox_size"`
+	// Wait is the inbox wait strategy: blocking, yielding, sleeping or busy_spin
+	Wait string `yaml:"wait" json:"wait"`
+
+	Supervisor *SupervisorSpec `yaml:"supervisor" json:"supervisor"`
+}
+
+// SupervisorSpec is the supervisor strategy of an actor in a pipeline spec
+type SupervisorSpec struct {
+	// Directive is applied on every failure: resume, restart, stop or escalate
+	Directive  string        `yaml:"directive" json:"directive"`
+	MaxRetries int           `yaml:"max_retries" json:"max_retries"`
+	Window     time.Duration `yaml:"window" json:"window"`
+}
+
+// EdgeSpec is an edge in a pipeline spec
+type EdgeSpec struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+}
+
+// ParseSpec reads a pipeline spec from YAML or JSON, JSON is valid YAML
+func ParseSpec(r io.Reader) (*Spec, error) {
+	var spec Spec
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("parse spec: %w", err)
+	}
+	return &spec, nil
+}
+
+// Validate checks the spec for unknown actor types, dangling edges and cycles
+func (s *Spec) Validate() error {
+	_, err := s.DAG()
+	return err
+}
+
+// DAG validates the spec and returns the DAG of its actor names
+func (s *Spec) DAG() (*pkg.DAG[pkg.Stringer], error) {
+	if len(s.Actors) == 0 {
+		return nil, fmt.Errorf("spec has no actors")
+	}
+	dag := pkg.NewDAG[pkg.Stringer]()
+	nodes := make(map[string]*pkg.Node[pkg.Stringer], len(s.Actors))
+
+	for _, actor := range s.Actors {
+		if actor.Name == "" {
+			return nil, fmt.Errorf("actor of type %q has no name", actor.Type)
+		}
+		if _, ok := nodes[actor.Name]; ok {
+			return nil, fmt.Errorf("actor %s is declared twice", actor.Name)
+		}
+		if _, ok := lookupActorType(actor.Type); !ok {
+			return nil, fmt.Errorf("actor %s has unknown type %q", actor.Name, actor.Type)
+		}
+		if _, err := actor.waitStrategy(); err != nil {
+			return nil, err
+		}
+		if _, err := actor.supervisorStrategy(nil); err != nil {
+			return nil, err
+		}
+		nodes[actor.Name] = dag.AddNode(specNode(actor.Name))
+	}
+
+	for _, edge := range s.Edges {
+		from, ok := nodes[edge.From]
+		if !ok {
+			return nil, fmt.Errorf("edge %s -> %s: actor %s not found", edge.From, edge.To, edge.From)
+		}
+		to, ok := nodes[edge.To]
+		if !ok {
+			return nil, fmt.Errorf("edge %s -> %s: actor %s not found", edge.From, edge.To, edge.To)
+		}
+		if err := dag.AddEdge(from, to); err != nil {
+			return nil, fmt.Errorf("edge %s -> %s: %w", edge.From, edge.To, err)
+		}
+	}
+
+	for _, actor := range s.Actors {
+		if actor.MailboxSize > 0 && dag.InDegree(nodes[actor.Name]) > 0 {
+			return nil, fmt.Errorf("actor %s is not a root actor, mailbox_size is not allowed", actor.Name)
+		}
+	}
+	return dag, nil
+}
+
+// specNode is the node of an actor in the spec's DAG
+type specNode string
+
+func (n specNode) String() string {
+	return string(n)
+}
+
+// newActor creates the actor with its registered factory
+func (a ActorSpec) newActor() (Actor, error) {
+	factory, ok := lookupActorType(a.Type)
+	if !ok {
+		return nil, fmt.Errorf("actor %s has unknown type %q", a.Name, a.Type)
+	}
+	actor, err := factory(a.Name, a.Config)
+	if err != nil {
+		return nil, fmt.Errorf("create actor %s: %w", a.Name, err)
+	}
+	if actor.String() != a.Name {
+		return nil, fmt.Errorf("actor type %q names the actor %s instead of %s", a.Type, actor.String(), a.Name)
+	}
+	return actor, nil
+}
+
+func (a ActorSpec) waitStrategy() (pkg.WaitStrategy, error) {
+	switch a.Wait {
+	case "", "blocking":
+		return pkg.NewBlockingWaitStrategy(), nil
+	case "yielding":
+		return pkg.NewYieldingWaitStrategy(100), nil
+	case "sleeping":
+		return pkg.NewSleepingWaitStrategy(time.Microsecond, time.Millisecond), nil
+	case "busy_spin":
+		return pkg.NewBusySpinWaitStrategy(), nil
+	default:
+		return nil, fmt.Errorf("actor %s has unknown wait strategy %q", a.Name, a.Wait)
+	}
+}
+
+func (a ActorSpec) supervisorStrategy(factory func() Actor) (SupervisorStrategy, error) {
+	if a.Supervisor == nil {
+		return DefaultSupervisorStrategy(), nil
+	}
+
+	var directive Directive
+	switch a.Supervisor.Directive {
+	case "", "resume":
+		directive = DirectiveResume
+	case "restart":
+		directive = DirectiveRestart
+	case "stop":
+		directive = DirectiveStop
+	case "escalate":
+		directive = DirectiveEscalate
+	default:
+		return SupervisorStrategy{}, fmt.Errorf("actor %s has unknown supervisor directive %q", a.Name, a.Supervisor.Directive)
+	}
+
+	return SupervisorStrategy{
+		Decider: func(err error) Directive {
+			return directive
+		},
+		Factory:    factory,
+		MaxRetries: a.Supervisor.MaxRetries,
+		Window:     a.Supervisor.Window,
+	}, nil
+}
+
+// pidOptions returns the Spawn options of the actor
+func (a ActorSpec) pidOptions(logger *zap.SugaredLogger) ([]PidOption, error) {
+	wait, err := a.waitStrategy()
+	if err != nil {
+		return nil, err
+	}
+
+	// a restarted actor is recreated from the same type and config
+	strategy, err := a.supervisorStrategy(func() Actor {
+		actor, err := a.newActor()
+		if err != nil {
+			logger.Errorw("recreate actor", "actor", a.Name, "err", err)
+			return nil
+		}
+		return actor
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []PidOption{WithWaitStrategy(wait), WithSupervisor(strategy)}
+	if a.InboxSize > 0 {
+		opts = append(opts, WithInboxSize(a.InboxSize))
+	}
+	if a.MailboxSize > 0 {
+		opts = append(opts, WithMailbox(NewDefaultMailboxWithSize(logger, a.MailboxSize)))
+	}
+	return opts, nil
+}
+
+// LoadSpec reads a pipeline spec from YAML or JSON, builds the DAG and readies the engine
+func (e *Engine[T]) LoadSpec(r io.Reader) error {
+	spec, err := ParseSpec(r)
+	if err != nil {
+		return err
+	}
+	return e.BuildSpec(spec)
+}
+
+// BuildSpec validates the spec, spawns its actors and edges, and readies the engine
+func (e *Engine[T]) BuildSpec(spec *Spec) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	pids := make(map[string]*Pid, len(spec.Actors))
+	for _, actorSpec := range spec.Actors {
+		actor, err := actorSpec.newActor()
+		if err != nil {
+			return err
+		}
+		typed, ok := actor.(T)
+		if !ok {
+			return fmt.Errorf("actor %s of type %q is not supported by the engine", actorSpec.Name, actorSpec.Type)
+		}
+
+		opts, err := actorSpec.pidOptions(e.logger)
+		if err != nil {
+			return err
+		}
+		pid, err := e.Spawn(typed, opts...)
+		if err != nil {
+			return fmt.Errorf("spawn actor %s: %w", actorSpec.Name, err)
+		}
+		pids[actorSpec.Name] = pid
+	}
+
+	for _, edge := range spec.Edges {
+		if err := e.AddEdge(pids[edge.From], pids[edge.To]); err != nil {
+			return fmt.Errorf("edge %s -> %s: %w", edge.From, edge.To, err)
+		}
+	}
+	return e.Ready()
+}
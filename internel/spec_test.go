@@ -0,0 +1,104 @@
+package internel
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterActorType("echo", func(name string, config map[string]any) (Actor, error) {
+		return newEcho(name), nil
+	})
+	RegisterActorType("dummy", func(name string, config map[string]any) (Actor, error) {
+		if name != "dummy" {
+			return nil, fmt.Errorf("dummy must be named dummy")
+		}
+		return newDummy(), nil
+	})
+}
+
+const testYamlSpec = `
+actors:
+  - name: dummy
+    type: dummy
+    mailbox_size: 16
+  - name: enrich
+    type: echo
+    wait: yielding
+    inbox_size: 64
+    supervisor: {directive: restart, max_retries: 3, window: 1m}
+  - name: sink
+    type: echo
+edges:
+  - {from: dummy, to: enrich}
+  - {from: enrich, to: sink}
+`
+
+const testJsonSpec = `{
+  "actors": [
+    {"name": "dummy", "type": "dummy"},
+    {"name": "sink", "type": "echo", "config": {"prefix": "x"}}
+  ],
+  "edges": [{"from": "dummy", "to": "sink"}]
+}`
+
+func TestSpec_Parse(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(testYamlSpec))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(spec.Actors))
+	assert.Equal(t, 16, spec.Actors[0].MailboxSize)
+	assert.Equal(t, time.Minute, spec.Actors[1].Supervisor.Window)
+	assert.Equal(t, EdgeSpec{From: "enrich", To: "sink"}, spec.Edges[1])
+	assert.Nil(t, spec.Validate())
+
+	spec, err = ParseSpec(strings.NewReader(testJsonSpec))
+	assert.Nil(t, err)
+	assert.Equal(t, "x", spec.Actors[1].Config["prefix"])
+	assert.Nil(t, spec.Validate())
+
+	_, err = ParseSpec(strings.NewReader("actors: [{name: a, kind: echo}]"))
+	assert.NotNil(t, err)
+}
+
+func TestSpec_Validate(t *testing.T) {
+	for name, spec := range map[string]string{
+		"empty":            "actors: []",
+		"unknown type":     "actors: [{name: a, type: nope}]",
+		"duplicate":        "actors: [{name: a, type: echo}, {name: a, type: echo}]",
+		"dangling edge":    "actors: [{name: a, type: echo}]\nedges: [{from: a, to: b}]",
+		"cycle":            "actors: [{name: a, type: echo}, {name: b, type: echo}]\nedges: [{from: a, to: b}, {from: b, to: a}]",
+		"wait strategy":    "actors: [{name: a, type: echo, wait: nope}]",
+		"directive":        "actors: [{name: a, type: echo, supervisor: {directive: nope}}]",
+		"non-root mailbox": "actors: [{name: a, type: echo}, {name: b, type: echo, mailbox_size: 8}]\nedges: [{from: a, to: b}]",
+	} {
+		spec, err := ParseSpec(strings.NewReader(spec))
+		assert.Nil(t, err, name)
+		assert.NotNil(t, spec.Validate(), name)
+	}
+}
+
+func TestEngine_LoadSpec(t *testing.T) {
+	engine := NewEngine()
+	assert.Nil(t, engine.LoadSpec(strings.NewReader(testYamlSpec)))
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outputs, err := engine.SendAndWait(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"sink": "sink(enrich(2))"}, outputs)
+
+	// the factory does not name the actor as the spec
+	engine = NewEngine()
+	assert.NotNil(t, engine.LoadSpec(strings.NewReader("actors: [{name: other, type: dummy}]")))
+
+	// an empty spec, or an engine without actors, is an error, not an exit
+	engine = NewEngine()
+	assert.EqualError(t, engine.LoadSpec(strings.NewReader("actors: []")), "spec has no actors")
+	assert.NotNil(t, engine.Ready())
+}
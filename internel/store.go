@@ -1,11 +1,51 @@
 package internel
 
-import "github.com/fzft/my-actor/pkg"
+import (
+	"github.com/fzft/my-actor/pkg"
+	"sort"
+)
 
 // Storer is the interface that wraps the basic Store methods.
+// an actor reaches its store with Context.Store, a durable store is set at Spawn with WithStore
 type Storer interface {
 	Put(key string, value any)
 	Get(key string) (any, bool)
+	Delete(key string)
+
+	// Range calls fn for every key in key order, until fn returns false
+	Range(fn func(key string, value any) bool)
+
+	// Write applies the writes of the batch, a durable store persists all of them or none
+	// it returns an error if the batch is not applied, e.g. a value can not be encoded
+	Write(batch *Batch) error
+
+	// Close releases the resources held by the store
+	Close()
+}
+
+// Batch is a group of writes for Storer.Write
+type Batch struct {
+	ops []storeOp
+}
+
+// storeOp is a put, or a delete of the key
+type storeOp struct {
+	key    string
+	value  any
+	delete bool
+}
+
+func (b *Batch) Put(key string, value any) {
+	b.ops = append(b.ops, storeOp{key: key, value: value})
+}
+
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, storeOp{key: key, delete: true})
+}
+
+// Len returns the number of writes in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
 }
 
 // MemoryStore wraps the KeyValueStore
@@ -27,6 +67,47 @@ func (m *MemoryStore) Get(key string) (any, bool) {
 	return m.store.Get(key)
 }
 
+// Delete ...
+func (m *MemoryStore) Delete(key string) {
+	m.store.Delete(key)
+}
+
+// Range ...
+func (m *MemoryStore) Range(fn func(key string, value any) bool) {
+	rangeItems(m.store.Items(), fn)
+}
+
+// Write ...
+func (m *MemoryStore) Write(batch *Batch) error {
+	for _, op := range batch.ops {
+		if op.delete {
+			m.store.Delete(op.key)
+		} else {
+			m.store.Put(op.key, op.value)
+		}
+	}
+	return nil
+}
+
+// Close ...
+func (m *MemoryStore) Close() {
+	m.store.Close()
+}
+
+// rangeItems calls fn for every item in key order, until fn returns false
+func rangeItems(items map[string]any, fn func(key string, value any) bool) {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, items[key]) {
+			return
+		}
+	}
+}
+
 // Pool ...
 type Pool interface {
 	Put(key any, value any)
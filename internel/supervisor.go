@@ -0,0 +1,226 @@
+package internel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directive is the decision of the supervisor when an actor fails
+type Directive int
+
+const (
+	// DirectiveResume keeps the actor as it is and continues with the next message
+	DirectiveResume Directive = iota
+	// DirectiveRestart recreates the actor with the factory and reruns PreStart
+	DirectiveRestart
+	// DirectiveStop stops the actor, the messages sent to it are dropped
+	DirectiveStop
+	// DirectiveEscalate hands the failure over to the parent actors in the DAG, each applies the directive of its own strategy
+	// the escalating actor waits for the decision and follows it: it stops if a parent stops, restarts if a parent restarts
+	// a parent restarts before its next message, a root actor, or one whose parents are all stopped, stops
+	DirectiveEscalate
+)
+
+func (d Directive) String() string {
+	switch d {
+	case DirectiveResume:
+		return "resume"
+	case DirectiveRestart:
+		return "restart"
+	case DirectiveStop:
+		return "stop"
+	case DirectiveEscalate:
+		return "escalate"
+	default:
+		return fmt.Sprintf("directive(%d)", int(d))
+	}
+}
+
+// Decider maps the failure of an actor to a directive
+type Decider func(err error) Directive
+
+// PanicError is the error recovered from a panic in Receive
+type PanicError struct {
+	Value any
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// SupervisorStrategy is how a Pid reacts when its actor returns an error or panics
+type SupervisorStrategy struct {
+	// Decider decides the directive for the error, resume if nil
+	// it is called from the goroutines of the escalating children too, it must be safe for concurrent use
+	Decider Decider
+
+	// Factory recreates the actor on restart, the same actor is reused if nil
+	Factory func() Actor
+
+	// MaxRetries is the max number of restarts within Window, the actor is stopped once exceeded
+	// 0 means no limit
+	MaxRetries int
+
+	// Window is the time window of MaxRetries, 0 means the whole lifetime of the actor
+	Window time.Duration
+}
+
+// DefaultSupervisorStrategy resumes the actor on every failure
+func DefaultSupervisorStrategy() SupervisorStrategy {
+	return SupervisorStrategy{
+		Decider: func(err error) Directive {
+			return DirectiveResume
+		},
+	}
+}
+
+// WithSupervisor sets the supervisor strategy of the actor
+func WithSupervisor(strategy SupervisorStrategy) PidOption {
+	return func(p *Pid) {
+		p.supervisor = newSupervisor(strategy)
+	}
+}
+
+// supervisor applies the strategy and keeps the restart history of one actor
+type supervisor struct {
+	strategy SupervisorStrategy
+
+	// mu guards restarts, the children decide with the strategy of their parent when they escalate
+	mu       sync.Mutex
+	restarts []time.Time
+}
+
+func newSupervisor(strategy SupervisorStrategy) *supervisor {
+	return &supervisor{strategy: strategy}
+}
+
+// decide returns the directive for the error
+func (s *supervisor) decide(err error) Directive {
+	if s.strategy.Decider == nil {
+		return DirectiveResume
+	}
+	return s.strategy.Decider(err)
+}
+
+// allowRestart records a restart, returns false if the restart exceeds MaxRetries within Window
+func (s *supervisor) allowRestart(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.strategy.Window > 0 {
+		// forget the restarts that are out of the window
+		i := 0
+		for ; i < len(s.restarts); i++ {
+			if now.Sub(s.restarts[i]) <= s.strategy.Window {
+				break
+			}
+		}
+		s.restarts = s.restarts[i:]
+	}
+
+	if s.strategy.MaxRetries > 0 && len(s.restarts) >= s.strategy.MaxRetries {
+		return false
+	}
+	s.restarts = append(s.restarts, now)
+	return true
+}
+
+// supervise applies the supervisor's directive for the actor's failure, and returns the directive applied
+func (p *Pid) supervise(err error) Directive {
+	directive := p.supervisor.decide(err)
+	p.logger.Warnw("supervise", "pid", p.String(), "err", err, "directive", directive)
+
+	if directive == DirectiveEscalate {
+		directive = p.escalate(err)
+		p.logger.Warnw("escalated", "pid", p.String(), "err", err, "directive", directive)
+	}
+	switch directive {
+	case DirectiveRestart:
+		if !p.supervisor.allowRestart(time.Now()) {
+			p.logger.Errorw("too many restarts, stop actor", "pid", p.String(), "err", err)
+			p.Stop()
+			return DirectiveStop
+		}
+		p.restart()
+	case DirectiveStop:
+		p.Stop()
+	}
+	return directive
+}
+
+// escalate hands the failure over to the running parents, in the actor's goroutine, and returns the directive to follow
+// the actor does not take another message before the parents have decided
+func (p *Pid) escalate(err error) Directive {
+	err = fmt.Errorf("escalated from %s: %w", p.String(), err)
+	directive, decided := DirectiveResume, false
+	for _, parent := range p.context.parentActors() {
+		if parent.State() == ActorStateStopped {
+			continue
+		}
+		decided = true
+		switch parent.decideEscalation(err) {
+		case DirectiveStop:
+			directive = DirectiveStop
+		case DirectiveRestart:
+			if directive != DirectiveStop {
+				directive = DirectiveRestart
+			}
+		}
+	}
+	if !decided {
+		// no one to escalate to
+		return DirectiveStop
+	}
+	return directive
+}
+
+// decideEscalation applies the actor's strategy to a child's failure, it is called in the child's goroutine
+// the actor stops right away or restarts before its next message, the directive is returned for the child to follow
+func (p *Pid) decideEscalation(err error) Directive {
+	directive := p.supervisor.decide(err)
+	p.logger.Warnw("supervise escalation", "pid", p.String(), "err", err, "directive", directive)
+
+	if directive == DirectiveEscalate {
+		directive = p.escalate(err)
+	}
+	switch directive {
+	case DirectiveRestart:
+		if !p.supervisor.allowRestart(time.Now()) {
+			p.logger.Errorw("too many restarts, stop actor", "pid", p.String(), "err", err)
+			p.Stop()
+			return DirectiveStop
+		}
+		atomic.StoreInt32(&p.restartRequested, 1)
+	case DirectiveStop:
+		p.Stop()
+	}
+	return directive
+}
+
+// restart recreates the actor and reruns PreStart
+func (p *Pid) restart() {
+	if d, ok := p.actor.(PostStopHookActor); ok {
+		d.PostStop()
+	}
+
+	if factory := p.supervisor.strategy.Factory; factory != nil {
+		actor := factory()
+		if actor == nil || actor.String() != p.actorName {
+			p.logger.Errorw("factory returns a different actor, keep the old one", "pid", p.String(), "actor", actor)
+		} else {
+			p.actor = actor
+			// the new actor starts from scratch, an EventSourcedActor gets its state back from the journal
+			if err := p.replay(); err != nil {
+				p.logger.Errorw("replay journal, stop actor", "pid", p.String(), "err", err)
+				p.Stop()
+				return
+			}
+		}
+	}
+
+	if d, ok := p.actor.(PreStartHookActor); ok {
+		d.PreStart()
+	}
+}
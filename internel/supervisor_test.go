@@ -0,0 +1,237 @@
+package internel
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Panicker panics on "panic" and echoes everything else
+type Panicker struct {
+	generation int64
+	started    *int64
+}
+
+func (p *Panicker) Receive(ctx *Context, msg any) (any, error) {
+	if msg == "panic" {
+		panic("boom")
+	}
+	if msg == "fail" {
+		return nil, errors.New("fail")
+	}
+	return p.generation, nil
+}
+
+func (p *Panicker) String() string {
+	return "panicker"
+}
+
+func (p *Panicker) PreStart() {
+	atomic.AddInt64(p.started, 1)
+}
+
+func newPanickerEngine(t *testing.T, strategy SupervisorStrategy) (*Engine[Actor], *Pid) {
+	engine := NewEngine()
+	started := int64(0)
+	var generation int64
+	strategy.Factory = func() Actor {
+		generation++
+		return &Panicker{generation: generation, started: &started}
+	}
+	pid, err := engine.Spawn(strategy.Factory(), WithSupervisor(strategy))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Ready())
+	return engine, pid
+}
+
+func TestSupervisor_Resume(t *testing.T) {
+	engine, _ := newPanickerEngine(t, DefaultSupervisorStrategy())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := engine.SendAndWait(ctx, "panic")
+	var panicErr *PanicError
+	assert.True(t, errors.As(err, &panicErr))
+	assert.Equal(t, "boom", panicErr.Value)
+
+	outputs, err := engine.SendAndWait(ctx, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), outputs["panicker"])
+}
+
+func TestSupervisor_Restart(t *testing.T) {
+	engine, pid := newPanickerEngine(t, SupervisorStrategy{
+		Decider: func(err error) Directive {
+			return DirectiveRestart
+		},
+		MaxRetries: 2,
+		Window:     time.Minute,
+	})
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := engine.SendAndWait(ctx, "panic")
+	assert.NotNil(t, err)
+	outputs, err := engine.SendAndWait(ctx, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), outputs["panicker"])
+
+	_, err = engine.SendAndWait(ctx, "fail")
+	assert.NotNil(t, err)
+	outputs, err = engine.SendAndWait(ctx, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), outputs["panicker"])
+
+	// the third restart within the window stops the actor
+	_, err = engine.SendAndWait(ctx, "panic")
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		return pid.State() == ActorStateStopped
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSupervisor_Stop(t *testing.T) {
+	for _, directive := range []Directive{DirectiveStop, DirectiveEscalate} {
+		engine, pid := newPanickerEngine(t, SupervisorStrategy{
+			Decider: func(err error) Directive {
+				return directive
+			},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := engine.SendAndWait(ctx, "panic")
+		assert.NotNil(t, err)
+		assert.Eventually(t, func() bool {
+			return pid.State() == ActorStateStopped
+		}, time.Second, 10*time.Millisecond, directive.String())
+
+		assert.Nil(t, engine.Shutdown(ctx))
+		cancel()
+	}
+}
+
+func TestSupervisor_EscalateRestart(t *testing.T) {
+	engine := NewEngine()
+	var counters []*Counter
+	parentStrategy := SupervisorStrategy{
+		Decider: func(err error) Directive {
+			return DirectiveRestart
+		},
+		Factory: func() Actor {
+			counter := &Counter{}
+			counters = append(counters, counter)
+			return counter
+		},
+	}
+	parent, err := engine.Spawn(parentStrategy.Factory(), WithSupervisor(parentStrategy))
+	assert.Nil(t, err)
+
+	started := int64(0)
+	var generation int64
+	childStrategy := SupervisorStrategy{
+		Decider: func(err error) Directive {
+			return DirectiveEscalate
+		},
+		Factory: func() Actor {
+			generation++
+			return &Panicker{generation: generation, started: &started}
+		},
+	}
+	child, err := engine.Spawn(childStrategy.Factory(), WithSupervisor(childStrategy))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(parent, child))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = engine.SendAndWait(ctx, "panic")
+	assert.NotNil(t, err)
+
+	// the parent's strategy restarts the child right away, and the parent before its next message
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&started) == 2
+	}, time.Second, 10*time.Millisecond)
+	outputs, err := engine.SendAndWait(ctx, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"panicker": int64(2)}, outputs)
+	assert.Equal(t, 2, len(counters))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&counters[1].started))
+	assert.Equal(t, ActorStateRunning, parent.State())
+	assert.Equal(t, ActorStateRunning, child.State())
+}
+
+// newEscalatingEngine parent -> panicker, the panicker escalates every failure to the parent's strategy
+func newEscalatingEngine(t *testing.T, parentStrategy SupervisorStrategy, opts ...PidOption) (*Engine[Actor], *Pid, *Pid) {
+	engine := NewEngine()
+	parent, err := engine.Spawn(&Counter{}, append(opts, WithSupervisor(parentStrategy))...)
+	assert.Nil(t, err)
+	started := int64(0)
+	child, err := engine.Spawn(&Panicker{started: &started}, append(opts, WithSupervisor(SupervisorStrategy{
+		Decider: func(err error) Directive {
+			return DirectiveEscalate
+		},
+	}))...)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(parent, child))
+	assert.Nil(t, engine.Ready())
+	return engine, parent, child
+}
+
+func TestSupervisor_EscalateStop(t *testing.T) {
+	engine, parent, child := newEscalatingEngine(t, SupervisorStrategy{
+		Decider: func(err error) Directive {
+			return DirectiveStop
+		},
+	})
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := engine.SendAndWait(ctx, "fail")
+	assert.NotNil(t, err)
+
+	// the parent stops, and the child with it
+	assert.Eventually(t, func() bool {
+		return parent.State() == ActorStateStopped && child.State() == ActorStateStopped
+	}, time.Second, 10*time.Millisecond)
+	letters := engine.DeadLetters().Query(nil)
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, DeadLetterFailed, letters[0].Reason)
+	assert.Equal(t, "panicker", letters[0].Actor)
+}
+
+func TestSupervisor_EscalateStopped(t *testing.T) {
+	engine, parent, child := newEscalatingEngine(t, DefaultSupervisorStrategy())
+	defer engine.Shutdown(context.Background())
+
+	// a child whose parents are all stopped has no one to escalate to, it stops
+	parent.Stop()
+	assert.Equal(t, DirectiveStop, child.supervise(errors.New("boom")))
+	assert.Equal(t, ActorStateStopped, child.State())
+	assert.Equal(t, 0, engine.DeadLetters().Len())
+}
+
+func TestSupervisor_EscalateFullInbox(t *testing.T) {
+	// the parent waits for room in the child's inbox while the child escalates, neither blocks the other
+	engine, parent, child := newEscalatingEngine(t, DefaultSupervisorStrategy(), WithInboxSize(2))
+	defer engine.Shutdown(context.Background())
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, engine.Send("fail"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	outputs, err := engine.SendAndWait(ctx, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"panicker": int64(0)}, outputs)
+	assert.Equal(t, ActorStateRunning, parent.State())
+	assert.Equal(t, ActorStateRunning, child.State())
+}
@@ -0,0 +1,299 @@
+package internel
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TraceContext is the position of a message in its trace, it travels with the message along the edges
+type TraceContext struct {
+	// TraceID is 16 bytes hex encoded, shared by every span of the message
+	TraceID string
+	// SpanID is 8 bytes hex encoded, the span of the actor that produced the message, empty at the root
+	SpanID string
+}
+
+// IsValid reports whether the trace context has a trace id
+func (t TraceContext) IsValid() bool {
+	return t.TraceID != ""
+}
+
+// Span is one Receive of an actor
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+
+	// Links are the spans of the other parents of a JoinActor
+	Links []TraceContext
+
+	// Name is the actor name
+	Name  string
+	Uid   string
+	Start time.Time
+	End   time.Time
+	Err   error
+}
+
+// Duration returns how long the Receive took
+func (s Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// SpanExporter receives the spans of the actors
+// it is called from the actors' goroutines, implementations must be safe for concurrent use and cheap
+type SpanExporter interface {
+	Export(span Span)
+
+	// Close flushes the spans, it is called when the engine is shut down
+	Close() error
+}
+
+func newTraceID() string {
+	return randomHex(16)
+}
+
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// MemoryExporter is a SpanExporter that keeps the spans in memory
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (m *MemoryExporter) Export(span Span) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, span)
+}
+
+func (m *MemoryExporter) Close() error {
+	return nil
+}
+
+// Spans returns the exported spans, in export order
+func (m *MemoryExporter) Spans() []Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Span(nil), m.spans...)
+}
+
+// Trace returns the spans of a trace, in export order
+func (m *MemoryExporter) Trace(traceID string) []Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var spans []Span
+	for _, span := range m.spans {
+		if span.TraceID == traceID {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// Reset drops the exported spans
+func (m *MemoryExporter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = nil
+}
+
+const defaultOTLPBatchSize = 128
+
+// OTLPFileExporter is a SpanExporter that appends the spans to a file in the OTLP JSON format,
+// one ExportTraceServiceRequest per line, like the file exporter of the OpenTelemetry collector
+type OTLPFileExporter struct {
+	serviceName string
+	batchSize   int
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	batch  []Span
+	err    error
+}
+
+// NewOTLPFileExporter appends the spans to the file at path, serviceName is the service.name resource attribute
+// the spans are written in batches of batchSize, 0 means the default batch size
+func NewOTLPFileExporter(path string, serviceName string, batchSize int) (*OTLPFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		batchSize = defaultOTLPBatchSize
+	}
+	return &OTLPFileExporter{
+		serviceName: serviceName,
+		batchSize:   batchSize,
+		file:        file,
+		writer:      bufio.NewWriter(file),
+	}, nil
+}
+
+func (o *OTLPFileExporter) Export(span Span) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.batch = append(o.batch, span)
+	if len(o.batch) >= o.batchSize {
+		o.writeBatch()
+	}
+}
+
+// Flush writes the batched spans to the file
+func (o *OTLPFileExporter) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.writeBatch()
+	if o.err == nil {
+		o.err = o.writer.Flush()
+	}
+	return o.err
+}
+
+func (o *OTLPFileExporter) Close() error {
+	err := o.Flush()
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeBatch writes the batched spans as one line, must be called with mu held
+// the first error is kept, and returned by Flush
+func (o *OTLPFileExporter) writeBatch() {
+	if len(o.batch) == 0 || o.err != nil {
+		o.batch = o.batch[:0]
+		return
+	}
+
+	spans := make([]otlpSpan, 0, len(o.batch))
+	for _, span := range o.batch {
+		spans = append(spans, newOTLPSpan(span))
+	}
+	o.batch = o.batch[:0]
+
+	request := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", o.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/fzft/my-actor"},
+			Spans: spans,
+		}},
+	}}}
+	line, err := json.Marshal(request)
+	if err != nil {
+		o.err = err
+		return
+	}
+	if _, err := o.writer.Write(append(line, '\n')); err != nil {
+		o.err = err
+	}
+}
+
+// the subset of the OTLP JSON encoding the exporter writes
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+func newOTLPSpan(span Span) otlpSpan {
+	s := otlpSpan{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentSpanID,
+		Name:              span.Name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttribute("actor.name", span.Name),
+			stringAttribute("message.uid", span.Uid),
+		},
+		Status: otlpStatus{Code: otlpStatusOk},
+	}
+	for _, link := range span.Links {
+		s.Links = append(s.Links, otlpLink{TraceID: link.TraceID, SpanID: link.SpanID})
+	}
+	if span.Err != nil {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: span.Err.Error()}
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package internel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrace_Chain(t *testing.T) {
+	exporter := NewMemoryExporter()
+	engine := NewEngine()
+	engine.SetSpanExporter(exporter)
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	mid, err := engine.Spawn(newEcho("mid"))
+	assert.Nil(t, err)
+	picky, err := engine.Spawn(&Picky{})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, mid))
+	assert.Nil(t, engine.AddEdge(mid, picky))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = engine.SendAndWait(ctx, "ok")
+	assert.Nil(t, err)
+	_, err = engine.SendAndWait(ctx, "bad")
+	assert.NotNil(t, err)
+
+	spans := exporter.Spans()
+	assert.Equal(t, 6, len(spans))
+
+	for _, traceID := range []string{spans[0].TraceID, spans[3].TraceID} {
+		trace := exporter.Trace(traceID)
+		assert.Equal(t, 3, len(trace))
+		assert.Equal(t, "src", trace[0].Name)
+		assert.Equal(t, "", trace[0].ParentSpanID)
+		assert.Equal(t, trace[0].SpanID, trace[1].ParentSpanID)
+		assert.Equal(t, trace[1].SpanID, trace[2].ParentSpanID)
+		assert.Equal(t, trace[0].Uid, trace[2].Uid)
+		assert.True(t, trace[2].Duration() >= 0)
+	}
+	assert.NotEqual(t, spans[0].TraceID, spans[3].TraceID)
+	assert.Nil(t, spans[2].Err)
+	assert.NotNil(t, spans[5].Err)
+}
+
+func TestTrace_Join(t *testing.T) {
+	exporter := NewMemoryExporter()
+	engine := NewEngine()
+	engine.SetSpanExporter(exporter)
+	src, err := engine.Spawn(newEcho("src"))
+	assert.Nil(t, err)
+	left, err := engine.Spawn(newEcho("left"))
+	assert.Nil(t, err)
+	right, err := engine.Spawn(newEcho("right"))
+	assert.Nil(t, err)
+	join, err := engine.Spawn(&Joiner{received: make(chan map[string]any, 1)})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddEdge(src, left))
+	assert.Nil(t, engine.AddEdge(src, right))
+	assert.Nil(t, engine.AddEdge(left, join))
+	assert.Nil(t, engine.AddEdge(right, join))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = engine.SendAndWait(ctx, "ok")
+	assert.Nil(t, err)
+
+	spans := make(map[string]Span)
+	for _, span := range exporter.Spans() {
+		spans[span.Name] = span
+	}
+	assert.Equal(t, 4, len(spans))
+	// the join continues from the first parent, and links the other
+	assert.Equal(t, spans["left"].SpanID, spans["joiner"].ParentSpanID)
+	assert.Equal(t, []TraceContext{{TraceID: spans["src"].TraceID, SpanID: spans["right"].SpanID}}, spans["joiner"].Links)
+}
+
+func TestOTLPFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	exporter, err := NewOTLPFileExporter(path, "pipeline", 2)
+	assert.Nil(t, err)
+
+	start := time.Unix(0, 1000)
+	for i := 0; i < 3; i++ {
+		span := Span{
+			TraceID: newTraceID(),
+			SpanID:  newSpanID(),
+			Name:    fmt.Sprintf("actor%d", i),
+			Uid:     "uid",
+			Start:   start,
+			End:     start.Add(time.Millisecond),
+		}
+		if i == 2 {
+			span.Err = fmt.Errorf("boom")
+		}
+		exporter.Export(span)
+	}
+	assert.Nil(t, exporter.Close())
+
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	var spans []otlpSpan
+	scanner := bufio.NewScanner(file)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		var request otlpRequest
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &request))
+		assert.Equal(t, "pipeline", request.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+		spans = append(spans, request.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	assert.Equal(t, 2, lines)
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, 32, len(spans[0].TraceID))
+	assert.Equal(t, 16, len(spans[0].SpanID))
+	assert.Equal(t, "1000", spans[0].StartTimeUnixNano)
+	assert.Equal(t, "1001000", spans[0].EndTimeUnixNano)
+	assert.Equal(t, otlpStatus{Code: otlpStatusOk}, spans[0].Status)
+	assert.Equal(t, otlpStatus{Code: otlpStatusError, Message: "boom"}, spans[2].Status)
+}
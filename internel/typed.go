@@ -0,0 +1,171 @@
+package internel
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// TypedReceiver is an actor of typed messages, wrap it with Typed to spawn it
+type TypedReceiver[In, Out any] interface {
+	String() string
+	Receive(ctx *Context, msg In) (Out, error)
+}
+
+// TypedActor adapts a TypedReceiver to an Actor, it converts the messages to In before the receiver sees them
+// the edges added with AddTypedEdge between TypedActors are checked at Ready: the parent's Out must be assignable to the child's In
+// the lifecycle hooks of the receiver, e.g. PreStart or ErrHandler, are called, a TypedActor can not be a JoinActor
+type TypedActor[In, Out any] struct {
+	receiver TypedReceiver[In, Out]
+}
+
+// Typed wraps the receiver in a TypedActor
+//
+//	parse, _ := engine.Spawn(Typed[string, Order](&Parser{}))
+func Typed[In, Out any](receiver TypedReceiver[In, Out]) *TypedActor[In, Out] {
+	return &TypedActor[In, Out]{receiver: receiver}
+}
+
+// TypedFunc returns a TypedActor named name that calls receive
+func TypedFunc[In, Out any](name string, receive func(ctx *Context, msg In) (Out, error)) *TypedActor[In, Out] {
+	return Typed[In, Out](&typedFunc[In, Out]{name: name, receive: receive})
+}
+
+type typedFunc[In, Out any] struct {
+	name    string
+	receive func(ctx *Context, msg In) (Out, error)
+}
+
+func (f *typedFunc[In, Out]) Receive(ctx *Context, msg In) (Out, error) {
+	return f.receive(ctx, msg)
+}
+
+func (f *typedFunc[In, Out]) String() string {
+	return f.name
+}
+
+// Receive converts msg to In, a message of another type is a permanent error
+func (a *TypedActor[In, Out]) Receive(ctx *Context, msg any) (any, error) {
+	in, ok := msg.(In)
+	if !ok {
+		if msg != nil || !nillable(a.inType()) {
+			return nil, Permanent(fmt.Errorf("actor %s: message of type %T is not %s", a.String(), msg, a.inType()))
+		}
+	}
+	out, err := a.receiver.Receive(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *TypedActor[In, Out]) String() string {
+	return a.receiver.String()
+}
+
+// Receiver returns the wrapped receiver
+func (a *TypedActor[In, Out]) Receiver() TypedReceiver[In, Out] {
+	return a.receiver
+}
+
+func (a *TypedActor[In, Out]) PreStart() {
+	if d, ok := a.receiver.(interface{ PreStart() }); ok {
+		d.PreStart()
+	}
+}
+
+func (a *TypedActor[In, Out]) PostStop() {
+	if d, ok := a.receiver.(interface{ PostStop() }); ok {
+		d.PostStop()
+	}
+}
+
+func (a *TypedActor[In, Out]) PreHandleMsg(ctx *Context, inMsg any) {
+	if d, ok := a.receiver.(interface{ PreHandleMsg(*Context, any) }); ok {
+		d.PreHandleMsg(ctx, inMsg)
+	}
+}
+
+func (a *TypedActor[In, Out]) PostHandleMsg(ctx *Context, outMsg any) {
+	if d, ok := a.receiver.(interface{ PostHandleMsg(*Context, any) }); ok {
+		d.PostHandleMsg(ctx, outMsg)
+	}
+}
+
+func (a *TypedActor[In, Out]) ErrHandler(ctx *Context, err error) {
+	if d, ok := a.receiver.(interface{ ErrHandler(*Context, error) }); ok {
+		d.ErrHandler(ctx, err)
+	}
+}
+
+// MessageTypes declares In and Out, and the types the receiver declares, for the engine's type registry
+// an interface or a Route is not declared, the types of its values are only known at runtime
+func (a *TypedActor[In, Out]) MessageTypes() []any {
+	var types []any
+	for _, t := range []reflect.Type{a.inType(), a.outType()} {
+		if t.Kind() == reflect.Interface || t == reflect.TypeOf(Route{}) {
+			continue
+		}
+		types = append(types, reflect.Zero(t).Interface())
+	}
+	if d, ok := a.receiver.(MessageTypes); ok {
+		types = append(types, d.MessageTypes()...)
+	}
+	return types
+}
+
+func (a *TypedActor[In, Out]) inType() reflect.Type {
+	return reflect.TypeOf((*In)(nil)).Elem()
+}
+
+func (a *TypedActor[In, Out]) outType() reflect.Type {
+	return reflect.TypeOf((*Out)(nil)).Elem()
+}
+
+// typedActor is a TypedActor of any type parameters
+type typedActor interface {
+	inType() reflect.Type
+	outType() reflect.Type
+}
+
+// nillable reports whether nil is a value of t
+func nillable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+// AddTypedEdge adds an edge between two TypedActors, Ready fails if the parent's Out is not assignable to the child's In
+// a parent whose Out is Route is not checked, the type of its data is only known at runtime
+func (e *Engine[Actor]) AddTypedEdge(from, to *Pid) error {
+	for _, pid := range []*Pid{from, to} {
+		if _, ok := pid.actor.(typedActor); !ok {
+			return fmt.Errorf("actor %s is not a TypedActor", pid.actorName)
+		}
+	}
+	if err := e.AddEdge(from, to); err != nil {
+		return err
+	}
+	e.typedEdges = append(e.typedEdges, [2]*Pid{from, to})
+	return nil
+}
+
+// checkTypedEdges returns an error listing every typed edge whose types do not match
+func (e *Engine[Actor]) checkTypedEdges() error {
+	var mismatches []string
+	for _, edge := range e.typedEdges {
+		from, to := edge[0].actor.(typedActor), edge[1].actor.(typedActor)
+		out, in := from.outType(), to.inType()
+		if out == reflect.TypeOf(Route{}) || out.AssignableTo(in) {
+			continue
+		}
+		mismatches = append(mismatches, fmt.Sprintf("%s -> %s: output %s is not assignable to input %s",
+			edge[0].actorName, edge[1].actorName, out, in))
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("typed edges: %s", strings.Join(mismatches, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package internel
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Doubler is a typed actor, its PreStart is called through the adapter
+type Doubler struct {
+	started bool
+}
+
+func (d *Doubler) Receive(ctx *Context, msg int) (int, error) {
+	return msg * 2, nil
+}
+
+func (d *Doubler) PreStart() {
+	d.started = true
+}
+
+func (d *Doubler) String() string {
+	return "double"
+}
+
+func newParser() *TypedActor[string, int] {
+	return TypedFunc("parse", func(ctx *Context, msg string) (int, error) {
+		return strconv.Atoi(msg)
+	})
+}
+
+func newFormatter(name string) *TypedActor[fmt.Stringer, string] {
+	return TypedFunc(name, func(ctx *Context, msg fmt.Stringer) (string, error) {
+		return msg.String(), nil
+	})
+}
+
+func TestEngine_TypedEdges(t *testing.T) {
+	doubler := &Doubler{}
+	engine := NewEngine()
+	parse, err := engine.Spawn(newParser())
+	assert.Nil(t, err)
+	double, err := engine.Spawn(Typed[int, int](doubler))
+	assert.Nil(t, err)
+	format, err := engine.Spawn(TypedFunc("format", func(ctx *Context, msg int) (string, error) {
+		return fmt.Sprintf("#%d", msg), nil
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddTypedEdge(parse, double))
+	assert.Nil(t, engine.AddTypedEdge(double, format))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	outputs, err := engine.SendAndWait(context.Background(), "21")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"format": "#42"}, outputs)
+	assert.True(t, doubler.started)
+
+	// a message of the wrong type fails before the receiver sees it
+	_, err = engine.SendAndWait(context.Background(), 21)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "message of type int is not string"))
+}
+
+func TestEngine_TypedEdgesMismatch(t *testing.T) {
+	engine := NewEngine()
+	parse, err := engine.Spawn(newParser())
+	assert.Nil(t, err)
+	stringer, err := engine.Spawn(newFormatter("stringer"))
+	assert.Nil(t, err)
+	name, err := engine.Spawn(TypedFunc("name", func(ctx *Context, msg string) (string, error) {
+		return msg, nil
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddTypedEdge(parse, stringer))
+	assert.Nil(t, engine.AddTypedEdge(parse, name))
+
+	// every mismatch is reported at once
+	err = engine.Ready()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "parse -> stringer: output int is not assignable to input fmt.Stringer"))
+	assert.True(t, strings.Contains(err.Error(), "parse -> name: output int is not assignable to input string"))
+
+	dummy, err := engine.Spawn(newDummy())
+	assert.Nil(t, err)
+	assert.NotNil(t, engine.AddTypedEdge(parse, dummy))
+}
+
+func TestEngine_TypedEdgesInterface(t *testing.T) {
+	engine := NewEngine()
+	build, err := engine.Spawn(TypedFunc("build", func(ctx *Context, msg string) (*strings.Builder, error) {
+		b := &strings.Builder{}
+		b.WriteString(strings.ToUpper(msg))
+		return b, nil
+	}))
+	assert.Nil(t, err)
+	format, err := engine.Spawn(newFormatter("format"))
+	assert.Nil(t, err)
+	assert.Nil(t, engine.AddTypedEdge(build, format))
+	assert.Nil(t, engine.Ready())
+	defer engine.Shutdown(context.Background())
+
+	outputs, err := engine.SendAndWait(context.Background(), "order")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"format": "ORDER"}, outputs)
+}
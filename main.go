@@ -1,17 +1,328 @@
 package main
 
-// Define the Actor interface
-type Actor interface {
-	Receive(msg interface{})
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fzft/my-actor/internel"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const usage = `actor runs and inspects actor pipelines
+
+Usage:
+  actor run [-root name] [-timeout d] [-v] <spec>       feed newline-delimited JSON from stdin, print the outputs
+  actor validate <spec>                                 check the spec for cycles and unknown actors
+  actor graph <spec>                                    print the DAG of the spec
+  actor bench [-root name] [-n count] [-c concurrency] [-msg json] <spec>
+                                                        push synthetic load, print throughput and latency
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = runCmd(os.Args[2:], os.Stdin, os.Stdout)
+	case "validate":
+		err = validateCmd(os.Args[2:], os.Stdout)
+	case "graph":
+		err = graphCmd(os.Args[2:], os.Stdout)
+	case "bench":
+		err = benchCmd(os.Args[2:], os.Stdout)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "actor %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
 }
 
-// Define an actor struct that implements the Actor interface
-type MyActor struct {
-	state string
+// readSpec parses and validates the spec file
+func readSpec(path string) (*internel.Spec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	spec, err := internel.ParseSpec(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
 }
 
-func (a *MyActor) Receive(msg any) {
+// newLogger logs warnings to stderr, or everything if verbose
+func newLogger(verbose bool) *zap.SugaredLogger {
+	loggerConfig := zap.NewDevelopmentConfig()
+	loggerConfig.EncoderConfig.TimeKey = ""
+	if !verbose {
+		loggerConfig.Level = zap.NewAtomicLevelAt(zapcore.WarnLevel)
+		loggerConfig.DisableStacktrace = true
+	}
+	logger, _ := loggerConfig.Build()
+	return logger.Sugar()
 }
 
-func main() {
+// startEngine starts an engine from the spec file
+func startEngine(path string, verbose bool) (*internel.Engine[internel.Actor], error) {
+	spec, err := readSpec(path)
+	if err != nil {
+		return nil, err
+	}
+	engine := internel.NewEngineWithLogger(newLogger(verbose))
+	if err := engine.BuildSpec(spec); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// ask sends the msg to the named root, or to the only root if name is empty
+func ask(ctx context.Context, engine *internel.Engine[internel.Actor], root string, msg any) (*internel.Future, error) {
+	if root == "" {
+		return engine.Ask(ctx, msg)
+	}
+	return engine.AskTo(ctx, root, msg)
+}
+
+// runResult is a line printed by the run command
+type runResult struct {
+	Line    int            `json:"line"`
+	Outputs map[string]any `json:"outputs,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+func runCmd(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	root := fs.String("root", "", "the root actor to send to, required if the spec has multiple roots")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the outputs of one message")
+	verbose := fs.Bool("v", false, "log everything")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expect one spec file")
+	}
+
+	engine, err := startEngine(fs.Arg(0), *verbose)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		line   int
+		future *internel.Future
+		err    error
+		cancel context.CancelFunc
+	}
+
+	// print the results in the order of the input lines
+	results := make(chan pending, 1024)
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		encoder := json.NewEncoder(stdout)
+		for p := range results {
+			result := runResult{Line: p.line}
+			if p.err == nil {
+				result.Outputs, p.err = p.future.Result()
+			}
+			if p.err != nil {
+				result.Error = p.err.Error()
+			}
+			p.cancel()
+			encoder.Encode(result)
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		p := pending{line: line, cancel: cancel}
+		var msg any
+		if p.err = json.Unmarshal([]byte(text), &msg); p.err == nil {
+			p.future, p.err = ask(ctx, engine, *root, msg)
+		}
+		results <- p
+	}
+	close(results)
+	<-printed
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := engine.Shutdown(ctx); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+func validateCmd(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expect one spec file")
+	}
+
+	spec, err := readSpec(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "ok: %d actors, %d edges\n", len(spec.Actors), len(spec.Edges))
+	return nil
+}
+
+func graphCmd(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expect one spec file")
+	}
+
+	spec, err := readSpec(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	dag, err := spec.DAG()
+	if err != nil {
+		return err
+	}
+
+	types := make(map[string]string, len(spec.Actors))
+	for _, actor := range spec.Actors {
+		types[actor.Name] = actor.Type
+	}
+
+	sorted, err := dag.TopologicalSort()
+	if err != nil {
+		return err
+	}
+	for _, node := range sorted {
+		var kind []string
+		if dag.InDegree(node) == 0 {
+			kind = append(kind, "root")
+		}
+		if len(dag.Neighbors(node)) == 0 {
+			kind = append(kind, "leaf")
+		}
+		fmt.Fprintf(stdout, "%s (%s) %s\n", node, types[node.String()], strings.Join(kind, ","))
+	}
+	for _, edge := range dag.Edges {
+		fmt.Fprintf(stdout, "%s -> %s\n", edge.From, edge.To)
+	}
+	return nil
+}
+
+func benchCmd(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	root := fs.String("root", "", "the root actor to send to, required if the spec has multiple roots")
+	n := fs.Int("n", 10000, "number of messages")
+	c := fs.Int("c", 64, "number of messages in flight")
+	raw := fs.String("msg", `{"seq": 0}`, "the JSON message to send")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the outputs of one message")
+	verbose := fs.Bool("v", false, "log everything")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expect one spec file")
+	}
+	if *n <= 0 || *c <= 0 {
+		return fmt.Errorf("-n and -c must be positive")
+	}
+
+	var msg any
+	if err := json.Unmarshal([]byte(*raw), &msg); err != nil {
+		return fmt.Errorf("-msg: %w", err)
+	}
+
+	engine, err := startEngine(fs.Arg(0), *verbose)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, *n)
+		failed    int
+		wg        sync.WaitGroup
+	)
+	sem := make(chan struct{}, *c)
+	start := time.Now()
+	for i := 0; i < *n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			sent := time.Now()
+			future, err := ask(ctx, engine, *root, msg)
+			if err == nil {
+				_, err = future.Result()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				return
+			}
+			latencies = append(latencies, time.Since(sent))
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := engine.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	fmt.Fprintf(stdout, "messages:   %d (%d failed)\n", *n, failed)
+	fmt.Fprintf(stdout, "elapsed:    %s\n", elapsed)
+	fmt.Fprintf(stdout, "throughput: %.0f msg/s\n", float64(*n)/elapsed.Seconds())
+	fmt.Fprintf(stdout, "latency:    p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	return nil
 }
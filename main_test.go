@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSpec = `
+actors:
+  - name: src
+    type: identity
+  - name: tag
+    type: set
+    config: {fields: {seen: true}}
+edges:
+  - {from: src, to: tag}
+`
+
+// TestMain runs the CLI instead of the tests when the test binary is started by runCLI
+func TestMain(m *testing.M) {
+	if os.Getenv("ACTOR_CLI") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCLI runs the CLI with the args and stdin, returns its stdout, stderr and exit code
+func runCLI(t *testing.T, stdin string, args ...string) (string, string, int) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "ACTOR_CLI=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return stdout.String(), stderr.String(), exit.ExitCode()
+	}
+	assert.Nil(t, err)
+	return stdout.String(), stderr.String(), 0
+}
+
+// writeSpec writes the spec to a file in a temp dir
+func writeSpec(t *testing.T, spec string) string {
+	path := filepath.Join(t.TempDir(), "spec.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(spec), 0o644))
+	return path
+}
+
+func TestCLI_Run(t *testing.T) {
+	path := writeSpec(t, testSpec)
+	stdout, stderr, code := runCLI(t, "{\"id\": 1}\n\nnot json\n{\"id\": 2}\n", "run", path)
+	assert.Equal(t, 0, code, stderr)
+
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, `{"line":1,"outputs":{"tag":{"id":1,"seen":true}}}`, lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], `{"line":3,"error":"invalid character`), lines[1])
+	assert.Equal(t, `{"line":4,"outputs":{"tag":{"id":2,"seen":true}}}`, lines[2])
+}
+
+func TestCLI_ValidateGraph(t *testing.T) {
+	path := writeSpec(t, testSpec)
+	stdout, stderr, code := runCLI(t, "", "validate", path)
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "ok: 2 actors, 1 edges\n", stdout)
+
+	stdout, stderr, code = runCLI(t, "", "graph", path)
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "src (identity) root\ntag (set) leaf\nsrc -> tag\n", stdout)
+}
+
+func TestCLI_InvalidSpec(t *testing.T) {
+	cycle := writeSpec(t, `
+actors: [{name: a, type: identity}, {name: b, type: identity}]
+edges: [{from: a, to: b}, {from: b, to: a}]
+`)
+	unknown := writeSpec(t, "actors: [{name: a, type: nope}]")
+	empty := writeSpec(t, "actors: []")
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	for _, cmd := range []string{"run", "validate", "graph"} {
+		for path, want := range map[string]string{
+			cycle:   "edge b -> a: adding this edge would create a cycle",
+			unknown: `actor a has unknown type "nope"`,
+			empty:   "spec has no actors",
+			missing: "no such file or directory",
+		} {
+			stdout, stderr, code := runCLI(t, "", cmd, path)
+			assert.Equal(t, 1, code, cmd)
+			assert.Equal(t, "", stdout, cmd)
+			assert.True(t, strings.HasPrefix(stderr, "actor "+cmd+": "), stderr)
+			assert.Contains(t, stderr, want, cmd)
+		}
+	}
+
+	// an unknown command and a missing spec are usage errors
+	_, stderr, code := runCLI(t, "", "nope")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, `unknown command "nope"`)
+	_, stderr, code = runCLI(t, "", "validate")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "actor validate: expect one spec file\n", stderr)
+}
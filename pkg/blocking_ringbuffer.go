@@ -0,0 +1,64 @@
+package pkg
+
+// BlockingRingBuffer is a LockFreeRingBuffer whose Dequeue waits for a value with the given WaitStrategy
+type BlockingRingBuffer struct {
+	buffer *LockFreeRingBuffer
+	wait   WaitStrategy
+}
+
+func NewBlockingRingBuffer(capacity int, wait WaitStrategy) *BlockingRingBuffer {
+	return &BlockingRingBuffer{
+		buffer: NewLockFreeRingBuffer(capacity),
+		wait:   wait,
+	}
+}
+
+// Enqueue adds a value and wakes up the consumer, returns false if the buffer is full
+func (rb *BlockingRingBuffer) Enqueue(val any) bool {
+	if !rb.buffer.Enqueue(val) {
+		return false
+	}
+	rb.wait.Signal()
+	return true
+}
+
+// Dequeue blocks until a value is available, returns false once stopCh is closed
+func (rb *BlockingRingBuffer) Dequeue(stopCh <-chan struct{}) (any, bool) {
+	for attempt := 0; ; attempt++ {
+		if val, ok := rb.buffer.Dequeue(); ok {
+			if !rb.buffer.IsEmpty() {
+				// pass the signal on, another consumer may be parked while values are left
+				rb.wait.Signal()
+			}
+			return val, true
+		}
+
+		select {
+		case <-stopCh:
+			return nil, false
+		default:
+		}
+		rb.wait.Wait(attempt, stopCh)
+	}
+}
+
+// TryDequeue removes a value without waiting
+func (rb *BlockingRingBuffer) TryDequeue() (any, bool) {
+	return rb.buffer.Dequeue()
+}
+
+func (rb *BlockingRingBuffer) IsEmpty() bool {
+	return rb.buffer.IsEmpty()
+}
+
+func (rb *BlockingRingBuffer) IsFull() bool {
+	return rb.buffer.IsFull()
+}
+
+func (rb *BlockingRingBuffer) Len() int {
+	return rb.buffer.Len()
+}
+
+func (rb *BlockingRingBuffer) Capacity() int {
+	return rb.buffer.Capacity()
+}
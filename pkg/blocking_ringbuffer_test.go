@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func waitStrategies() map[string]func() WaitStrategy {
+	return map[string]func() WaitStrategy{
+		"BusySpin": func() WaitStrategy { return NewBusySpinWaitStrategy() },
+		"Yielding": func() WaitStrategy { return NewYieldingWaitStrategy(100) },
+		"Sleeping": func() WaitStrategy { return NewSleepingWaitStrategy(time.Microsecond, time.Millisecond) },
+		"Blocking": func() WaitStrategy { return NewBlockingWaitStrategy() },
+	}
+}
+
+func TestBlockingRingBufferDequeueWait(t *testing.T) {
+	for name, newWait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			rb := NewBlockingRingBuffer(8, newWait())
+			stopCh := make(chan struct{})
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				rb.Enqueue(1)
+				rb.Enqueue(2)
+			}()
+
+			val, ok := rb.Dequeue(stopCh)
+			assert.True(t, ok)
+			assert.Equal(t, 1, val)
+			val, ok = rb.Dequeue(stopCh)
+			assert.True(t, ok)
+			assert.Equal(t, 2, val)
+		})
+	}
+}
+
+func TestBlockingRingBufferStop(t *testing.T) {
+	for name, newWait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			rb := NewBlockingRingBuffer(8, newWait())
+			stopCh := make(chan struct{})
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				close(stopCh)
+			}()
+
+			val, ok := rb.Dequeue(stopCh)
+			assert.False(t, ok)
+			assert.Nil(t, val)
+		})
+	}
+}
+
+func TestBlockingRingBufferFull(t *testing.T) {
+	rb := NewBlockingRingBuffer(3, NewBlockingWaitStrategy())
+	assert.True(t, rb.Enqueue(1))
+	assert.True(t, rb.Enqueue(2))
+	assert.False(t, rb.Enqueue(3))
+	assert.True(t, rb.IsFull())
+
+	val, ok := rb.TryDequeue()
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+}
@@ -223,6 +223,67 @@ func (dag *DAG[Stringer]) LeafNodes() []*Node[Stringer] {
 	return leafNodes
 }
 
+// InDegree returns the number of edges that point to the node
+func (dag *DAG[Stringer]) InDegree(node *Node[Stringer]) int {
+	degree := 0
+	for _, edge := range dag.Edges {
+		if edge.To == node {
+			degree++
+		}
+	}
+	return degree
+}
+
+// Parents returns the nodes that have an edge to the node
+func (dag *DAG[Stringer]) Parents(node *Node[Stringer]) []*Node[Stringer] {
+	parents := make([]*Node[Stringer], 0)
+	for _, edge := range dag.Edges {
+		if edge.To == node {
+			parents = append(parents, edge.From)
+		}
+	}
+	return parents
+}
+
+// RootNodes returns all nodes that no edge points to
+func (dag *DAG[Stringer]) RootNodes() []*Node[Stringer] {
+	rootNodes := make([]*Node[Stringer], 0)
+
+	for _, node := range dag.Nodes {
+		if dag.InDegree(node) == 0 {
+			rootNodes = append(rootNodes, node)
+		}
+	}
+
+	return rootNodes
+}
+
+// ReachableLeafNodes returns the leaf nodes that can be reached from the given node
+func (dag *DAG[Stringer]) ReachableLeafNodes(from *Node[Stringer]) []*Node[Stringer] {
+	leafNodes := make([]*Node[Stringer], 0)
+	visited := make(map[*Node[Stringer]]bool)
+
+	var visit func(node *Node[Stringer])
+	visit = func(node *Node[Stringer]) {
+		if visited[node] {
+			return
+		}
+		visited[node] = true
+
+		neighbors := dag.Neighbors(node)
+		if len(neighbors) == 0 {
+			leafNodes = append(leafNodes, node)
+			return
+		}
+		for _, neighbor := range neighbors {
+			visit(neighbor)
+		}
+	}
+	visit(from)
+
+	return leafNodes
+}
+
 // GetNonLeafNodes returns all nodes that are not leaf nodes
 func (dag *DAG[Stringer]) GetNonLeafNodes() []*Node[Stringer] {
 	noLeafNodes := make([]*Node[Stringer], 0)
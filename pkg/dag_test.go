@@ -110,6 +110,34 @@ func TestDAG_Neighbors(t *testing.T) {
 	assert.Equal(t, "C", neighbors[1].Value.String())
 }
 
+func TestDAG_RootNodes(t *testing.T) {
+	dag := newTestDag(t)
+	rootNodes := dag.RootNodes()
+	assert.Equal(t, 2, len(rootNodes))
+	assert.Equal(t, "A", rootNodes[0].Value.String())
+	assert.Equal(t, "G", rootNodes[1].Value.String())
+
+	nodeF := dag.Nodes[5]
+	assert.Equal(t, 2, dag.InDegree(nodeF))
+	parents := dag.Parents(nodeF)
+	assert.Equal(t, 2, len(parents))
+	assert.Equal(t, "E", parents[0].Value.String())
+	assert.Equal(t, "D", parents[1].Value.String())
+}
+
+func TestDAG_ReachableLeafNodes(t *testing.T) {
+	dag := newTestDag(t)
+	nodeA := dag.Nodes[0]
+	leafNodes := dag.ReachableLeafNodes(nodeA)
+	assert.Equal(t, 1, len(leafNodes))
+	assert.Equal(t, "F", leafNodes[0].Value.String())
+
+	nodeF := dag.Nodes[5]
+	leafNodes = dag.ReachableLeafNodes(nodeF)
+	assert.Equal(t, 1, len(leafNodes))
+	assert.Equal(t, "F", leafNodes[0].Value.String())
+}
+
 func newTestDag(t *testing.T) *DAG[Stringer] {
 
 	dag := &DAG[Stringer]{}
@@ -1,5 +1,7 @@
 package pkg
 
+import "sync"
+
 type KeyValueStore[K comparable, V any] struct {
 	data        map[K]V
 	getCh       chan *GetRequest[K, V]
@@ -12,6 +14,10 @@ type KeyValueStore[K comparable, V any] struct {
 	popAllValCh chan *PopAllValRequest[V]
 	popAllKeyCh chan *PopAllKeyRequest[K]
 	popValByKey chan *PopValByKeyRequest[K, V]
+	itemsCh     chan *ItemsRequest[K, V]
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type PopValByKeyRequest[K comparable, V any] struct {
@@ -20,6 +26,10 @@ type PopValByKeyRequest[K comparable, V any] struct {
 	existsResponse chan bool
 }
 
+type ItemsRequest[K comparable, V any] struct {
+	response chan map[K]V
+}
+
 type PopAllValRequest[V any] struct {
 	response chan []V
 }
@@ -75,6 +85,8 @@ func NewKeyValueStore[K comparable, V any]() *KeyValueStore[K, V] {
 		popAllValCh: make(chan *PopAllValRequest[V]),
 		popAllKeyCh: make(chan *PopAllKeyRequest[K]),
 		popValByKey: make(chan *PopValByKeyRequest[K, V]),
+		itemsCh:     make(chan *ItemsRequest[K, V]),
+		done:        make(chan struct{}),
 	}
 
 	go store.run()
@@ -84,6 +96,8 @@ func NewKeyValueStore[K comparable, V any]() *KeyValueStore[K, V] {
 func (store *KeyValueStore[K, V]) run() {
 	for {
 		select {
+		case <-store.done:
+			return
 		case req := <-store.getCh:
 			value, exists := store.data[req.key]
 			req.valueResponse <- value
@@ -120,6 +134,12 @@ func (store *KeyValueStore[K, V]) run() {
 			}
 			store.data = make(map[K]V)
 			req.response <- keys
+		case req := <-store.itemsCh:
+			items := make(map[K]V, len(store.data))
+			for key, value := range store.data {
+				items[key] = value
+			}
+			req.response <- items
 		case req := <-store.popValByKey:
 			value, exists := store.data[req.key]
 			if exists {
@@ -137,7 +157,12 @@ func (store *KeyValueStore[K, V]) Get(key K) (V, bool) {
 		valueResponse:  make(chan V),
 		existsResponse: make(chan bool),
 	}
-	store.getCh <- req
+	select {
+	case store.getCh <- req:
+	case <-store.done:
+		var value V
+		return value, false
+	}
 	value := <-req.valueResponse
 	exists := <-req.existsResponse
 	return value, exists
@@ -148,7 +173,10 @@ func (store *KeyValueStore[K, V]) Put(key K, value V) {
 		key:   key,
 		value: value,
 	}
-	store.setCh <- req
+	select {
+	case store.setCh <- req:
+	case <-store.done:
+	}
 }
 
 // Has returns true if the key exists.
@@ -157,7 +185,11 @@ func (store *KeyValueStore[K, V]) Has(key K) bool {
 		key:      key,
 		response: make(chan bool),
 	}
-	store.hasCh <- req
+	select {
+	case store.hasCh <- req:
+	case <-store.done:
+		return false
+	}
 	return <-req.response
 }
 
@@ -168,7 +200,11 @@ func (store *KeyValueStore[K, V]) HasOrAdd(key K, value V) bool {
 		value:    value,
 		response: make(chan bool),
 	}
-	store.hasOrAddCh <- req
+	select {
+	case store.hasOrAddCh <- req:
+	case <-store.done:
+		return false
+	}
 	return <-req.response
 }
 
@@ -176,14 +212,21 @@ func (store *KeyValueStore[K, V]) Delete(key K) {
 	req := &DeleteRequest[K]{
 		key: key,
 	}
-	store.deleteCh <- req
+	select {
+	case store.deleteCh <- req:
+	case <-store.done:
+	}
 }
 
 func (store *KeyValueStore[K, V]) Clear() {
 	req := &ClearRequest{
 		done: make(chan struct{}),
 	}
-	store.clearCh <- req
+	select {
+	case store.clearCh <- req:
+	case <-store.done:
+		return
+	}
 	<-req.done
 }
 
@@ -191,7 +234,11 @@ func (store *KeyValueStore[K, V]) Len() int {
 	req := &LenRequest{
 		response: make(chan int),
 	}
-	store.lenCh <- req
+	select {
+	case store.lenCh <- req:
+	case <-store.done:
+		return 0
+	}
 	return <-req.response
 }
 
@@ -200,7 +247,11 @@ func (store *KeyValueStore[K, V]) PopAllVal() []V {
 	req := &PopAllValRequest[V]{
 		response: make(chan []V),
 	}
-	store.popAllValCh <- req
+	select {
+	case store.popAllValCh <- req:
+	case <-store.done:
+		return nil
+	}
 	return <-req.response
 }
 
@@ -209,7 +260,24 @@ func (store *KeyValueStore[K, V]) PopAllKey() []K {
 	req := &PopAllKeyRequest[K]{
 		response: make(chan []K),
 	}
-	store.popAllKeyCh <- req
+	select {
+	case store.popAllKeyCh <- req:
+	case <-store.done:
+		return nil
+	}
+	return <-req.response
+}
+
+// Items returns a copy of all key-value pairs.
+func (store *KeyValueStore[K, V]) Items() map[K]V {
+	req := &ItemsRequest[K, V]{
+		response: make(chan map[K]V),
+	}
+	select {
+	case store.itemsCh <- req:
+	case <-store.done:
+		return nil
+	}
 	return <-req.response
 }
 
@@ -220,8 +288,20 @@ func (store *KeyValueStore[K, V]) PopValByKey(key K) (V, bool) {
 		response:       make(chan V),
 		existsResponse: make(chan bool),
 	}
-	store.popValByKey <- req
+	select {
+	case store.popValByKey <- req:
+	case <-store.done:
+		var value V
+		return value, false
+	}
 	value := <-req.response
 	exists := <-req.existsResponse
 	return value, exists
 }
+
+// Close stops the store's goroutine, operations on a closed store are no-ops
+func (store *KeyValueStore[K, V]) Close() {
+	store.closeOnce.Do(func() {
+		close(store.done)
+	})
+}
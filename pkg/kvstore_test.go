@@ -106,3 +106,29 @@ func TestKeyValueStorePopValByKey(t *testing.T) {
 	assert.Equal(t, "one", val)
 	assert.Equal(t, 2, store.Len())
 }
+
+func TestKeyValueStoreItems(t *testing.T) {
+	store := NewKeyValueStore[int, string]()
+	store.Put(1, "one")
+	store.Put(2, "two")
+
+	items := store.Items()
+	assert.Equal(t, map[int]string{1: "one", 2: "two"}, items)
+
+	// the items are a copy
+	items[3] = "three"
+	assert.Equal(t, 2, store.Len())
+}
+
+func TestKeyValueStoreClose(t *testing.T) {
+	store := NewKeyValueStore[int, string]()
+	store.Put(1, "one")
+	store.Close()
+	store.Close()
+
+	_, exist := store.Get(1)
+	assert.False(t, exist)
+	assert.Equal(t, 0, store.Len())
+	store.Put(2, "two")
+	assert.False(t, store.Has(2))
+}
@@ -2,84 +2,119 @@ package pkg
 
 import (
 	"sync/atomic"
-	"unsafe"
 )
 
-type Value struct {
-	data    any
-	version uint64
+// slot is a cell of the ring buffer, seq tells whose turn it is:
+// seq == pos, a producer at pos may write it; seq == pos+1, a consumer at pos may read it
+type slot struct {
+	seq  uint64
+	data any
 }
 
+// LockFreeRingBuffer is a bounded queue safe for several producers and consumers
+// every slot carries a sequence number, so a producer that has claimed a slot and not written it yet
+// is never read as an empty or a stale value
 type LockFreeRingBuffer struct {
-	buffer   []unsafe.Pointer
-	head     uint64
-	tail     uint64
-	capacity uint64
+	// slots has one more slot than size, a full slot and a free one of the next lap never share a seq
+	slots []slot
+	size  uint64
+
+	_    [56]byte
+	head uint64 // next position to dequeue
+	_    [56]byte
+	tail uint64 // next position to enqueue
+	_    [56]byte
 }
 
+// NewLockFreeRingBuffer returns a ring buffer that holds capacity-1 values
 func NewLockFreeRingBuffer(capacity int) *LockFreeRingBuffer {
+	size := capacity - 1
+	if size < 1 {
+		size = 1
+	}
 	rb := &LockFreeRingBuffer{
-		buffer:   make([]unsafe.Pointer, capacity),
-		capacity: uint64(capacity),
+		slots: make([]slot, size+1),
+		size:  uint64(size),
 	}
-	for i := 0; i < capacity; i++ {
-		rb.buffer[i] = unsafe.Pointer(&Value{})
+	for i := range rb.slots {
+		rb.slots[i].seq = uint64(i)
 	}
 	return rb
 }
 
+// Enqueue adds a value, returns false if the buffer is full
 func (rb *LockFreeRingBuffer) Enqueue(val any) bool {
+	n := uint64(len(rb.slots))
+	pos := atomic.LoadUint64(&rb.tail)
 	for {
-		head := atomic.LoadUint64(&rb.head)
-		tail := atomic.LoadUint64(&rb.tail)
-		if (tail+1)%rb.capacity == head%rb.capacity {
+		if head := atomic.LoadUint64(&rb.head); pos >= head && pos-head >= rb.size {
 			return false
 		}
-
-		expected := tail
-		if atomic.CompareAndSwapUint64(&rb.tail, expected, (tail+1)%rb.capacity) {
-			idx := tail % rb.capacity
-			newValue := &Value{data: val, version: tail + rb.capacity}
-			atomic.StorePointer(&rb.buffer[idx], unsafe.Pointer(newValue))
-			return true
+		s := &rb.slots[pos%n]
+		seq := atomic.LoadUint64(&s.seq)
+		switch diff := int64(seq - pos); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&rb.tail, pos, pos+1) {
+				s.data = val
+				atomic.StoreUint64(&s.seq, pos+1)
+				return true
+			}
+			pos = atomic.LoadUint64(&rb.tail)
+		case diff < 0:
+			// the slot still holds the value of the previous lap
+			return false
+		default:
+			pos = atomic.LoadUint64(&rb.tail)
 		}
 	}
 }
 
+// Dequeue removes the oldest value, returns false if the buffer is empty
 func (rb *LockFreeRingBuffer) Dequeue() (any, bool) {
+	n := uint64(len(rb.slots))
+	pos := atomic.LoadUint64(&rb.head)
 	for {
-		head := atomic.LoadUint64(&rb.head)
-		tail := atomic.LoadUint64(&rb.tail)
-		if head == tail {
+		s := &rb.slots[pos%n]
+		seq := atomic.LoadUint64(&s.seq)
+		switch diff := int64(seq - (pos + 1)); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&rb.head, pos, pos+1) {
+				val := s.data
+				s.data = nil
+				atomic.StoreUint64(&s.seq, pos+n)
+				return val, true
+			}
+			pos = atomic.LoadUint64(&rb.head)
+		case diff < 0:
+			// nothing written at pos yet
 			return nil, false
-		}
-
-		idx := head % rb.capacity
-		value := (*Value)(atomic.LoadPointer(&rb.buffer[idx]))
-
-		if value.version <= head {
-			continue
-		}
-
-		expected := head
-		if atomic.CompareAndSwapUint64(&rb.head, expected, (head+1)%rb.capacity) {
-			return value.data, true
+		default:
+			pos = atomic.LoadUint64(&rb.head)
 		}
 	}
 }
 
 func (rb *LockFreeRingBuffer) IsEmpty() bool {
-	head := atomic.LoadUint64(&rb.head)
-	tail := atomic.LoadUint64(&rb.tail)
-	return head == tail
+	return rb.Len() == 0
 }
 
 func (rb *LockFreeRingBuffer) IsFull() bool {
+	return rb.Len() >= int(rb.size)
+}
+
+// Len returns the number of values in the ring buffer, including the ones being written
+func (rb *LockFreeRingBuffer) Len() int {
 	head := atomic.LoadUint64(&rb.head)
 	tail := atomic.LoadUint64(&rb.tail)
-	return (tail+1)%rb.capacity == head%rb.capacity
+	if tail <= head {
+		return 0
+	}
+	if n := tail - head; n < rb.size {
+		return int(n)
+	}
+	return int(rb.size)
 }
 
 func (rb *LockFreeRingBuffer) Capacity() int {
-	return int(rb.capacity) - 1
+	return int(rb.size)
 }
@@ -1,7 +1,9 @@
 package pkg
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -85,6 +87,23 @@ func TestLFRingBufferCapacity(t *testing.T) {
 	}
 }
 
+func TestLFRingBufferLen(t *testing.T) {
+	rb := NewLockFreeRingBuffer(3)
+	assert.Equal(t, 0, rb.Len())
+
+	rb.Enqueue(1)
+	rb.Enqueue(2)
+	assert.Equal(t, 2, rb.Len())
+
+	rb.Dequeue()
+	rb.Enqueue(3)
+	assert.Equal(t, 2, rb.Len())
+
+	rb.Dequeue()
+	rb.Dequeue()
+	assert.Equal(t, 0, rb.Len())
+}
+
 // TestLFRingBufferConcurrent tests concurrent access to the ring buffer
 func TestLFRingBufferConcurrent(t *testing.T) {
 	rb := NewLockFreeRingBuffer(5)
@@ -94,10 +113,10 @@ func TestLFRingBufferConcurrent(t *testing.T) {
 
 	go func() {
 		time.Sleep(10 * time.Second)
-		<-stopCh
+		close(stopCh)
 
 		time.Sleep(3 * time.Second)
-		<-quitCh
+		close(quitCh)
 	}()
 
 	go func() {
@@ -112,10 +131,68 @@ func TestLFRingBufferConcurrent(t *testing.T) {
 
 	go func() {
 		for {
-			rb.Dequeue()
+			select {
+			case <-stopCh:
+				return
+			default:
+				rb.Dequeue()
+			}
 		}
 	}()
 
 	<-quitCh
 
 }
+
+// TestLFRingBufferMultiProducer every value of several producers is dequeued exactly once
+func TestLFRingBufferMultiProducer(t *testing.T) {
+	// a buffer of capacity 2 holds one value, its only slot is reused on every lap
+	for _, capacity := range []int{2, 64} {
+		t.Run(fmt.Sprint(capacity), func(t *testing.T) {
+			testMultiProducer(t, NewLockFreeRingBuffer(capacity))
+		})
+	}
+}
+
+func testMultiProducer(t *testing.T, rb *LockFreeRingBuffer) {
+	const producers, perProducer = 4, 20000
+
+	for p := 0; p < producers; p++ {
+		go func(p int) {
+			for i := 0; i < perProducer; i++ {
+				for !rb.Enqueue(p*perProducer + i) {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+
+	seen := make([]int, producers*perProducer)
+	last := make([]int, producers)
+	for i := range last {
+		last[i] = -1
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for n := 0; n < producers*perProducer; {
+		val, ok := rb.Dequeue()
+		if !ok {
+			if time.Now().After(deadline) {
+				t.Fatalf("dequeued %d values, the others are lost", n)
+			}
+			runtime.Gosched()
+			continue
+		}
+		v := val.(int)
+		seen[v]++
+		// the values of one producer keep their order
+		assert.Greater(t, v%perProducer, last[v/perProducer])
+		last[v/perProducer] = v % perProducer
+		n++
+	}
+	for v, count := range seen {
+		if count != 1 {
+			t.Fatalf("value %d dequeued %d times", v, count)
+		}
+	}
+	assert.True(t, rb.IsEmpty())
+}
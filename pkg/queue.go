@@ -25,11 +25,39 @@ func (q *Queue) Enqueue(item any) {
 	q.cond.Signal()
 }
 
-func (q *Queue) Dequeue() any {
+// Len returns the number of items in the queue
+func (q *Queue) Len() int {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
+	return len(q.items)
+}
+
+// Dequeue blocks until an item is available, returns nil once stopCh is closed
+func (q *Queue) Dequeue(stopCh <-chan struct{}) any {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if len(q.items) == 0 && stopCh != nil {
+		// wake up the waiter when stopCh is closed
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-stopCh:
+				q.cond.L.Lock()
+				q.cond.Broadcast()
+				q.cond.L.Unlock()
+			case <-done:
+			}
+		}()
+	}
 
 	for len(q.items) == 0 {
+		select {
+		case <-stopCh:
+			return nil
+		default:
+		}
 		q.cond.Wait()
 	}
 
@@ -24,3 +24,18 @@ func TestQueue(t *testing.T) {
 		fmt.Println(item)
 	}
 }
+
+func TestQueue_DequeueStop(t *testing.T) {
+	stopCh := make(chan struct{})
+	q := NewQueue(8)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(stopCh)
+	}()
+
+	// blocks on the empty queue until stopCh is closed
+	if item := q.Dequeue(stopCh); item != nil {
+		t.Errorf("Dequeue should return nil after stop, got %v", item)
+	}
+}
@@ -4,14 +4,13 @@ import "testing"
 
 func BenchmarkLockFreeRingBuffer(b *testing.B) {
 	rb := NewLockFreeRingBuffer(1024)
-	stopCh := make(chan struct{})
 	b.RunParallel(func(pb *testing.PB) {
 		i := 0
 		for pb.Next() {
 			if i%2 == 0 {
 				rb.Enqueue(i)
 			} else {
-				rb.Dequeue(stopCh)
+				rb.Dequeue()
 			}
 			i++
 		}
@@ -32,3 +31,29 @@ func BenchmarkLockBasedRingBuffer(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkBlockingRingBuffer one producer and one waiting consumer, for every wait strategy
+func BenchmarkBlockingRingBuffer(b *testing.B) {
+	for name, newWait := range waitStrategies() {
+		b.Run(name, func(b *testing.B) {
+			rb := NewBlockingRingBuffer(1024, newWait())
+			stopCh := make(chan struct{})
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				for i := 0; i < b.N; i++ {
+					rb.Dequeue(stopCh)
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for !rb.Enqueue(i) {
+				}
+			}
+			<-done
+			close(stopCh)
+		})
+	}
+}
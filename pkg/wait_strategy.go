@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"runtime"
+	"time"
+)
+
+// WaitStrategy is how a consumer waits for an empty ring buffer to be filled, like the LMAX Disruptor wait strategies
+type WaitStrategy interface {
+	// Wait is called every time the consumer finds the buffer empty, attempt counts the empty polls in a row
+	// it returns when the consumer should poll again, or when stopCh is closed
+	Wait(attempt int, stopCh <-chan struct{})
+
+	// Signal is called by the producer after every enqueue
+	Signal()
+}
+
+// BusySpinWaitStrategy polls the buffer in a tight loop, lowest latency but burns a full core
+type BusySpinWaitStrategy struct{}
+
+func NewBusySpinWaitStrategy() *BusySpinWaitStrategy {
+	return &BusySpinWaitStrategy{}
+}
+
+func (w *BusySpinWaitStrategy) Wait(attempt int, stopCh <-chan struct{}) {}
+
+func (w *BusySpinWaitStrategy) Signal() {}
+
+// YieldingWaitStrategy spins for spinTries polls, then yields the processor between polls
+type YieldingWaitStrategy struct {
+	spinTries int
+}
+
+func NewYieldingWaitStrategy(spinTries int) *YieldingWaitStrategy {
+	return &YieldingWaitStrategy{spinTries: spinTries}
+}
+
+func (w *YieldingWaitStrategy) Wait(attempt int, stopCh <-chan struct{}) {
+	if attempt < w.spinTries {
+		return
+	}
+	runtime.Gosched()
+}
+
+func (w *YieldingWaitStrategy) Signal() {}
+
+// SleepingWaitStrategy backs off exponentially from min to max between polls
+type SleepingWaitStrategy struct {
+	min time.Duration
+	max time.Duration
+}
+
+func NewSleepingWaitStrategy(min, max time.Duration) *SleepingWaitStrategy {
+	return &SleepingWaitStrategy{min: min, max: max}
+}
+
+func (w *SleepingWaitStrategy) Wait(attempt int, stopCh <-chan struct{}) {
+	backoff := w.max
+	if attempt < 32 && w.min<<uint(attempt) < w.max {
+		backoff = w.min << uint(attempt)
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-stopCh:
+	case <-timer.C:
+	}
+}
+
+func (w *SleepingWaitStrategy) Signal() {}
+
+// BlockingWaitStrategy parks the consumer until the producer signals, an idle consumer costs nothing
+type BlockingWaitStrategy struct {
+	notify chan struct{}
+}
+
+func NewBlockingWaitStrategy() *BlockingWaitStrategy {
+	return &BlockingWaitStrategy{notify: make(chan struct{}, 1)}
+}
+
+func (w *BlockingWaitStrategy) Wait(attempt int, stopCh <-chan struct{}) {
+	select {
+	case <-stopCh:
+	case <-w.notify:
+	}
+}
+
+func (w *BlockingWaitStrategy) Signal() {
+	// the pending signal is enough to wake up the consumer, drop the rest
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}